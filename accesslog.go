@@ -0,0 +1,146 @@
+package tcpee
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// Connection closer values, i.e. the side that closed first.
+const (
+	CloserClient = "client"
+	CloserServer = "server"
+	CloserProxy  = "proxy"
+)
+
+// Connection termination reasons.
+const (
+	ReasonEOF      = "eof"
+	ReasonTimeout  = "timeout"
+	ReasonReset    = "reset"
+	ReasonShutdown = "shutdown"
+	ReasonDial     = "dial_failure"
+	ReasonKilled   = "killed"
+	ReasonBlocked  = "blocked"
+	ReasonError    = "error"
+)
+
+// errIdleTimeout is returned by copyConn on a conn idle timeout.
+var errIdleTimeout = errors.New("tcpee: idle timeout")
+
+// AccessRecord is the record of a single proxied connection, emitted on close.
+type AccessRecord struct {
+	// ID is the unique connection ID.
+	ID string
+
+	// Proxy is the name of the proxy serving this connection.
+	Proxy string
+
+	// Src is the client address.
+	Src string
+
+	// Listener is the route address the client connected to.
+	Listener string
+
+	// Backend is the backend address, resolved if connected.
+	Backend string
+
+	// Start and End are the connection start and end times.
+	Start time.Time
+	End   time.Time
+
+	// BytesIn and BytesOut are the no. bytes proxied
+	// client -> server, and server -> client.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// Closer is the side that closed first, see Closer{Client,Server,Proxy}.
+	Closer string
+
+	// Reason is the termination reason, see Reason{EOF,Timeout,...}.
+	Reason string
+}
+
+// Duration returns the connection duration.
+func (rec *AccessRecord) Duration() time.Duration {
+	return rec.End.Sub(rec.Start)
+}
+
+// Fields returns the access record as key-value fields.
+func (rec *AccessRecord) Fields() kv.Fields {
+	return kv.Fields{
+		{K: "id", V: rec.ID},
+		{K: "proxy", V: rec.Proxy},
+		{K: "src", V: rec.Src},
+		{K: "listener", V: rec.Listener},
+		{K: "backend", V: rec.Backend},
+		{K: "start", V: rec.Start.Format(time.RFC3339Nano)},
+		{K: "end", V: rec.End.Format(time.RFC3339Nano)},
+		{K: "duration", V: rec.Duration().String()},
+		{K: "bytes_in", V: rec.BytesIn},
+		{K: "bytes_out", V: rec.BytesOut},
+		{K: "closer", V: rec.Closer},
+		{K: "reason", V: rec.Reason},
+	}
+}
+
+// logAccess emits the access record for a closed connection, to the
+// proxy's access log if set, else to the global logger.
+func (proxy *TCPProxy) logAccess(rec *AccessRecord) {
+	if proxy.AccessLog == nil {
+		log.InfoKVs(append(rec.Fields(), kv.Field{
+			K: "msg", V: "connection closed",
+		})...)
+		return
+	}
+
+	if err := proxy.AccessLog.Write(rec); err != nil {
+		log.ErrorKVs(kv.Fields{
+			{K: "proxy", V: proxy.Name},
+			{K: "error", V: err},
+			{K: "msg", V: "access log error"},
+		}...)
+	}
+}
+
+// closeReason returns the termination reason for a copyConn error.
+func closeReason(err error) string {
+	switch {
+	case err == nil:
+		return ReasonEOF
+	case err == errIdleTimeout:
+		return ReasonTimeout
+	case err == ErrProxyClosed:
+		return ReasonShutdown
+	case errors.Is(err, ErrBlocked):
+		return ReasonBlocked
+	case errors.Is(err, syscall.ECONNRESET):
+		return ReasonReset
+	default:
+		return ReasonError
+	}
+}
+
+var (
+	// connIDPrefix is the per-process random conn ID prefix.
+	connIDPrefix = func() string {
+		var b [4]byte
+		_, _ = rand.Read(b[:])
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[:])), 16) + "-"
+	}()
+
+	// connIDCount is the conn ID counter.
+	connIDCount uint64
+)
+
+// newConnID returns a new process-unique connection ID.
+func newConnID() string {
+	return connIDPrefix + strconv.FormatUint(atomic.AddUint64(&connIDCount, 1), 16)
+}
@@ -0,0 +1,71 @@
+package tcpee
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestCloseReason(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		reason string
+	}{
+		{err: nil, reason: ReasonEOF},
+		{err: errIdleTimeout, reason: ReasonTimeout},
+		{err: ErrProxyClosed, reason: ReasonShutdown},
+		{err: fmt.Errorf("filter: %w", ErrBlocked), reason: ReasonBlocked},
+		{err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, reason: ReasonReset},
+		{err: errors.New("other"), reason: ReasonError},
+	} {
+		if reason := closeReason(test.err); reason != test.reason {
+			t.Errorf("closeReason(%v) = %q, expected %q", test.err, reason, test.reason)
+		}
+	}
+}
+
+func TestNewConnID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newConnID()
+		if seen[id] {
+			t.Fatalf("duplicate conn ID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestAccessRecord(t *testing.T) {
+	hooks := newRecordHooks()
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web", Hooks: hooks})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	// Client closes
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	conn.Close()
+
+	rec := hooks.next(t)
+	if rec.Proxy != "web" || rec.Listener != "front" || rec.Backend != "backend" {
+		t.Errorf("record addrs = %+v", rec)
+	}
+	if rec.BytesIn != 5 || rec.BytesOut != 5 {
+		t.Errorf("record bytes in=%d out=%d", rec.BytesIn, rec.BytesOut)
+	}
+	if rec.Closer != CloserClient || rec.Reason != ReasonEOF {
+		t.Errorf("record closer=%s reason=%s", rec.Closer, rec.Reason)
+	}
+	if rec.ID == "" || rec.End.Before(rec.Start) {
+		t.Errorf("record id=%q duration=%v", rec.ID, rec.Duration())
+	}
+
+	// Backend unreachable
+	startRoute(t, proxy, Route{Src: "lazy", Dst: "missing", Startup: StartupLazy, Fallback: "missing"})
+	_, _ = readAll(mn.dial(t, "lazy"))
+	if rec := hooks.next(t); rec.Reason != ReasonDial || rec.Backend != "missing" {
+		t.Errorf("dial failure record reason=%s backend=%s", rec.Reason, rec.Backend)
+	}
+}
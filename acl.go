@@ -0,0 +1,315 @@
+package tcpee
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// aclPollInterval is the interval at which ACL files are checked for changes.
+const aclPollInterval = 5 * time.Second
+
+// ACL is an access control list of allowed and denied IPs / CIDRs, for both
+// IPv4 and IPv6. The most specific matching entry decides whether an address
+// is allowed, with deny winning for identical entries. An address matching no
+// entries is allowed only if the ACL contains no allow entries.
+type ACL struct {
+	// Allow is a list of allowed IPs / CIDRs.
+	Allow []string
+
+	// Deny is a list of denied IPs / CIDRs.
+	Deny []string
+
+	// AllowFile is an optional path to a file of further allowed
+	// IPs / CIDRs, one per line with '#' comments. It is reloaded
+	// on change while the ACL is in use by a proxy.
+	AllowFile string
+
+	// DenyFile is as AllowFile, but for denied IPs / CIDRs.
+	DenyFile string
+
+	trie     atomic.Value  // trie is the currently loaded *aclTrie
+	mutex    sync.Mutex    // mutex protects mtimes during (re)load, and the watcher state
+	mtimes   [2]time.Time  // mtimes are the last loaded file mod times
+	watchers int           // watchers is the no. routes watching the ACL
+	stop     chan struct{} // stop is closed to stop the running file watcher
+	denied   uint64        // denied tracks the no. denied addresses
+}
+
+// Load (re)builds the ACL from its allow / deny lists and files, returning
+// an error on any invalid entry. The previous ACL state is kept on error.
+func (acl *ACL) Load() error {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	return acl.load()
+}
+
+// load is the underlying Load() implementation, expecting the mutex held.
+func (acl *ACL) load() error {
+	trie := &aclTrie{}
+
+	// Insert the static entries
+	if err := trie.insertAll(acl.Deny, false); err != nil {
+		return err
+	}
+	if err := trie.insertAll(acl.Allow, true); err != nil {
+		return err
+	}
+
+	// Insert the entries from files
+	var mtimes [2]time.Time
+	for i, path := range []string{acl.DenyFile, acl.AllowFile} {
+		if len(path) < 1 {
+			continue
+		}
+		entries, mtime, err := readACLFile(path)
+		if err != nil {
+			return err
+		}
+		if err := trie.insertAll(entries, i == 1); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		mtimes[i] = mtime
+	}
+
+	acl.trie.Store(trie)
+	acl.mtimes = mtimes
+	return nil
+}
+
+// Allowed returns whether the supplied IP is allowed by the ACL. A nil
+// or not-yet-loaded ACL allows everything.
+func (acl *ACL) Allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	trie, _ := acl.trie.Load().(*aclTrie)
+	if trie == nil || trie.allowed(ip) {
+		return true
+	}
+	atomic.AddUint64(&acl.denied, 1)
+	return false
+}
+
+// Denied returns the total no. addresses denied by this ACL.
+func (acl *ACL) Denied() uint64 {
+	if acl == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&acl.denied)
+}
+
+// reload reloads the ACL if any of its files have changed since last load.
+func (acl *ACL) reload() error {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+
+	for i, path := range []string{acl.DenyFile, acl.AllowFile} {
+		if len(path) < 1 {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !stat.ModTime().Equal(acl.mtimes[i]) {
+			return acl.load()
+		}
+	}
+
+	return nil
+}
+
+// watch starts a file watcher for this ACL (if it has files, and none is
+// already running), which reloads the ACL on change until done is closed
+// for every route watching it, e.g. once replaced by a reload.
+func (acl *ACL) watch(name string, done <-chan struct{}) {
+	if acl == nil || (acl.AllowFile == "" && acl.DenyFile == "") {
+		return
+	}
+
+	acl.mutex.Lock()
+	acl.watchers++
+	if acl.watchers == 1 {
+		acl.stop = make(chan struct{})
+		go acl.poll(name, acl.stop)
+	}
+	acl.mutex.Unlock()
+
+	go func() {
+		<-done
+		acl.mutex.Lock()
+		acl.watchers--
+		if acl.watchers == 0 {
+			close(acl.stop)
+		}
+		acl.mutex.Unlock()
+	}()
+}
+
+// poll reloads the ACL on change of its files until stop is closed.
+func (acl *ACL) poll(name string, stop <-chan struct{}) {
+	tick := time.NewTicker(aclPollInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
+		if err := acl.reload(); err != nil {
+			log.ErrorKVs(kv.Fields{
+				{K: "proxy", V: name},
+				{K: "error", V: err},
+				{K: "msg", V: "acl reload error"},
+			}...)
+		}
+	}
+}
+
+// readACLFile reads the IP / CIDR entries from file at path.
+func readACLFile(path string) ([]string, time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			entries = append(entries, line)
+		}
+	}
+
+	return entries, stat.ModTime(), scanner.Err()
+}
+
+// aclNode is a single node in a binary prefix trie.
+type aclNode struct {
+	child [2]*aclNode // child are the next-bit child nodes
+	set   bool        // set indicates an entry ends at this node
+	allow bool        // allow is the entry's action
+}
+
+// aclTrie is a pair of IPv4 and IPv6 binary prefix tries.
+type aclTrie struct {
+	v4     aclNode // v4 is the IPv4 trie root
+	v6     aclNode // v6 is the IPv6 trie root
+	allows bool    // allows indicates any allow entries exist
+}
+
+// insertAll parses and inserts all IP / CIDR entries with action.
+func (trie *aclTrie) insertAll(entries []string, allow bool) error {
+	for _, entry := range entries {
+		ipnet, err := parseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		trie.insert(ipnet, allow)
+	}
+	return nil
+}
+
+// insert inserts the supplied IP network with action into the trie.
+func (trie *aclTrie) insert(ipnet *net.IPNet, allow bool) {
+	ones, _ := ipnet.Mask.Size()
+
+	node := &trie.v6
+	if len(ipnet.IP) == net.IPv4len {
+		node = &trie.v4
+	}
+
+	for i := 0; i < ones; i++ {
+		bit := ipnet.IP[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &aclNode{}
+		}
+		node = node.child[bit]
+	}
+
+	if node.set && !node.allow {
+		// deny wins on
+		// identical entry
+		return
+	}
+
+	node.set = true
+	node.allow = allow
+	trie.allows = trie.allows || allow
+}
+
+// allowed looks-up the most specific entry matching IP, returning its action.
+// A nil IP, i.e. a non-IP source, matches no entries.
+func (trie *aclTrie) allowed(ip net.IP) bool {
+	if ip == nil {
+		return !trie.allows
+	}
+	node := &trie.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		node, ip = &trie.v4, ip4
+	}
+
+	allow := !trie.allows
+	for i := 0; node != nil; i++ {
+		if node.set {
+			allow = node.allow
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		node = node.child[bit]
+	}
+
+	return allow
+}
+
+// parseCIDR parses an IP or CIDR string, returning the IP network with
+// IPv4 networks, including IPv4-mapped IPv6 networks such as
+// "::ffff:192.168.0.0/112", in their 4-byte form.
+func parseCIDR(str string) (*net.IPNet, error) {
+	if !strings.Contains(str, "/") {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", str)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(str)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		// Masked IP only maps to IPv4 if the
+		// prefix covers the ::ffff:0:0/96 bits
+		ones, bits := ipnet.Mask.Size()
+		ipnet.IP = ip4
+		ipnet.Mask = net.CIDRMask(ones-(bits-32), 32)
+	}
+	return ipnet, nil
+}
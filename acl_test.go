@@ -0,0 +1,241 @@
+package tcpee
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCIDR(t *testing.T) {
+	for _, test := range []struct {
+		str string
+		net string
+		err bool
+	}{
+		{str: "192.0.2.1", net: "192.0.2.1/32"},
+		{str: "192.0.2.0/24", net: "192.0.2.0/24"},
+		{str: "192.0.2.77/24", net: "192.0.2.0/24"},
+		{str: "2001:db8::1", net: "2001:db8::1/128"},
+		{str: "2001:db8::/32", net: "2001:db8::/32"},
+		{str: "::ffff:192.0.2.1", net: "192.0.2.1/32"},
+		{str: "::ffff:192.168.0.0/112", net: "192.168.0.0/16"},
+		{str: "::ffff:0:0/96", net: "0.0.0.0/0"},
+		{str: "::/0", net: "::/0"},
+		{str: "192.0.2.256", err: true},
+		{str: "192.0.2.0/33", err: true},
+		{str: "example.com", err: true},
+	} {
+		ipnet, err := parseCIDR(test.str)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseCIDR(%q) = %v, expected error", test.str, ipnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCIDR(%q): %v", test.str, err)
+		} else if ipnet.String() != test.net {
+			t.Errorf("parseCIDR(%q) = %s, expected %s", test.str, ipnet, test.net)
+		}
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "empty",
+			allowed: []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name:    "deny only",
+			deny:    []string{"192.0.2.0/24", "2001:db8::/32"},
+			allowed: []string{"198.51.100.1", "2001:db9::1"},
+			denied:  []string{"192.0.2.1", "::ffff:192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name:    "allow only",
+			allow:   []string{"10.0.0.0/8"},
+			allowed: []string{"10.1.2.3"},
+			denied:  []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name:    "most specific wins",
+			allow:   []string{"10.0.0.0/8", "10.1.1.1"},
+			deny:    []string{"10.1.0.0/16"},
+			allowed: []string{"10.2.0.1", "10.1.1.1"},
+			denied:  []string{"10.1.1.2", "11.0.0.1"},
+		},
+		{
+			name:   "deny wins identical",
+			allow:  []string{"192.0.2.0/24"},
+			deny:   []string{"192.0.2.0/24"},
+			denied: []string{"192.0.2.1"},
+		},
+		{
+			name:    "mapped entry",
+			allow:   []string{"::ffff:192.168.0.0/112"},
+			allowed: []string{"192.168.1.1", "::ffff:192.168.1.1"},
+			denied:  []string{"192.169.0.1"},
+		},
+		{
+			name:    "v6 catch-all",
+			allow:   []string{"0.0.0.0/0"},
+			deny:    []string{"::/0"},
+			allowed: []string{"192.0.2.1"},
+			denied:  []string{"2001:db8::1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			acl := &ACL{Allow: test.allow, Deny: test.deny}
+			if err := acl.Load(); err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range test.allowed {
+				if !acl.Allowed(parseIP(t, ip)) {
+					t.Errorf("%s denied", ip)
+				}
+			}
+			for _, ip := range test.denied {
+				if acl.Allowed(parseIP(t, ip)) {
+					t.Errorf("%s allowed", ip)
+				}
+			}
+			if acl.Denied() != uint64(len(test.denied)) {
+				t.Errorf("Denied() = %d, expected %d", acl.Denied(), len(test.denied))
+			}
+		})
+	}
+}
+
+func TestACLNil(t *testing.T) {
+	var acl *ACL
+	if !acl.Allowed(parseIP(t, "192.0.2.1")) {
+		t.Fatal("nil ACL denied")
+	}
+	if !(&ACL{Deny: []string{"0.0.0.0/0"}}).Allowed(parseIP(t, "192.0.2.1")) {
+		t.Fatal("unloaded ACL denied")
+	}
+}
+
+func TestACLLoadError(t *testing.T) {
+	acl := &ACL{Deny: []string{"192.0.2.0/24"}}
+	if err := acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	acl.Deny = []string{"bad"}
+	if err := acl.Load(); err == nil {
+		t.Fatal("invalid entry loaded")
+	}
+	if acl.Allowed(parseIP(t, "192.0.2.1")) {
+		t.Fatal("previous ACL not kept on error")
+	}
+}
+
+func TestACLFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny")
+	write := func(data string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# comment\n192.0.2.0/24 # trailing\n\n", time.Now().Add(-time.Hour))
+	acl := &ACL{DenyFile: path}
+	if err := acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Allowed(parseIP(t, "192.0.2.1")) || !acl.Allowed(parseIP(t, "198.51.100.1")) {
+		t.Fatal("file entries not loaded")
+	}
+
+	// Unchanged file is not reloaded
+	if err := acl.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	write("198.51.100.0/24\n", time.Now())
+	if err := acl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allowed(parseIP(t, "192.0.2.1")) || acl.Allowed(parseIP(t, "198.51.100.1")) {
+		t.Fatal("changed file not reloaded")
+	}
+}
+
+func TestACLRoute(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{ACL: &ACL{Deny: []string{"0.0.0.0/0"}}})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "denied", Dst: "backend"})
+	startRoute(t, proxy, Route{Src: "allowed", Dst: "backend", ACL: &ACL{Allow: []string{"0.0.0.0/0"}}})
+
+	if msg, err := readAll(mn.dial(t, "denied")); msg != "" || err != nil {
+		t.Fatalf("denied conn read %q, %v", msg, err)
+	}
+	roundTrip(t, mn.dial(t, "allowed"), "hello")
+
+	if stats := proxy.Stats(); stats.Denied != 1 {
+		t.Fatalf("proxy denied = %d", stats.Denied)
+	}
+}
+
+func TestACLWatchRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny")
+	if err := os.WriteFile(path, []byte("192.0.2.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchers := func(acl *ACL, n int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			acl.mutex.Lock()
+			watchers := acl.watchers
+			acl.mutex.Unlock()
+			if watchers == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("watchers = %d, expected %d", watchers, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	acl := &ACL{DenyFile: path}
+	proxy, mn := newMemProxy(t, &TCPProxy{ACL: acl})
+	mn.echo(t, "backend")
+	h1 := startRoute(t, proxy, Route{Src: "front1", Dst: "backend"})
+	h2 := startRoute(t, proxy, Route{Src: "front2", Dst: "backend"})
+	waitWatchers(acl, 2)
+
+	// Watched until its last route stops
+	h1.Stop()
+	waitWatchers(acl, 1)
+	if err := h2.Replace(Route{Src: "front2", Dst: "backend", ACL: &ACL{Deny: []string{"192.0.2.0/24"}}}); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchers(acl, 0)
+	select {
+	case <-acl.stop:
+	default:
+		t.Fatal("watcher not stopped")
+	}
+
+	// Routes failing to load an ACL aren't registered
+	os.Remove(path)
+	if _, err := proxy.StartRoute(Route{Src: "front3", Dst: "backend", ACL: &ACL{DenyFile: path}}); err == nil {
+		t.Fatal("route started without ACL file")
+	}
+	if n := len(proxy.Stats().Routes); n != 1 {
+		t.Fatalf("%d routes registered", n)
+	}
+}
@@ -0,0 +1,379 @@
+package tcpee
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// Admin is an http.Handler serving a JSON admin API over a set of proxies:
+//
+//	GET    /conns                  list active conns, filtered by query
+//	DELETE /conns                  kill active conns matching query (one filter required)
+//	DELETE /conns/{id}             kill active conn with ID
+//	GET    /stats                  list proxy stats
+//	GET    /stats/{name}           get stats of proxy with name
+//	GET    /errors                 list recent conn errors, newest first
+//	GET    /backends               list backend stats
+//	POST   /backends/{addr}/drain  drain backend at address
+//	DELETE /backends/{addr}/drain  undrain backend at address
+//	GET    /bans                   list active bans
+//	DELETE /bans/{ip}              lift ban on source IP
+//	POST   /reload                 reload configuration
+//
+// Conn, error and backend queries accept a "proxy" filter, conn queries additionally
+// accept "route", "backend" and "src" (IP / CIDR) filters.
+//
+// The API has no authentication. As a guard against cross-site requests, POST and
+// DELETE requests must set the AdminHeader, or a JSON content type, else they are
+// forbidden. Even so, it should only be served to trusted users, e.g. over a unix
+// socket, and never exposed on a public TCP address.
+type Admin struct {
+	// Proxies are the proxies served by the admin API. To
+	// change them while serving, use SetProxies() instead.
+	Proxies []*TCPProxy
+
+	// Bans is the banlist served by the admin API, if any.
+	Bans *Banlist
+
+	// Reload is an optional configuration reload function.
+	// If nil, reload requests are responded to as unsupported.
+	Reload func() error
+
+	mutex sync.RWMutex // mutex protects Proxies once serving
+}
+
+// SetProxies safely replaces the proxies served by the admin API,
+// e.g. following a configuration reload.
+func (a *Admin) SetProxies(proxies []*TCPProxy) {
+	a.mutex.Lock()
+	a.Proxies = proxies
+	a.mutex.Unlock()
+}
+
+// proxies returns the proxies served by the admin API.
+func (a *Admin) proxies() []*TCPProxy {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.Proxies
+}
+
+// ProxyBackend is a proxy's backend stats, as served by the admin API.
+type ProxyBackend struct {
+	// Proxy is the name of the proxy.
+	Proxy string `json:"proxy"`
+
+	// BackendStats are the backend stats.
+	BackendStats
+}
+
+// connFilter is a set of active conn filters, parsed from a query.
+type connFilter struct {
+	proxy   string     // proxy is the proxy name to match
+	route   string     // route is the listener address to match
+	backend string     // backend is the backend address to match
+	src     *net.IPNet // src is the source network to match
+}
+
+// AdminHeader is the request header marking admin API requests as non cross-site.
+const AdminHeader = "X-Tcpee-Admin"
+
+// ServeHTTP implements http.Handler.
+func (a *Admin) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Forbid possibly cross-site mutating requests
+	if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+		r.Header.Get(AdminHeader) == "" &&
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		writeError(rw, http.StatusForbidden, "missing "+AdminHeader+" header")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	name, arg := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, arg = path[:i], path[i+1:]
+	}
+
+	switch name {
+	case "conns":
+		a.serveConns(rw, r, arg)
+	case "stats":
+		a.serveStats(rw, r, arg)
+	case "errors":
+		a.serveErrors(rw, r)
+	case "backends":
+		a.serveBackends(rw, r, arg)
+	case "bans":
+		a.serveBans(rw, r, arg)
+	case "reload":
+		a.serveReload(rw, r)
+	default:
+		writeError(rw, http.StatusNotFound, "not found")
+	}
+}
+
+// serveConns serves the /conns endpoints.
+func (a *Admin) serveConns(rw http.ResponseWriter, r *http.Request, id string) {
+	switch {
+	// Kill conn by ID
+	case id != "" && r.Method == http.MethodDelete:
+		for _, proxy := range a.proxies() {
+			if proxy.Kill(id) {
+				logKilled(proxy.Name, id)
+				writeJSON(rw, http.StatusOK, map[string]int{"killed": 1})
+				return
+			}
+		}
+		writeError(rw, http.StatusNotFound, "connection not found")
+
+	case id != "":
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+
+	// List / kill conns by filter
+	case r.Method == http.MethodGet, r.Method == http.MethodDelete:
+		filter, err := parseConnFilter(r)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if r.Method == http.MethodDelete && filter == (connFilter{}) {
+			writeError(rw, http.StatusBadRequest, "refusing to kill all connections, supply a filter")
+			return
+		}
+
+		conns := []Conn{}
+		killed := 0
+		for _, proxy := range a.proxies() {
+			for _, conn := range proxy.Conns() {
+				if !filter.match(conn) {
+					continue
+				}
+				if r.Method == http.MethodGet {
+					conns = append(conns, conn)
+				} else if proxy.Kill(conn.ID) {
+					logKilled(proxy.Name, conn.ID)
+					killed++
+				}
+			}
+		}
+
+		if r.Method == http.MethodGet {
+			writeJSON(rw, http.StatusOK, conns)
+		} else {
+			writeJSON(rw, http.StatusOK, map[string]int{"killed": killed})
+		}
+
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// serveStats serves the /stats endpoints.
+func (a *Admin) serveStats(rw http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if name == "" {
+		proxies := a.proxies()
+		stats := make([]ProxyStats, 0, len(proxies))
+		for _, proxy := range proxies {
+			stats = append(stats, proxy.Stats())
+		}
+		writeJSON(rw, http.StatusOK, stats)
+		return
+	}
+
+	for _, proxy := range a.proxies() {
+		if proxy.Name == name {
+			writeJSON(rw, http.StatusOK, proxy.Stats())
+			return
+		}
+	}
+
+	writeError(rw, http.StatusNotFound, "proxy not found")
+}
+
+// serveErrors serves the /errors endpoint.
+func (a *Admin) serveErrors(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := r.URL.Query().Get("proxy")
+	errs := []ConnError{}
+	for _, proxy := range a.proxies() {
+		if name == "" || name == proxy.Name {
+			errs = append(errs, proxy.Errors()...)
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Time.After(errs[j].Time)
+	})
+
+	writeJSON(rw, http.StatusOK, errs)
+}
+
+// serveBackends serves the /backends endpoints.
+func (a *Admin) serveBackends(rw http.ResponseWriter, r *http.Request, arg string) {
+	name := r.URL.Query().Get("proxy")
+
+	switch {
+	// List backend stats
+	case arg == "" && r.Method == http.MethodGet:
+		backends := []ProxyBackend{}
+		for _, proxy := range a.proxies() {
+			if name != "" && name != proxy.Name {
+				continue
+			}
+			for _, stats := range proxy.Stats().Backends {
+				backends = append(backends, ProxyBackend{
+					Proxy:        proxy.Name,
+					BackendStats: stats,
+				})
+			}
+		}
+		writeJSON(rw, http.StatusOK, backends)
+
+	// (Un)drain backend
+	case strings.HasSuffix(arg, "/drain") &&
+		(r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		addr := strings.TrimSuffix(arg, "/drain")
+		drained := 0
+		for _, proxy := range a.proxies() {
+			if name != "" && name != proxy.Name {
+				continue
+			}
+			if proxy.Drain(addr, r.Method == http.MethodPost) {
+				drained++
+			}
+		}
+		if drained == 0 {
+			writeError(rw, http.StatusNotFound, "backend not found")
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]int{"proxies": drained})
+
+	case arg == "", strings.HasSuffix(arg, "/drain"):
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+
+	default:
+		writeError(rw, http.StatusNotFound, "not found")
+	}
+}
+
+// serveReload serves the /reload endpoint.
+func (a *Admin) serveReload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if a.Reload == nil {
+		writeError(rw, http.StatusNotImplemented, "reload not supported")
+		return
+	}
+
+	if err := a.Reload(); err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+// serveBans serves the /bans endpoints.
+func (a *Admin) serveBans(rw http.ResponseWriter, r *http.Request, ip string) {
+	switch {
+	// List active bans
+	case ip == "" && r.Method == http.MethodGet:
+		bans := a.Bans.Bans()
+		if bans == nil {
+			bans = []Ban{}
+		}
+		writeJSON(rw, http.StatusOK, bans)
+
+	// Lift ban on source
+	case ip != "" && r.Method == http.MethodDelete:
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			writeError(rw, http.StatusBadRequest, "invalid IP address")
+			return
+		}
+		if !a.Bans.Unban(addr) {
+			writeError(rw, http.StatusNotFound, "source not banned")
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]int{"unbanned": 1})
+
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// parseConnFilter parses an active conn filter from the request query.
+func parseConnFilter(r *http.Request) (connFilter, error) {
+	query := r.URL.Query()
+	filter := connFilter{
+		proxy:   query.Get("proxy"),
+		route:   query.Get("route"),
+		backend: query.Get("backend"),
+	}
+	if src := query.Get("src"); src != "" {
+		ipnet, err := parseCIDR(src)
+		if err != nil {
+			return filter, err
+		}
+		filter.src = ipnet
+	}
+	return filter, nil
+}
+
+// match returns whether the supplied conn matches the filter.
+func (filter *connFilter) match(conn Conn) bool {
+	if (filter.proxy != "" && filter.proxy != conn.Proxy) ||
+		(filter.route != "" && filter.route != conn.Listener) ||
+		(filter.backend != "" && filter.backend != conn.Backend) {
+		return false
+	}
+	if filter.src != nil {
+		host, _, err := net.SplitHostPort(conn.Src)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && filter.src.Contains(ip)
+	}
+	return true
+}
+
+// logKilled logs a connection killed via the admin API.
+func logKilled(name string, id string) {
+	log.InfoKVs(kv.Fields{
+		{K: "proxy", V: name},
+		{K: "id", V: id},
+		{K: "msg", V: "connection killed"},
+	}...)
+}
+
+// writeJSON writes v as a JSON response with status code.
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+// writeError writes a JSON error response with status code.
+func writeError(rw http.ResponseWriter, code int, msg string) {
+	writeJSON(rw, code, map[string]string{"error": msg})
+}
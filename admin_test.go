@@ -0,0 +1,215 @@
+package tcpee
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// request serves a request to the admin API, decoding the JSON
+// response into v (if non-nil) and returning the status code.
+func request(t *testing.T, a *Admin, method string, target string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set(AdminHeader, "1")
+	a.ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s %s: content type %q", method, target, ct)
+	}
+	if v != nil {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminConns(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web"})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+	a := &Admin{Proxies: []*TCPProxy{proxy}}
+
+	c1 := mn.dial(t, "front")
+	roundTrip(t, c1, "hello")
+	c2 := mn.dial(t, "front")
+	roundTrip(t, c2, "hi")
+
+	var conns []Conn
+	if code := request(t, a, "GET", "/conns", &conns); code != http.StatusOK || len(conns) != 2 {
+		t.Fatalf("GET /conns = %d %+v", code, conns)
+	}
+	if conns[0].Proxy != "web" || conns[0].Listener != "front" || conns[0].Backend != "backend" {
+		t.Fatalf("conns = %+v", conns)
+	}
+
+	for target, n := range map[string]int{
+		"/conns?proxy=web":            2,
+		"/conns?proxy=other":          0,
+		"/conns?route=front":          2,
+		"/conns?backend=elsewhere":    0,
+		"/conns?src=127.0.0.0/8":      2,
+		"/conns?src=127.0.0.1":        2,
+		"/conns?src=192.0.2.0/24":     0,
+		"/conns?src=::ffff:127.0.0.1": 2,
+	} {
+		var got []Conn
+		if code := request(t, a, "GET", target, &got); code != http.StatusOK || len(got) != n {
+			t.Errorf("GET %s = %d, %d conns, expected %d", target, code, len(got), n)
+		}
+	}
+
+	if code := request(t, a, "GET", "/conns?src=bogus", nil); code != http.StatusBadRequest {
+		t.Errorf("GET invalid src = %d", code)
+	}
+	if code := request(t, a, "DELETE", "/conns", nil); code != http.StatusBadRequest {
+		t.Errorf("DELETE without filter = %d", code)
+	}
+
+	// Kill by ID
+	var killed map[string]int
+	if code := request(t, a, "DELETE", "/conns/"+conns[0].ID, &killed); code != http.StatusOK || killed["killed"] != 1 {
+		t.Fatalf("DELETE by ID = %d %v", code, killed)
+	}
+	if code := request(t, a, "DELETE", "/conns/"+conns[0].ID, nil); code != http.StatusNotFound {
+		t.Errorf("DELETE killed ID = %d", code)
+	}
+	if _, err := readAll(c1); err != nil {
+		t.Fatalf("killed conn not closed: %v", err)
+	}
+	waitOpen(t, proxy, 1)
+
+	// Kill by filter
+	if code := request(t, a, "DELETE", "/conns?route=front", &killed); code != http.StatusOK || killed["killed"] != 1 {
+		t.Fatalf("DELETE by filter = %d %v", code, killed)
+	}
+	waitOpen(t, proxy, 0)
+}
+
+func TestAdminStatus(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web"})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	var reloads int
+	a := &Admin{
+		Proxies: []*TCPProxy{proxy},
+		Bans:    &Banlist{Threshold: 1, Window: time.Minute, BanTime: time.Minute},
+		Reload: func() error {
+			if reloads++; reloads > 1 {
+				return errors.New("bad config")
+			}
+			return nil
+		},
+	}
+	a.Bans.Record(parseIP(t, "192.0.2.1"), EventEmptyConn)
+
+	for _, test := range []struct {
+		method string
+		target string
+		code   int
+	}{
+		{"GET", "/", http.StatusNotFound},
+		{"GET", "/unknown", http.StatusNotFound},
+		{"POST", "/conns", http.StatusMethodNotAllowed},
+		{"GET", "/conns/123", http.StatusMethodNotAllowed},
+		{"GET", "/stats", http.StatusOK},
+		{"GET", "/stats/web", http.StatusOK},
+		{"GET", "/stats/other", http.StatusNotFound},
+		{"POST", "/stats", http.StatusMethodNotAllowed},
+		{"GET", "/errors", http.StatusOK},
+		{"DELETE", "/errors", http.StatusMethodNotAllowed},
+		{"GET", "/backends", http.StatusOK},
+		{"GET", "/backends/backend/drain", http.StatusMethodNotAllowed},
+		{"POST", "/backends/backend/drain", http.StatusOK},
+		{"DELETE", "/backends/backend/drain", http.StatusOK},
+		{"POST", "/backends/other/drain", http.StatusNotFound},
+		{"POST", "/backends/backend/drain?proxy=other", http.StatusNotFound},
+		{"POST", "/backends/backend", http.StatusNotFound},
+		{"GET", "/bans", http.StatusOK},
+		{"DELETE", "/bans/bogus", http.StatusBadRequest},
+		{"DELETE", "/bans/192.0.2.2", http.StatusNotFound},
+		{"DELETE", "/bans/192.0.2.1", http.StatusOK},
+		{"DELETE", "/bans/192.0.2.1", http.StatusNotFound},
+		{"POST", "/bans", http.StatusMethodNotAllowed},
+		{"GET", "/reload", http.StatusMethodNotAllowed},
+		{"POST", "/reload", http.StatusOK},
+		{"POST", "/reload", http.StatusInternalServerError},
+	} {
+		if code := request(t, a, test.method, test.target, nil); code != test.code {
+			t.Errorf("%s %s = %d, expected %d", test.method, test.target, code, test.code)
+		}
+	}
+
+	a.Reload = nil
+	if code := request(t, a, "POST", "/reload", nil); code != http.StatusNotImplemented {
+		t.Errorf("POST /reload unsupported = %d", code)
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web"})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+	a := &Admin{}
+	a.SetProxies([]*TCPProxy{proxy})
+
+	if code := request(t, a, "POST", "/backends/backend/drain", nil); code != http.StatusOK {
+		t.Fatalf("drain = %d", code)
+	}
+
+	var backends []ProxyBackend
+	request(t, a, "GET", "/backends", &backends)
+	if len(backends) != 1 || backends[0].Proxy != "web" || backends[0].Backend != "backend" || !backends[0].Drained {
+		t.Fatalf("backends = %+v", backends)
+	}
+	request(t, a, "GET", "/backends?proxy=other", &backends)
+	if len(backends) != 0 {
+		t.Fatalf("filtered backends = %+v", backends)
+	}
+
+	// Drained backend rejects new conns
+	if _, err := readAll(mn.dial(t, "front")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := proxy.Stats(); stats.Rejected != 1 || stats.Conns != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	if code := request(t, a, "DELETE", "/backends/backend/drain", nil); code != http.StatusOK {
+		t.Fatalf("undrain = %d", code)
+	}
+	roundTrip(t, mn.dial(t, "front"), "hello")
+}
+
+func TestAdminCrossSite(t *testing.T) {
+	a := &Admin{Reload: func() error { return nil }}
+
+	for _, test := range []struct {
+		method string
+		header string
+		value  string
+		code   int
+	}{
+		{"GET", "", "", http.StatusMethodNotAllowed},
+		{"POST", "", "", http.StatusForbidden},
+		{"POST", "Content-Type", "text/plain", http.StatusForbidden},
+		{"POST", "Content-Type", "application/x-www-form-urlencoded", http.StatusForbidden},
+		{"POST", "Content-Type", "application/json", http.StatusOK},
+		{"POST", AdminHeader, "1", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(test.method, "/reload", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		a.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s /reload %s: %s = %d, expected %d", test.method, test.header, test.value, rec.Code, test.code)
+		}
+	}
+}
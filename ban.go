@@ -0,0 +1,410 @@
+package tcpee
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// defaultBanForgetTime is the ban forget time used when none is set.
+const defaultBanForgetTime = 24 * time.Hour
+
+// banSaveDelay is the delay after a ban change before the state file is
+// written, batching the writes for bursts of bans / unbans.
+const banSaveDelay = time.Second
+
+// BanEvent is a type of abusive client behaviour tracked by a Banlist.
+type BanEvent int
+
+const (
+	// EventEmptyConn is a client connection closed before sending any bytes.
+	EventEmptyConn BanEvent = iota
+
+	// EventBackendReset is a backend resetting a connection within its first second.
+	EventBackendReset
+
+	// EventACLDenied is a client connection denied by an access control list.
+	EventACLDenied
+
+	// EventLimitBreached is a client connection breaching a per-source limit.
+	EventLimitBreached
+)
+
+// String returns the string representation of event.
+func (event BanEvent) String() string {
+	switch event {
+	case EventEmptyConn:
+		return "empty_conn"
+	case EventBackendReset:
+		return "backend_reset"
+	case EventACLDenied:
+		return "acl_denied"
+	case EventLimitBreached:
+		return "limit_breached"
+	default:
+		return "unknown"
+	}
+}
+
+// Ban describes a single banned source address.
+type Ban struct {
+	// IP is the banned source address.
+	IP string `json:"ip"`
+
+	// Until is the time at which the ban expires.
+	Until time.Time `json:"until"`
+
+	// Count is the no. times this source has been banned.
+	Count int `json:"count"`
+
+	// Reason is the event that triggered the ban.
+	Reason string `json:"reason"`
+}
+
+// Banlist tracks abusive client events per source IP, banning sources that
+// exceed a threshold of events within a time window. Each repeat ban of a
+// source doubles in duration, up to a maximum. A single Banlist may be shared
+// between TCPProxy instances via the TCPProxy.Bans field.
+type Banlist struct {
+	// Threshold is the no. events within Window at which a source is
+	// banned. If zero, no sources are banned.
+	Threshold int
+
+	// Window is the sliding time window in which events are counted.
+	Window time.Duration
+
+	// BanTime is the duration of a source's first ban.
+	BanTime time.Duration
+
+	// MaxBanTime is the maximum duration of a ban. If zero, unlimited.
+	MaxBanTime time.Duration
+
+	// ForgetTime is the time after a source's last ban expires at which
+	// its ban count is forgotten. If zero, a default of 24h is used.
+	ForgetTime time.Duration
+
+	// StateFile is an optional path at which bans are persisted, so
+	// they survive a restart. Call Load() to read existing state, and
+	// Flush() before exit to write any pending changes.
+	StateFile string
+
+	mutex   sync.Mutex            // mutex protects sources and saveTimer
+	sources map[string]*banSource // sources tracks per-source ban state
+	saving  sync.Mutex            // saving serializes state file writes
+
+	saveTimer *time.Timer // saveTimer is the pending state file write
+}
+
+// banSource holds the ban state of a single source address.
+type banSource struct {
+	events []time.Time // events are the recent event times within window
+	until  time.Time   // until is the current ban expiry time
+	count  int         // count is the no. times banned
+	reason BanEvent    // reason is the last ban reason
+}
+
+// Load reads previously persisted bans from the state file, if set.
+func (bl *Banlist) Load() error {
+	if bl == nil || len(bl.StateFile) < 1 {
+		return nil
+	}
+
+	b, err := os.ReadFile(bl.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(b, &bans); err != nil {
+		return err
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if bl.sources == nil {
+		bl.sources = make(map[string]*banSource)
+	}
+
+	for _, ban := range bans {
+		src := &banSource{until: ban.Until, count: ban.Count}
+		for event := EventEmptyConn; event <= EventLimitBreached; event++ {
+			if event.String() == ban.Reason {
+				src.reason = event
+			}
+		}
+		bl.sources[ban.IP] = src
+	}
+
+	return nil
+}
+
+// Banned returns whether the supplied source IP is currently banned.
+func (bl *Banlist) Banned(ip net.IP) bool {
+	if bl == nil || ip == nil {
+		return false
+	}
+	bl.mutex.Lock()
+	src, ok := bl.sources[ip.String()]
+	banned := ok && time.Now().Before(src.until)
+	bl.mutex.Unlock()
+	return banned
+}
+
+// Record records an event for the supplied source IP, banning it if this
+// brings the source over the threshold. Returns whether the source was banned.
+func (bl *Banlist) Record(ip net.IP, event BanEvent) bool {
+	if bl == nil || ip == nil || bl.Threshold < 1 {
+		return false
+	}
+
+	key := ip.String()
+	now := time.Now()
+
+	bl.mutex.Lock()
+
+	if bl.sources == nil {
+		bl.sources = make(map[string]*banSource)
+	}
+
+	src, ok := bl.sources[key]
+	if !ok {
+		src = &banSource{}
+		bl.sources[key] = src
+	} else if now.Before(src.until) {
+		// Already banned
+		bl.mutex.Unlock()
+		return false
+	}
+
+	// Drop events outside window, append new
+	src.events = trimEvents(src.events, now.Add(-bl.Window))
+	src.events = append(src.events, now)
+
+	if len(src.events) < bl.Threshold {
+		bl.mutex.Unlock()
+		return false
+	}
+
+	// Calculate the doubling ban duration,
+	// stopping short of overflow if unlimited
+	d := bl.BanTime
+	for i := 0; i < src.count && d <= math.MaxInt64/2 &&
+		(bl.MaxBanTime < 1 || d < bl.MaxBanTime); i++ {
+		d *= 2
+	}
+	if bl.MaxBanTime > 0 && d > bl.MaxBanTime {
+		d = bl.MaxBanTime
+	}
+
+	// Ban the source
+	src.events = src.events[:0]
+	src.until = now.Add(d)
+	src.count++
+	src.reason = event
+	count := src.count
+
+	bl.mutex.Unlock()
+
+	log.InfoKVs(kv.Fields{
+		{K: "src", V: key},
+		{K: "reason", V: event.String()},
+		{K: "duration", V: d.String()},
+		{K: "count", V: count},
+		{K: "msg", V: "source banned"},
+	}...)
+
+	bl.scheduleSave()
+	return true
+}
+
+// Bans returns the currently active bans, ordered by expiry time.
+func (bl *Banlist) Bans() []Ban {
+	if bl == nil {
+		return nil
+	}
+
+	now := time.Now()
+	bans := []Ban{}
+
+	bl.mutex.Lock()
+	for key, src := range bl.sources {
+		if now.Before(src.until) {
+			bans = append(bans, Ban{
+				IP:     key,
+				Until:  src.until,
+				Count:  src.count,
+				Reason: src.reason.String(),
+			})
+		}
+	}
+	bl.mutex.Unlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+
+	return bans
+}
+
+// Unban lifts any ban on the supplied source IP, forgetting its ban history.
+// Returns whether the source was banned.
+func (bl *Banlist) Unban(ip net.IP) bool {
+	if bl == nil {
+		return false
+	}
+
+	key := ip.String()
+
+	bl.mutex.Lock()
+	src, ok := bl.sources[key]
+	banned := ok && time.Now().Before(src.until)
+	delete(bl.sources, key)
+	bl.mutex.Unlock()
+
+	if banned {
+		log.InfoKVs(kv.Fields{
+			{K: "src", V: key},
+			{K: "msg", V: "source unbanned"},
+		}...)
+		bl.scheduleSave()
+	}
+
+	return banned
+}
+
+// sweep drops source states that no longer hold any events or ban history.
+func (bl *Banlist) sweep() {
+	if bl == nil {
+		return
+	}
+
+	now := time.Now()
+	forget := bl.ForgetTime
+	if forget < 1 {
+		forget = defaultBanForgetTime
+	}
+
+	bl.mutex.Lock()
+	for key, src := range bl.sources {
+		src.events = trimEvents(src.events, now.Add(-bl.Window))
+		if len(src.events) == 0 && now.After(src.until.Add(forget)) {
+			delete(bl.sources, key)
+		}
+	}
+	bl.mutex.Unlock()
+}
+
+// Flush writes any pending ban state changes to the state file.
+func (bl *Banlist) Flush() {
+	if bl == nil {
+		return
+	}
+
+	bl.saving.Lock()
+	defer bl.saving.Unlock()
+
+	bl.mutex.Lock()
+	timer := bl.saveTimer
+	bl.saveTimer = nil
+	bl.mutex.Unlock()
+
+	if timer != nil {
+		timer.Stop()
+		bl.save()
+	}
+}
+
+// scheduleSave schedules the ban states to be persisted after banSaveDelay,
+// in the background, unless a save is already pending.
+func (bl *Banlist) scheduleSave() {
+	if len(bl.StateFile) < 1 {
+		return
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	if bl.saveTimer != nil {
+		return
+	}
+
+	bl.saveTimer = time.AfterFunc(banSaveDelay, func() {
+		bl.saving.Lock()
+		defer bl.saving.Unlock()
+
+		bl.mutex.Lock()
+		bl.saveTimer = nil
+		bl.mutex.Unlock()
+
+		bl.save()
+	})
+}
+
+// save persists the ban states to the state file, if set.
+// The saving mutex must be held.
+func (bl *Banlist) save() {
+	// Snapshot all states with ban history
+	bans := []Ban{}
+	bl.mutex.Lock()
+	for key, src := range bl.sources {
+		if src.count > 0 {
+			bans = append(bans, Ban{
+				IP:     key,
+				Until:  src.until,
+				Count:  src.count,
+				Reason: src.reason.String(),
+			})
+		}
+	}
+	bl.mutex.Unlock()
+
+	if err := writeJSONFile(bl.StateFile, bans); err != nil {
+		log.ErrorKVs(kv.Fields{
+			{K: "error", V: err},
+			{K: "msg", V: "ban state save error"},
+		}...)
+	}
+}
+
+// trimEvents drops event times before the supplied cutoff.
+func trimEvents(events []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(events) && events[i].Before(cutoff) {
+		i++
+	}
+	return append(events[:0], events[i:]...)
+}
+
+// writeJSONFile atomically writes v as JSON to file at path.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,203 @@
+package tcpee
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// expire moves the supplied source's ban and event times back by d.
+func (bl *Banlist) expire(ip string, d time.Duration) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	src := bl.sources[ip]
+	src.until = src.until.Add(-d)
+	for i := range src.events {
+		src.events[i] = src.events[i].Add(-d)
+	}
+}
+
+// banFor records events from ip until banned, returning the ban duration.
+func banFor(t *testing.T, bl *Banlist, ip string) time.Duration {
+	t.Helper()
+	for i := 0; i < bl.Threshold; i++ {
+		if bl.Record(parseIP(t, ip), EventEmptyConn) != (i == bl.Threshold-1) {
+			t.Fatalf("event %d of %d banned = %v", i+1, bl.Threshold, i != bl.Threshold-1)
+		}
+	}
+	bans := bl.Bans()
+	if len(bans) != 1 || bans[0].IP != ip {
+		t.Fatalf("bans = %+v", bans)
+	}
+	return time.Until(bans[0].Until).Round(time.Minute)
+}
+
+func TestBanlistThreshold(t *testing.T) {
+	bl := &Banlist{Threshold: 3, Window: time.Minute, BanTime: time.Minute}
+	ip := parseIP(t, "192.0.2.1")
+
+	bl.Record(ip, EventEmptyConn)
+	bl.Record(ip, EventEmptyConn)
+	bl.expire("192.0.2.1", 2*time.Minute)
+
+	// Events outside window don't count
+	if bl.Record(ip, EventEmptyConn) || bl.Banned(ip) {
+		t.Fatal("banned on events outside window")
+	}
+	bl.Record(ip, EventACLDenied)
+	if !bl.Record(ip, EventLimitBreached) || !bl.Banned(ip) {
+		t.Fatal("not banned at threshold")
+	}
+	if bl.Banned(parseIP(t, "192.0.2.2")) {
+		t.Fatal("other source banned")
+	}
+	if bans := bl.Bans(); bans[0].Reason != "limit_breached" || bans[0].Count != 1 {
+		t.Fatalf("ban = %+v", bans[0])
+	}
+
+	// Already banned sources aren't re-banned
+	if bl.Record(ip, EventEmptyConn) {
+		t.Fatal("banned source re-banned")
+	}
+
+	if !bl.Unban(ip) || bl.Banned(ip) || bl.Unban(ip) {
+		t.Fatal("unban failed")
+	}
+}
+
+func TestBanlistDisabled(t *testing.T) {
+	var nilList *Banlist
+	if nilList.Record(parseIP(t, "192.0.2.1"), EventEmptyConn) || nilList.Banned(parseIP(t, "192.0.2.1")) {
+		t.Fatal("nil banlist banned")
+	}
+	bl := &Banlist{}
+	if bl.Record(parseIP(t, "192.0.2.1"), EventEmptyConn) {
+		t.Fatal("zero threshold banned")
+	}
+}
+
+func TestBanlistDoubling(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		max  time.Duration
+		bans []time.Duration
+	}{
+		{
+			name: "capped",
+			max:  5 * time.Minute,
+			bans: []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute},
+		},
+		{
+			name: "unlimited",
+			bans: []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bl := &Banlist{
+				Threshold:  2,
+				Window:     time.Minute,
+				BanTime:    time.Minute,
+				MaxBanTime: test.max,
+			}
+			for i, expect := range test.bans {
+				if d := banFor(t, bl, "192.0.2.1"); d != expect {
+					t.Fatalf("ban %d = %v, expected %v", i+1, d, expect)
+				}
+
+				// Expire ban, sweeping while remembered
+				bl.expire("192.0.2.1", expect+time.Minute)
+				bl.sweep()
+			}
+		})
+	}
+}
+
+func TestBanlistDoublingOverflow(t *testing.T) {
+	bl := &Banlist{Threshold: 1, Window: time.Minute, BanTime: time.Minute}
+	bl.Record(parseIP(t, "192.0.2.1"), EventEmptyConn)
+
+	// Many bans later, the unlimited ban mustn't overflow
+	bl.mutex.Lock()
+	bl.sources["192.0.2.1"].count = 100
+	bl.mutex.Unlock()
+	bl.expire("192.0.2.1", time.Hour)
+	bl.Record(parseIP(t, "192.0.2.1"), EventEmptyConn)
+
+	if bans := bl.Bans(); len(bans) != 1 || time.Until(bans[0].Until) < 100*365*24*time.Hour {
+		t.Fatalf("bans = %+v", bans)
+	}
+}
+
+func TestBanlistForget(t *testing.T) {
+	bl := &Banlist{
+		Threshold:  1,
+		Window:     time.Minute,
+		BanTime:    time.Minute,
+		ForgetTime: time.Hour,
+	}
+	banFor(t, bl, "192.0.2.1")
+
+	bl.expire("192.0.2.1", 30*time.Minute)
+	bl.sweep()
+	if d := banFor(t, bl, "192.0.2.1"); d != 2*time.Minute {
+		t.Fatalf("repeat ban = %v, expected doubled", d)
+	}
+
+	bl.expire("192.0.2.1", 2*time.Hour)
+	bl.sweep()
+	if d := banFor(t, bl, "192.0.2.1"); d != time.Minute {
+		t.Fatalf("ban after forget time = %v, expected reset", d)
+	}
+}
+
+func TestBanlistPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bl := &Banlist{
+		Threshold: 1,
+		Window:    time.Minute,
+		BanTime:   time.Hour,
+		StateFile: path,
+	}
+	bl.Record(parseIP(t, "192.0.2.1"), EventBackendReset)
+	bl.Record(parseIP(t, "2001:db8::1"), EventEmptyConn)
+
+	// Written in the background, not on record
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file written synchronously: %v", err)
+	}
+	bl.Flush()
+
+	loaded := &Banlist{StateFile: path}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Banned(parseIP(t, "192.0.2.1")) || !loaded.Banned(parseIP(t, "2001:db8::1")) {
+		t.Fatalf("bans not loaded: %+v", loaded.Bans())
+	}
+	bans := loaded.Bans()
+	if bans[0].Reason != "backend_reset" || bans[0].Count != 1 {
+		t.Fatalf("loaded ban = %+v", bans[0])
+	}
+
+	// Debounced write after unban
+	loaded.Unban(parseIP(t, "192.0.2.1"))
+	deadline := time.Now().Add(5 * banSaveDelay)
+	for {
+		reloaded := &Banlist{StateFile: path}
+		if err := reloaded.Load(); err != nil {
+			t.Fatal(err)
+		}
+		if len(reloaded.Bans()) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unban not saved")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := (&Banlist{StateFile: filepath.Join(t.TempDir(), "missing")}).Load(); err != nil {
+		t.Fatalf("missing state file: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package tcpee
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// Capture formats.
+const (
+	CaptureRaw     = "raw"
+	CaptureHexdump = "hexdump"
+	CapturePcapng  = "pcapng"
+	CaptureSession = "session"
+)
+
+// defaultCaptureQueue is the default no. chunks queued per captured conn.
+const defaultCaptureQueue = 256
+
+// Capture is a traffic capture sink, teeing both directions of proxied conns
+// to per-connection files in a directory, as read before any stream filters.
+// Captured data is queued to a background writer, and dropped if the queue is
+// full. A single Capture may be shared between TCPProxy instances via the
+// TCPProxy.Capture and Route.Capture fields.
+type Capture struct {
+	// Dir is the directory capture files are written to.
+	Dir string
+
+	// Format is the capture file format, one of CaptureRaw (the default),
+	// writing separate {proxy}-{id}.in / .out files of raw bytes per conn,
+	// CaptureHexdump, writing a {proxy}-{id}.hex text file of timestamped
+	// hexdumps, or CapturePcapng, writing a {proxy}-{id}.pcapng file with
+	// synthesized TCP/IP headers between the client and backend addresses,
+	// or CaptureSession, writing a {proxy}-{id}.rec session recording of
+	// timestamped data in both directions, for replay (see SessionReader).
+	Format string
+
+	// MaxBytes is the maximum no. bytes captured per conn, across both
+	// directions. If zero, captures are unlimited.
+	MaxBytes int64
+
+	// Sample is the fraction of conns to capture, between 0 and 1.
+	// If zero, all connections are captured.
+	Sample float64
+
+	// Sources is an optional list of IPs / CIDRs, limiting
+	// captures to conns from matching source addresses.
+	Sources []string
+
+	// QueueSize is the no. chunks queued per captured conn before
+	// captured data is dropped. If zero, a default is used.
+	QueueSize int
+
+	filter atomic.Value // filter is the loaded *aclTrie source filter
+}
+
+// Load validates the capture configuration, creating the capture directory.
+func (c *Capture) Load() error {
+	switch c.Format {
+	case "", CaptureRaw, CaptureHexdump, CapturePcapng, CaptureSession:
+	default:
+		return fmt.Errorf("unknown capture format %q", c.Format)
+	}
+
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("invalid capture sample %v", c.Sample)
+	}
+
+	trie := &aclTrie{}
+	if err := trie.insertAll(c.Sources, true); err != nil {
+		return err
+	}
+	c.filter.Store(trie)
+
+	return os.MkdirAll(c.Dir, 0o750)
+}
+
+// captureChunk is a single chunk of captured conn data.
+type captureChunk struct {
+	in   bool      // in indicates client -> server
+	time time.Time // time is the time of capture
+	skip uint64    // skip is the no. bytes dropped before this chunk
+	data []byte    // data is the captured data
+}
+
+// captureWriter writes captured chunks to a capture file format.
+type captureWriter interface {
+	// write writes the supplied captured chunk.
+	write(chunk captureChunk) error
+
+	// close finalizes and closes the capture files.
+	close(truncated bool) error
+}
+
+// captureConn is the capture state of a single proxied conn.
+type captureConn struct {
+	capture *Capture          // capture is the parent capture sink
+	queue   chan captureChunk // queue is the background writer queue
+	size    int64             // size tracks the no. bytes captured
+	drops   [2]uint64         // drops track the no. bytes dropped in / out since last chunk
+	dropped uint64            // dropped tracks the total no. bytes dropped
+}
+
+// open starts a capture of the conn between src and dst if it passes the
+// source filter and sampling, returning nil if not captured. The background
+// writer is tracked by wg.
+func (c *Capture) open(proxy string, id string, src, dst *net.TCPAddr, wg *sync.WaitGroup) *captureConn {
+	if c == nil {
+		return nil
+	}
+
+	// Check source filter
+	trie, _ := c.filter.Load().(*aclTrie)
+	if trie != nil && trie.allows && !trie.allowed(src.IP) {
+		return nil
+	}
+
+	// Check conn sampling
+	if c.Sample > 0 && c.Sample < 1 && rand.Float64() >= c.Sample {
+		return nil
+	}
+
+	name := filepath.Join(c.Dir, proxy+"-"+id)
+
+	var w captureWriter
+	var err error
+	switch c.Format {
+	case CaptureHexdump:
+		w, err = newHexdumpWriter(name, id, src, dst)
+	case CapturePcapng:
+		w, err = newPcapngWriter(name, src, dst)
+	case CaptureSession:
+		w, err = newSessionWriter(name, proxy, id, src, dst)
+	default:
+		w, err = newRawWriter(name)
+	}
+	if err != nil {
+		log.ErrorKVs(kv.Fields{
+			{K: "proxy", V: proxy},
+			{K: "id", V: id},
+			{K: "error", V: err},
+			{K: "msg", V: "capture open error"},
+		}...)
+		return nil
+	}
+
+	size := c.QueueSize
+	if size < 1 {
+		size = defaultCaptureQueue
+	}
+
+	cc := &captureConn{
+		capture: c,
+		queue:   make(chan captureChunk, size),
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cc.run(proxy, id, w)
+	}()
+
+	return cc
+}
+
+// tap queues a copy of data for capture, in the client -> server direction if
+// in, else server -> client. Data is dropped if the writer queue is full.
+func (cc *captureConn) tap(in bool, data []byte) {
+	dir := 0
+	if !in {
+		dir = 1
+	}
+
+	// Limit to max capture bytes
+	if max := cc.capture.MaxBytes; max > 0 {
+		size := atomic.AddInt64(&cc.size, int64(len(data)))
+		if over := size - max; over > 0 {
+			if over >= int64(len(data)) {
+				return
+			}
+			data = data[:int64(len(data))-over]
+		}
+	}
+
+	chunk := captureChunk{
+		in:   in,
+		time: time.Now(),
+		skip: atomic.SwapUint64(&cc.drops[dir], 0),
+		data: append([]byte(nil), data...),
+	}
+
+	select {
+	case cc.queue <- chunk:
+	default:
+		// Sink is behind, drop
+		n := chunk.skip + uint64(len(data))
+		atomic.AddUint64(&cc.drops[dir], n)
+		atomic.AddUint64(&cc.dropped, uint64(len(data)))
+	}
+}
+
+// close stops queueing captured data, letting the writer finish.
+func (cc *captureConn) close() {
+	close(cc.queue)
+}
+
+// run writes queued chunks with w until the queue is closed.
+func (cc *captureConn) run(proxy string, id string, w captureWriter) {
+	var err error
+	for chunk := range cc.queue {
+		if err == nil {
+			err = w.write(chunk)
+		}
+	}
+
+	truncated := cc.capture.MaxBytes > 0 && atomic.LoadInt64(&cc.size) > cc.capture.MaxBytes
+	if cerr := w.close(truncated); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		log.ErrorKVs(kv.Fields{
+			{K: "proxy", V: proxy},
+			{K: "id", V: id},
+			{K: "error", V: err},
+			{K: "msg", V: "capture write error"},
+		}...)
+	}
+
+	if dropped := atomic.LoadUint64(&cc.dropped); dropped > 0 {
+		log.ErrorKVs(kv.Fields{
+			{K: "proxy", V: proxy},
+			{K: "id", V: id},
+			{K: "dropped", V: dropped},
+			{K: "msg", V: "capture dropped bytes, sink too slow"},
+		}...)
+	}
+}
+
+// rawWriter writes captured data as raw bytes, to a file per direction.
+type rawWriter struct {
+	files [2]*os.File
+}
+
+// newRawWriter creates raw capture files at name + ".in" / ".out".
+func newRawWriter(name string) (*rawWriter, error) {
+	in, err := os.OpenFile(name+".in", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(name+".out", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &rawWriter{files: [2]*os.File{in, out}}, nil
+}
+
+func (w *rawWriter) write(chunk captureChunk) error {
+	file := w.files[1]
+	if chunk.in {
+		file = w.files[0]
+	}
+	_, err := file.Write(chunk.data)
+	return err
+}
+
+func (w *rawWriter) close(truncated bool) error {
+	err1 := w.files[0].Close()
+	err2 := w.files[1].Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// hexdumpWriter writes captured data as timestamped hexdumps to a text file.
+type hexdumpWriter struct {
+	file *os.File
+	bw   *bufio.Writer
+}
+
+// newHexdumpWriter creates a hexdump capture file at name + ".hex".
+func newHexdumpWriter(name string, id string, src, dst *net.TCPAddr) (*hexdumpWriter, error) {
+	file, err := os.OpenFile(name+".hex", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	w := &hexdumpWriter{file: file, bw: bufio.NewWriter(file)}
+	fmt.Fprintf(w.bw, "# conn %s: %s -> %s\n", id, src, dst)
+	return w, nil
+}
+
+func (w *hexdumpWriter) write(chunk captureChunk) error {
+	dir := "<"
+	if chunk.in {
+		dir = ">"
+	}
+	if chunk.skip > 0 {
+		fmt.Fprintf(w.bw, "\n# %s %d bytes dropped\n", dir, chunk.skip)
+	}
+	fmt.Fprintf(w.bw, "\n%s %s %d bytes\n", chunk.time.Format(time.RFC3339Nano), dir, len(chunk.data))
+	dumper := hex.Dumper(w.bw)
+	dumper.Write(chunk.data)
+	return dumper.Close()
+}
+
+func (w *hexdumpWriter) close(truncated bool) error {
+	if truncated {
+		w.bw.WriteString("\n# capture truncated at max bytes\n")
+	}
+	err := w.bw.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,317 @@
+package tcpee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureFile reads the named capture file in dir.
+func captureFile(t *testing.T, dir string, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCaptureLoad(t *testing.T) {
+	for _, test := range []struct {
+		capture Capture
+		ok      bool
+	}{
+		{Capture{}, true},
+		{Capture{Format: CapturePcapng, Sample: 0.5, Sources: []string{"10.0.0.0/8"}}, true},
+		{Capture{Format: "pcap"}, false},
+		{Capture{Sample: 1.5}, false},
+		{Capture{Sample: -1}, false},
+		{Capture{Sources: []string{"bogus"}}, false},
+	} {
+		c := test.capture
+		c.Dir = filepath.Join(t.TempDir(), "captures")
+		if err := c.Load(); (err == nil) != test.ok {
+			t.Errorf("%+v: load error = %v", test.capture, err)
+		}
+	}
+}
+
+func TestCaptureProxy(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		files  map[string]string
+	}{
+		{CaptureRaw, map[string]string{
+			".in":  "hello world",
+			".out": "hello world",
+		}},
+		{CaptureHexdump, map[string]string{
+			".hex": "68 65 6c 6c 6f",
+		}},
+	} {
+		t.Run(test.format, func(t *testing.T) {
+			capture := &Capture{Dir: t.TempDir(), Format: test.format}
+			if err := capture.Load(); err != nil {
+				t.Fatal(err)
+			}
+			proxy, mn := newMemProxy(t, &TCPProxy{Name: "web", Capture: capture})
+			mn.echo(t, "backend")
+			startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+			conn := mn.dial(t, "front")
+			roundTrip(t, conn, "hello ")
+			roundTrip(t, conn, "world")
+			conn.Close()
+
+			// Close waits on capture writers
+			waitOpen(t, proxy, 0)
+			proxy.Close()
+
+			entries, _ := os.ReadDir(capture.Dir)
+			if len(entries) != len(test.files) {
+				t.Fatalf("capture files = %v", entries)
+			}
+			for _, entry := range entries {
+				ext := filepath.Ext(entry.Name())
+				data := captureFile(t, capture.Dir, entry.Name())
+				if !strings.HasPrefix(entry.Name(), "web-") || !strings.Contains(data, test.files[ext]) {
+					t.Errorf("%s = %q", entry.Name(), data)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureFilter(t *testing.T) {
+	capture := &Capture{Dir: t.TempDir(), Sources: []string{"10.0.0.0/8"}}
+	if err := capture.Load(); err != nil {
+		t.Fatal(err)
+	}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+
+	var wg sync.WaitGroup
+	if cc := capture.open("web", "1", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2)}, dst, &wg); cc != nil {
+		t.Fatal("captured unmatched source")
+	}
+	cc := capture.open("web", "2", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, dst, &wg)
+	if cc == nil {
+		t.Fatal("matched source not captured")
+	}
+	cc.close()
+	wg.Wait()
+
+	var nilCapture *Capture
+	if nilCapture.open("web", "3", dst, dst, &wg) != nil {
+		t.Fatal("nil capture captured")
+	}
+}
+
+func TestCaptureMaxBytes(t *testing.T) {
+	capture := &Capture{Dir: t.TempDir(), MaxBytes: 8}
+	if err := capture.Load(); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+
+	var wg sync.WaitGroup
+	cc := capture.open("web", "1", addr, addr, &wg)
+	cc.tap(true, []byte("hello"))
+	cc.tap(false, []byte("world"))
+	cc.tap(true, []byte("again"))
+	cc.close()
+	wg.Wait()
+
+	in := captureFile(t, capture.Dir, "web-1.in")
+	out := captureFile(t, capture.Dir, "web-1.out")
+	if in != "hello" || out != "wor" {
+		t.Fatalf("captured %q / %q", in, out)
+	}
+}
+
+func TestCaptureDrops(t *testing.T) {
+	capture := &Capture{}
+
+	// Fill the queue before the writer can drain it
+	cc := &captureConn{capture: capture, queue: make(chan captureChunk, 1)}
+	cc.tap(true, []byte("one"))
+	cc.tap(true, []byte("two"))
+	cc.tap(false, []byte("four"))
+	<-cc.queue
+	cc.tap(true, []byte("three"))
+
+	chunk := <-cc.queue
+	if string(chunk.data) != "three" || chunk.skip != 3 || cc.dropped != 7 || cc.drops[1] != 4 {
+		t.Fatalf("chunk = %+v, dropped = %d, drops = %v", chunk, cc.dropped, cc.drops)
+	}
+}
+
+// pcapPacket is a synthesized TCP/IP packet read from a pcapng file.
+type pcapPacket struct {
+	v4      bool
+	srcPort uint16
+	seq     uint32
+	ack     uint32
+	flags   byte
+	payload []byte
+}
+
+// readPcapng reads the packets of a pcapng capture, validating block
+// structure and IP / TCP checksums.
+func readPcapng(t *testing.T, path string) []pcapPacket {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []pcapPacket
+	for i := 0; len(b) > 0; i++ {
+		if len(b) < 12 {
+			t.Fatalf("block %d: short block", i)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		size := binary.LittleEndian.Uint32(b[4:])
+		if size%4 != 0 || int(size) > len(b) || binary.LittleEndian.Uint32(b[size-4:]) != size {
+			t.Fatalf("block %d: invalid length %d", i, size)
+		}
+		body := b[8 : size-4]
+		b = b[size:]
+
+		switch {
+		case i == 0 && typ == pcapngSHB:
+			if binary.LittleEndian.Uint32(body) != 0x1A2B3C4D {
+				t.Fatal("invalid byte-order magic")
+			}
+			continue
+		case i == 1 && typ == pcapngIDB:
+			if binary.LittleEndian.Uint16(body) != linktypeRaw {
+				t.Fatal("invalid link type")
+			}
+			continue
+		case i > 1 && typ == pcapngEPB:
+		default:
+			t.Fatalf("block %d: unexpected type %#x", i, typ)
+		}
+
+		caplen := binary.LittleEndian.Uint32(body[12:])
+		if binary.LittleEndian.Uint32(body[16:]) != caplen {
+			t.Fatalf("block %d: truncated packet", i)
+		}
+		pkt := body[20 : 20+caplen]
+
+		var p pcapPacket
+		var tcp []byte
+		var sum uint32
+		switch pkt[0] >> 4 {
+		case 4:
+			p.v4 = true
+			if checksum(pkt[:20], 0) != 0 {
+				t.Fatalf("block %d: invalid IP checksum", i)
+			}
+			tcp = pkt[20:]
+			sum = pseudoSum(pkt[12:20])
+		case 6:
+			tcp = pkt[40:]
+			sum = pseudoSum(pkt[8:40])
+		default:
+			t.Fatalf("block %d: invalid IP version", i)
+		}
+		if checksum(tcp, sum+6+uint32(len(tcp))) != 0 {
+			t.Fatalf("block %d: invalid TCP checksum", i)
+		}
+
+		p.srcPort = binary.BigEndian.Uint16(tcp)
+		p.seq = binary.BigEndian.Uint32(tcp[4:])
+		p.ack = binary.BigEndian.Uint32(tcp[8:])
+		p.flags = tcp[13]
+		p.payload = tcp[20:]
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// pseudoSum returns the checksum sum of pseudo-header addresses.
+func pseudoSum(addrs []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(addrs); i += 2 {
+		sum += uint32(addrs[i])<<8 | uint32(addrs[i+1])
+	}
+	return sum
+}
+
+func TestPcapngWriter(t *testing.T) {
+	big := bytes.Repeat([]byte{'x'}, pcapngMaxSegment+10)
+	now := time.Now()
+
+	for _, test := range []struct {
+		name string
+		src  *net.TCPAddr
+		dst  *net.TCPAddr
+		v4   bool
+	}{
+		{"v4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 80}, true},
+		{"mapped", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 80}, true},
+		{"v6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 80}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "conn")
+			w, err := newPcapngWriter(name, test.src, test.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chunk := range []captureChunk{
+				{in: true, time: now, data: []byte("hello")},
+				{in: false, time: now, skip: 3, data: []byte("world")},
+				{in: true, time: now, data: big},
+			} {
+				if err := w.write(chunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.close(false); err != nil {
+				t.Fatal(err)
+			}
+
+			pkts := readPcapng(t, name+".pcapng")
+			if len(pkts) != 10 {
+				t.Fatalf("read %d packets, expected 10", len(pkts))
+			}
+			for i, p := range pkts {
+				if p.v4 != test.v4 {
+					t.Fatalf("packet %d: v4 = %v", i, p.v4)
+				}
+			}
+
+			syn, synack := pkts[0], pkts[1]
+			if syn.flags != tcpSYN || syn.srcPort != 40000 || synack.flags != tcpSYN|tcpACK ||
+				synack.srcPort != 80 || synack.ack != syn.seq+1 {
+				t.Fatalf("handshake = %+v %+v", syn, synack)
+			}
+
+			hello, world := pkts[3], pkts[4]
+			if string(hello.payload) != "hello" || hello.seq != syn.seq+1 || hello.flags != tcpPSH|tcpACK {
+				t.Fatalf("client data = %+v", hello)
+			}
+			if string(world.payload) != "world" || world.seq != synack.seq+1+3 || world.ack != hello.seq+5 {
+				t.Fatalf("backend data = %+v", world)
+			}
+
+			// Large chunks split into segments
+			seg1, seg2 := pkts[5], pkts[6]
+			if len(seg1.payload) != pcapngMaxSegment || len(seg2.payload) != 10 || seg2.seq != seg1.seq+pcapngMaxSegment {
+				t.Fatalf("segments = %d@%d, %d@%d", len(seg1.payload), seg1.seq, len(seg2.payload), seg2.seq)
+			}
+
+			fin := pkts[7]
+			if fin.flags != tcpFIN|tcpACK || fin.seq != seg2.seq+10 {
+				t.Fatalf("close = %+v", fin)
+			}
+		})
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"codeberg.org/gruf/go-config"
+	"codeberg.org/gruf/tcpee"
+)
+
+// parseSize parses a byte size string of form "{n}[K|M|G|T][i][B]", using
+// 1024 as the multiplier for all units.
+func parseSize(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	num := strings.TrimRight(str, "KMGTiBkmgtb")
+	unit := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(str[len(num):], "B"), "b"))
+	unit = strings.TrimSuffix(unit, "I")
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+
+	switch unit {
+	case "":
+	case "K":
+		n *= 1 << 10
+	case "M":
+		n *= 1 << 20
+	case "G":
+		n *= 1 << 30
+	case "T":
+		n *= 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size unit %q", str)
+	}
+
+	return int64(n), nil
+}
+
+// parseRateLimit parses a rate limit string of form "{rate}[/{burst}]",
+// where rate is in bytes per second. An empty string disables the limit.
+func parseRateLimit(str string) (tcpee.RateLimit, error) {
+	var limit tcpee.RateLimit
+	var err error
+
+	if len(str) < 1 {
+		return limit, nil
+	}
+
+	split := strings.SplitN(str, "/", 2)
+	limit.Rate, err = parseSize(split[0])
+	if err != nil {
+		return limit, err
+	}
+	if len(split) == 2 {
+		limit.Burst, err = parseSize(split[1])
+		if err != nil {
+			return limit, err
+		}
+	}
+
+	return limit, nil
+}
+
+// parseStrings parses a string slice from a TOML array value.
+func parseStrings(val interface{}) ([]string, error) {
+	arr, _ := val.([]interface{})
+	out := make([]string, 0, len(arr))
+	for _, v := range arr {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T in array", v)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// parseACL parses an access control list from the "allow", "deny", "allow-file"
+// and "deny-file" keys in the supplied map, returning nil if none are set.
+func parseACL(m map[string]interface{}) (*tcpee.ACL, error) {
+	var acl tcpee.ACL
+	var err error
+
+	acl.Allow, err = parseStrings(m["allow"])
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	acl.Deny, err = parseStrings(m["deny"])
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	acl.AllowFile, _ = m["allow-file"].(string)
+	acl.DenyFile, _ = m["deny-file"].(string)
+
+	if len(acl.Allow) == 0 && len(acl.Deny) == 0 &&
+		acl.AllowFile == "" && acl.DenyFile == "" {
+		return nil, nil
+	}
+
+	return &acl, acl.Load()
+}
+
+// parseCapture parses a traffic capture sink from the "capture-*" keys in
+// the supplied map, returning nil if no capture directory is set.
+func parseCapture(m map[string]interface{}) (*tcpee.Capture, error) {
+	var capture tcpee.Capture
+	var err error
+
+	capture.Dir, _ = m["capture-dir"].(string)
+	if capture.Dir == "" {
+		return nil, nil
+	}
+
+	capture.Format, _ = m["capture-format"].(string)
+
+	if str, _ := m["capture-max-bytes"].(string); str != "" {
+		capture.MaxBytes, err = parseSize(str)
+		if err != nil {
+			return nil, fmt.Errorf("capture-max-bytes: %w", err)
+		}
+	}
+
+	capture.Sample, err = parseSample(m, "capture-sample")
+	if err != nil {
+		return nil, err
+	}
+
+	capture.Sources, err = parseStrings(m["capture-sources"])
+	if err != nil {
+		return nil, fmt.Errorf("capture-sources: %w", err)
+	}
+
+	return &capture, capture.Load()
+}
+
+// parseShadow parses a shadow backend from the "shadow-*" keys in the
+// supplied map, returning nil if no shadow backend is set.
+func parseShadow(m map[string]interface{}) (*tcpee.Shadow, error) {
+	var shadow tcpee.Shadow
+	var err error
+
+	shadow.Addr, _ = m["shadow-backend"].(string)
+	if shadow.Addr == "" {
+		return nil, nil
+	}
+
+	shadow.Sample, err = parseSample(m, "shadow-sample")
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := m["shadow-queue"]; ok {
+		i, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T for shadow-queue", v)
+		}
+		shadow.QueueSize = int(i)
+	}
+
+	return &shadow, nil
+}
+
+// parseSample parses an optional sampling fraction between 0 and 1 under
+// key in the supplied map, accepting either a float or an integer.
+func parseSample(m map[string]interface{}, key string) (float64, error) {
+	var sample float64
+	switch v := m[key].(type) {
+	case nil:
+	case float64:
+		sample = v
+	case int64:
+		sample = float64(v)
+	default:
+		return 0, fmt.Errorf("unexpected type %T for %s", v, key)
+	}
+	if sample < 0 || sample > 1 {
+		return 0, fmt.Errorf("%s: must be between 0 and 1", key)
+	}
+	return sample, nil
+}
+
+// parseAccessLog parses an access log sink from the "access-log*" keys in the
+// supplied map, returning nil if no path is set. Sinks are shared by path
+// via logs, so each file is opened only once, returning an error if the
+// settings differ from those of the sink already open for the path.
+func parseAccessLog(m map[string]interface{}, logs map[string]*tcpee.AccessLog) (*tcpee.AccessLog, error) {
+	path, _ := m["access-log"].(string)
+	if path == "" {
+		return nil, nil
+	}
+
+	al := tcpee.AccessLog{Path: path}
+	al.Format, _ = m["access-log-format"].(string)
+	if err := tcpee.ParseAccessFormat(al.Format); err != nil {
+		return nil, fmt.Errorf("access-log-format: %w", err)
+	}
+
+	if str, _ := m["access-log-max-size"].(string); str != "" {
+		size, err := parseSize(str)
+		if err != nil {
+			return nil, fmt.Errorf("access-log-max-size: %w", err)
+		}
+		al.MaxSize = size
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		"access-log-rotate":  &al.Interval,
+		"access-log-max-age": &al.MaxAge,
+	} {
+		if str, _ := m[key].(string); str != "" {
+			d, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = d
+		}
+	}
+
+	backups, _ := m["access-log-max-backups"].(int64)
+	al.MaxBackups = int(backups)
+	al.Compress, _ = m["access-log-compress"].(bool)
+
+	if open, ok := logs[path]; ok {
+		if !sameAccessLog(open, &al) {
+			return nil, fmt.Errorf("%s: settings differ from the open access log, requires restart", path)
+		}
+		return open, nil
+	}
+
+	if err := al.Open(); err != nil {
+		return nil, err
+	}
+
+	logs[path] = &al
+	return &al, nil
+}
+
+// sameAccessLog returns whether access log sinks a and b have the same settings.
+func sameAccessLog(a, b *tcpee.AccessLog) bool {
+	return a.Path == b.Path &&
+		a.Format == b.Format &&
+		a.MaxSize == b.MaxSize &&
+		a.Interval == b.Interval &&
+		a.MaxBackups == b.MaxBackups &&
+		a.MaxAge == b.MaxAge &&
+		a.Compress == b.Compress
+}
+
+// parseRoute parses a proxy route entry, either a string of form
+// "{src} -> {dst}" or an inline table with a "route" key of that form
+// alongside any per-route settings.
+func parseRoute(entry interface{}) (tcpee.Route, error) {
+	var route tcpee.Route
+
+	switch entry := entry.(type) {
+	case string:
+		return route, parseRouteAddrs(&route, entry)
+
+	case map[string]interface{}:
+		for key := range entry {
+			switch key {
+			case "route", "max-connections",
+				"allow", "deny", "allow-file", "deny-file",
+				"capture-dir", "capture-format", "capture-max-bytes",
+				"capture-sample", "capture-sources",
+				"shadow-backend", "shadow-sample", "shadow-queue",
+				"startup", "fallback-backend":
+			default:
+				return route, fmt.Errorf("undefined key %s in proxy entry", key)
+			}
+		}
+
+		str, _ := entry["route"].(string)
+		if err := parseRouteAddrs(&route, str); err != nil {
+			return route, err
+		}
+
+		if v, ok := entry["max-connections"]; ok {
+			i, ok := v.(int64)
+			if !ok {
+				return route, fmt.Errorf("unexpected type %T for max-connections", v)
+			}
+			route.MaxConns = int(i)
+		}
+
+		acl, err := parseACL(entry)
+		if err != nil {
+			return route, err
+		}
+		route.ACL = acl
+
+		capture, err := parseCapture(entry)
+		if err != nil {
+			return route, err
+		}
+		route.Capture = capture
+
+		shadow, err := parseShadow(entry)
+		if err != nil {
+			return route, err
+		}
+		route.Shadow = shadow
+
+		str, _ = entry["startup"].(string)
+		startup, ok := tcpee.ParseStartupPolicy(str)
+		if !ok {
+			return route, fmt.Errorf("startup: unknown policy %q", str)
+		}
+		route.Startup = startup
+		route.Fallback, _ = entry["fallback-backend"].(string)
+
+		return route, nil
+
+	default:
+		return route, fmt.Errorf("unexpected type %T for proxy entry", entry)
+	}
+}
+
+// parseRouteAddrs parses the src and dst addresses from a string of
+// form "{src} -> {dst}" into the supplied route.
+func parseRouteAddrs(route *tcpee.Route, str string) error {
+	split := strings.Split(str, " -> ")
+	if len(split) != 2 {
+		return errors.New(`expect "{src} -> {dst}"`)
+	}
+	route.Src = split[0]
+	route.Dst = split[1]
+	return nil
+}
+
+// fileConfig is a parsed configuration file.
+type fileConfig struct {
+	maxConns     int64
+	banThreshold int64
+	banWindow    time.Duration
+	banTime      time.Duration
+	banMaxTime   time.Duration
+	banForget    time.Duration
+	banStateFile string
+	metricsAddr  string
+	adminAddr    string
+	drainTimeout time.Duration
+	drainIdle    time.Duration
+	proxies      map[string]*proxyConfig
+}
+
+// proxyConfig is a parsed proxy configuration block.
+type proxyConfig struct {
+	proxy   *tcpee.TCPProxy        // proxy is the configured (unstarted) proxy
+	routes  []routeConfig          // routes are the configured proxy routes
+	details map[string]interface{} // details are the raw block settings, sans routes
+}
+
+// routeConfig is a parsed proxy route entry.
+type routeConfig struct {
+	route tcpee.Route // route is the configured route
+	entry interface{} // entry is the raw route entry
+}
+
+// loadConfig parses the configuration file at path. Access log sinks are
+// shared by path via logs, see parseAccessLog().
+func loadConfig(path string, logs map[string]*tcpee.AccessLog) (*fileConfig, error) {
+	var cfg fileConfig
+
+	tree := make(config.Tree)
+	tree.Int64Var(&cfg.maxConns, "max-connections", 0)
+	tree.Int64Var(&cfg.banThreshold, "ban-threshold", 0)
+	tree.DurationVar(&cfg.banWindow, "ban-window", time.Minute)
+	tree.DurationVar(&cfg.banTime, "ban-time", 10*time.Minute)
+	tree.DurationVar(&cfg.banMaxTime, "ban-max-time", 24*time.Hour)
+	tree.DurationVar(&cfg.banForget, "ban-forget-time", 24*time.Hour)
+	tree.StringVar(&cfg.banStateFile, "ban-state-file", "")
+	tree.StringVar(&cfg.metricsAddr, "metrics-listen", "")
+	tree.StringVar(&cfg.adminAddr, "admin-listen", "")
+	tree.DurationVar(&cfg.drainTimeout, "drain-timeout", 30*time.Second)
+	tree.DurationVar(&cfg.drainIdle, "drain-idle", 0)
+	proxies := tree.Wildcard("*", map[string]interface{}{
+		"server-timeout":   "",
+		"client-timeout":   "",
+		"server-keepalive": "",
+		"client-keepalive": "",
+		"proxy":            []interface{}{},
+		"transparent":      false,
+		"proxy-proto":      false,
+
+		"conn-upload-limit":     "",
+		"conn-download-limit":   "",
+		"source-upload-limit":   "",
+		"source-download-limit": "",
+		"route-upload-limit":    "",
+		"route-download-limit":  "",
+
+		"source-conn-rate":  "",
+		"source-max-conns":  int64(0),
+		"source-prefix-v4":  int64(0),
+		"source-prefix-v6":  int64(0),
+		"limit-action":      "",
+		"limit-tarpit-time": "",
+		"limit-tarpit-max":  int64(0),
+
+		"max-connections": int64(0),
+		"overload-mode":   "",
+		"queue-timeout":   "",
+		"max-queue":       int64(0),
+		"reject-banner":   "",
+
+		"allow":      []interface{}{},
+		"deny":       []interface{}{},
+		"allow-file": "",
+		"deny-file":  "",
+
+		"access-log":             "",
+		"access-log-format":      "",
+		"access-log-max-size":    "",
+		"access-log-rotate":      "",
+		"access-log-max-backups": int64(0),
+		"access-log-max-age":     "",
+		"access-log-compress":    false,
+
+		"capture-dir":       "",
+		"capture-format":    "",
+		"capture-max-bytes": "",
+		"capture-sample":    float64(0),
+		"capture-sources":   []interface{}{},
+
+		"shadow-backend": "",
+		"shadow-sample":  float64(0),
+		"shadow-queue":   int64(0),
+
+		"startup":          "",
+		"startup-timeout":  "",
+		"fallback-backend": "",
+	}, false, true)
+
+	undefined, err := tree.ParseDefined(path)
+	if err != nil {
+		return nil, err
+	} else if len(undefined) > 0 {
+		keys := make([]string, 0, len(undefined))
+		for key := range undefined {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("undefined keys %s", strings.Join(keys, ", "))
+	}
+
+	cfg.proxies = make(map[string]*proxyConfig, len(*proxies))
+	for name, details := range *proxies {
+		pc, err := parseProxy(name, details, logs)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s: %w", name, err)
+		}
+		pc.proxy.DrainIdle = cfg.drainIdle
+		cfg.proxies[name] = pc
+	}
+
+	return &cfg, nil
+}
+
+// parseProxy parses a proxy configuration block with name from the supplied
+// map, leaving the process-wide proxy settings (e.g. GlobalConns) unset.
+func parseProxy(name string, details map[string]interface{}, logs map[string]*tcpee.AccessLog) (*proxyConfig, error) {
+	// Define used values
+	var sTimeout, cTimeout time.Duration
+	var sKeepAlive, cKeepAlive time.Duration
+	var proxyProto bool
+	var str string
+	var err error
+
+	// Parse provided details
+	str, _ = details["server-timeout"].(string)
+	sTimeout, err = time.ParseDuration(str)
+	if err != nil {
+		return nil, fmt.Errorf("server-timeout: %w", err)
+	}
+	str, _ = details["client-timeout"].(string)
+	cTimeout, err = time.ParseDuration(str)
+	if err != nil {
+		return nil, fmt.Errorf("client-timeout: %w", err)
+	}
+	str, _ = details["server-keepalive"].(string)
+	sKeepAlive, err = time.ParseDuration(str)
+	if err != nil {
+		return nil, fmt.Errorf("server-keepalive: %w", err)
+	}
+	str, _ = details["client-keepalive"].(string)
+	cKeepAlive, err = time.ParseDuration(str)
+	if err != nil {
+		return nil, fmt.Errorf("client-keepalive: %w", err)
+	}
+	proxyProto, _ = details["proxy-proto"].(bool)
+
+	// Parse provided bandwidth limits
+	var limits [6]tcpee.RateLimit
+	for i, key := range []string{
+		"conn-upload-limit",
+		"conn-download-limit",
+		"source-upload-limit",
+		"source-download-limit",
+		"route-upload-limit",
+		"route-download-limit",
+	} {
+		str, _ = details[key].(string)
+		limits[i], err = parseRateLimit(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	// Parse provided connection limits
+	str, _ = details["source-conn-rate"].(string)
+	connRate, err := parseRateLimit(str)
+	if err != nil {
+		return nil, fmt.Errorf("source-conn-rate: %w", err)
+	}
+	maxConns, _ := details["source-max-conns"].(int64)
+	prefixV4, _ := details["source-prefix-v4"].(int64)
+	prefixV6, _ := details["source-prefix-v6"].(int64)
+	str, _ = details["limit-action"].(string)
+	action, ok := tcpee.ParseLimitAction(str)
+	if !ok {
+		return nil, fmt.Errorf("limit-action: unknown action %q", str)
+	}
+	var tarpitTime time.Duration
+	if str, _ = details["limit-tarpit-time"].(string); str != "" {
+		tarpitTime, err = time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("limit-tarpit-time: %w", err)
+		}
+	}
+	maxTarpits, _ := details["limit-tarpit-max"].(int64)
+
+	// Parse provided overload settings
+	routeConns, _ := details["max-connections"].(int64)
+	str, _ = details["overload-mode"].(string)
+	overload, ok := tcpee.ParseOverloadMode(str)
+	if !ok {
+		return nil, fmt.Errorf("overload-mode: unknown mode %q", str)
+	}
+	var queueTimeout time.Duration
+	if str, _ = details["queue-timeout"].(string); str != "" {
+		queueTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("queue-timeout: %w", err)
+		}
+	}
+	maxQueue, _ := details["max-queue"].(int64)
+	banner, _ := details["reject-banner"].(string)
+
+	// Parse provided startup settings
+	str, _ = details["startup"].(string)
+	startup, ok := tcpee.ParseStartupPolicy(str)
+	if !ok {
+		return nil, fmt.Errorf("startup: unknown policy %q", str)
+	}
+	var startupTimeout time.Duration
+	if str, _ = details["startup-timeout"].(string); str != "" {
+		startupTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("startup-timeout: %w", err)
+		}
+	}
+	fallback, _ := details["fallback-backend"].(string)
+
+	// Parse provided access control lists
+	acl, err := parseACL(details)
+	if err != nil {
+		return nil, fmt.Errorf("access control list: %w", err)
+	}
+
+	// Parse provided traffic capture sink
+	capture, err := parseCapture(details)
+	if err != nil {
+		return nil, fmt.Errorf("traffic capture: %w", err)
+	}
+
+	// Parse provided shadow backend
+	shadow, err := parseShadow(details)
+	if err != nil {
+		return nil, fmt.Errorf("shadow backend: %w", err)
+	}
+
+	// Parse provided access log sink
+	accessLog, err := parseAccessLog(details, logs)
+	if err != nil {
+		return nil, fmt.Errorf("access log: %w", err)
+	}
+
+	pc := proxyConfig{
+		proxy: &tcpee.TCPProxy{
+			Name:            name,
+			ProxyProto:      proxyProto,
+			ClientKeepAlive: cKeepAlive,
+			ServerKeepAlive: sKeepAlive,
+			ClientTimeout:   cTimeout,
+			ServerTimeout:   sTimeout,
+			ConnLimits: tcpee.BandwidthLimits{
+				Upload:   limits[0],
+				Download: limits[1],
+			},
+			SourceLimits: tcpee.BandwidthLimits{
+				Upload:   limits[2],
+				Download: limits[3],
+			},
+			RouteLimits: tcpee.BandwidthLimits{
+				Upload:   limits[4],
+				Download: limits[5],
+			},
+			SourceConnRate: connRate,
+			SourceMaxConns: int(maxConns),
+			SourcePrefixV4: int(prefixV4),
+			SourcePrefixV6: int(prefixV6),
+			LimitAction:    action,
+			TarpitTime:     tarpitTime,
+			MaxTarpits:     int(maxTarpits),
+			MaxConns:       int(routeConns),
+			OverloadMode:   overload,
+			QueueTimeout:   queueTimeout,
+			MaxQueue:       int(maxQueue),
+			RejectBanner:   banner,
+			StartupPolicy:  startup,
+			StartupTimeout: startupTimeout,
+			Fallback:       fallback,
+			ACL:            acl,
+			AccessLog:      accessLog,
+			Capture:        capture,
+			Shadow:         shadow,
+		},
+		details: make(map[string]interface{}, len(details)),
+	}
+
+	// Keep raw settings for change detection
+	for key, val := range details {
+		if key != "proxy" {
+			pc.details[key] = val
+		}
+	}
+
+	// Iter supplied proxying addresses
+	entries, _ := details["proxy"].([]interface{})
+	for _, entry := range entries {
+		route, err := parseRoute(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy route: %w", err)
+		}
+		for _, rc := range pc.routes {
+			if rc.route.Src == route.Src {
+				return nil, fmt.Errorf("duplicate proxy route %s", route.Src)
+			}
+		}
+		pc.routes = append(pc.routes, routeConfig{route: route, entry: entry})
+	}
+
+	return &pc, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		str  string
+		size int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"1K", 1 << 10, false},
+		{"1KiB", 1 << 10, false},
+		{"1.5M", 3 << 19, false},
+		{"100MiB", 100 << 20, false},
+		{"2g", 2 << 30, false},
+		{" 1 T ", 1 << 40, false},
+		{"", 0, true},
+		{"-1K", 0, true},
+		{"1X", 0, true},
+		{"K", 0, true},
+	} {
+		size, err := parseSize(test.str)
+		if size != test.size || (err != nil) != test.err {
+			t.Errorf("parseSize(%q) = %d, %v", test.str, size, err)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for _, test := range []struct {
+		str   string
+		limit tcpee.RateLimit
+		err   bool
+	}{
+		{"", tcpee.RateLimit{}, false},
+		{"1M", tcpee.RateLimit{Rate: 1 << 20}, false},
+		{"1M/4M", tcpee.RateLimit{Rate: 1 << 20, Burst: 4 << 20}, false},
+		{"1M/", tcpee.RateLimit{}, true},
+		{"fast", tcpee.RateLimit{}, true},
+	} {
+		limit, err := parseRateLimit(test.str)
+		if (err != nil) != test.err || (err == nil && limit != test.limit) {
+			t.Errorf("parseRateLimit(%q) = %+v, %v", test.str, limit, err)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		entry interface{}
+		check func(tcpee.Route) bool
+		err   string
+	}{
+		{
+			name:  "string",
+			entry: "127.0.0.1:80 -> backend:8080",
+			check: func(r tcpee.Route) bool {
+				return r.Src == "127.0.0.1:80" && r.Dst == "backend:8080" && r.ACL == nil
+			},
+		},
+		{
+			name: "overrides",
+			entry: map[string]interface{}{
+				"route":            ":80 -> backend:8080",
+				"max-connections":  int64(5),
+				"allow":            []interface{}{"10.0.0.0/8"},
+				"shadow-backend":   "shadow:8080",
+				"shadow-sample":    int64(1),
+				"startup":          "lazy",
+				"fallback-backend": "fallback:8080",
+			},
+			check: func(r tcpee.Route) bool {
+				return r.Src == ":80" && r.Dst == "backend:8080" && r.MaxConns == 5 &&
+					r.ACL != nil && r.ACL.Allow[0] == "10.0.0.0/8" &&
+					r.Shadow != nil && r.Shadow.Addr == "shadow:8080" && r.Shadow.Sample == 1 &&
+					r.Startup == tcpee.StartupLazy && r.Fallback == "fallback:8080" &&
+					r.Capture == nil
+			},
+		},
+		{
+			name:  "bad addrs",
+			entry: "127.0.0.1:80 => backend:8080",
+			err:   `expect "{src} -> {dst}"`,
+		},
+		{
+			name:  "bad type",
+			entry: int64(80),
+			err:   "unexpected type int64 for proxy entry",
+		},
+		{
+			name:  "undefined key",
+			entry: map[string]interface{}{"route": ":80 -> b:80", "server-timeout": "1s"},
+			err:   "undefined key server-timeout in proxy entry",
+		},
+		{
+			name:  "bad max-connections",
+			entry: map[string]interface{}{"route": ":80 -> b:80", "max-connections": "5"},
+			err:   "unexpected type string for max-connections",
+		},
+		{
+			name:  "bad startup",
+			entry: map[string]interface{}{"route": ":80 -> b:80", "startup": "eager"},
+			err:   `startup: unknown policy "eager"`,
+		},
+		{
+			name:  "bad sample",
+			entry: map[string]interface{}{"route": ":80 -> b:80", "shadow-backend": "s:80", "shadow-sample": 1.5},
+			err:   "shadow-sample: must be between 0 and 1",
+		},
+	} {
+		route, err := parseRoute(test.entry)
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error = %v, expected %s", test.name, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !test.check(route):
+			t.Errorf("%s: route = %+v", test.name, route)
+		}
+	}
+}
+
+func TestParseAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logs := make(map[string]*tcpee.AccessLog)
+	defer func() {
+		for _, al := range logs {
+			al.Close()
+		}
+	}()
+
+	if al, err := parseAccessLog(map[string]interface{}{}, logs); al != nil || err != nil {
+		t.Fatalf("no path = %v, %v", al, err)
+	}
+
+	m := map[string]interface{}{
+		"access-log":          path,
+		"access-log-format":   "json",
+		"access-log-max-size": "1MiB",
+		"access-log-rotate":   "1h",
+	}
+	al, err := parseAccessLog(m, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if al.Format != "json" || al.MaxSize != 1<<20 || al.Interval != time.Hour {
+		t.Fatalf("access log = %+v", al)
+	}
+
+	// Same settings share the open sink
+	if shared, err := parseAccessLog(m, logs); err != nil || shared != al {
+		t.Fatalf("shared = %p, %v", shared, err)
+	}
+
+	// Differing settings rejected
+	m["access-log-format"] = "logfmt"
+	if _, err := parseAccessLog(m, logs); err == nil || !strings.Contains(err.Error(), "settings differ") {
+		t.Fatalf("changed settings = %v", err)
+	}
+
+	for key, val := range map[string]interface{}{
+		"access-log-format":   "$nope",
+		"access-log-max-size": "1X",
+		"access-log-rotate":   "daily",
+	} {
+		m := map[string]interface{}{"access-log": filepath.Join(t.TempDir(), "other.log"), key: val}
+		if _, err := parseAccessLog(m, logs); err == nil || !strings.HasPrefix(err.Error(), key) {
+			t.Errorf("%s = %v", key, err)
+		}
+	}
+}
+
+// timeouts are the proxy block settings required by loadConfig.
+const timeouts = `
+    server-timeout = "10s"
+    client-timeout = "10s"
+    server-keepalive = "0s"
+    client-keepalive = "0s"
+`
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpee.conf")
+	writeConfig(t, path, `
+max-connections = 100
+drain-timeout = "5s"
+drain-idle = "1s"
+
+[web]`+timeouts+`
+    proxy-proto = true
+    startup = "lazy"
+    proxy = [
+        "127.0.0.1:80 -> backend:8080",
+        { route = "127.0.0.1:443 -> backend:8443", max-connections = 5, startup = "strict" },
+    ]
+`)
+
+	cfg, err := loadConfig(path, make(map[string]*tcpee.AccessLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.maxConns != 100 || cfg.drainTimeout != 5*time.Second || cfg.drainIdle != time.Second {
+		t.Fatalf("config = %+v", cfg)
+	}
+
+	pc := cfg.proxies["web"]
+	if pc == nil || len(cfg.proxies) != 1 {
+		t.Fatalf("proxies = %+v", cfg.proxies)
+	}
+	p := pc.proxy
+	if p.Name != "web" || !p.ProxyProto || p.ServerTimeout != 10*time.Second ||
+		p.StartupPolicy != tcpee.StartupLazy || p.DrainIdle != time.Second {
+		t.Fatalf("proxy = %+v", p)
+	}
+	if _, ok := pc.details["proxy"]; ok {
+		t.Fatal("routes in details")
+	}
+
+	// Inline route overrides proxy settings
+	if len(pc.routes) != 2 {
+		t.Fatalf("routes = %+v", pc.routes)
+	}
+	if r := pc.routes[0].route; r.Src != "127.0.0.1:80" || r.Startup != tcpee.StartupDefault {
+		t.Fatalf("route = %+v", r)
+	}
+	if r := pc.routes[1].route; r.Src != "127.0.0.1:443" || r.MaxConns != 5 || r.Startup != tcpee.StartupStrict {
+		t.Fatalf("route = %+v", r)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{
+			name: "undefined keys",
+			conf: "bogus = 1\nnope = 2\n",
+			err:  "undefined keys bogus, nope",
+		},
+		{
+			name: "undefined proxy key",
+			conf: "[web]" + timeouts + "    nope = 1\n",
+			err:  "undefined key nope in wildcard with key web",
+		},
+		{
+			name: "missing timeout",
+			conf: "[web]\n    proxy = []\n",
+			err:  "proxy web: server-timeout",
+		},
+		{
+			name: "duplicate route",
+			conf: "[web]" + timeouts + `    proxy = [":80 -> a:80", ":80 -> b:80"]` + "\n",
+			err:  "proxy web: duplicate proxy route :80",
+		},
+		{
+			name: "bad route",
+			conf: "[web]" + timeouts + `    proxy = [{ route = ":80 -> a:80", startup = "eager" }]` + "\n",
+			err:  `proxy web: bad proxy route: startup: unknown policy "eager"`,
+		},
+		{
+			name: "bad limit action",
+			conf: "[web]" + timeouts + `    limit-action = "explode"` + "\n",
+			err:  `proxy web: limit-action: unknown action "explode"`,
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "tcpee.conf")
+		writeConfig(t, path, test.conf)
+		_, err := loadConfig(path, make(map[string]*tcpee.AccessLog))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, expected %s", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+// defaultAdminAddr is the default admin API address used by ctl.
+const defaultAdminAddr = "unix:/run/tcpee.sock"
+
+// ctlUsage prints ctl usage string and exits with code.
+func ctlUsage(code int) {
+	fmt.Printf(`Usage: %s ctl [-a|--admin $addr] [-j|--json] $command [$args...]
+
+Commands:
+  status                    show per-proxy stats
+  conns [$key=$value...]    list connections, filtered by proxy, route, backend or src
+  kill $id                  kill connection by ID
+  kill $key=$value...       kill connections by filter, as for conns
+  backends                  show per-backend stats
+  drain $backend            reject new connections to backend
+  undrain $backend          stop draining backend
+  reload                    reload configuration
+`, os.Args[0])
+	os.Exit(code)
+}
+
+// ctlClient is an admin API client.
+type ctlClient struct {
+	http.Client
+	base string // base is the admin API base URL
+	json bool   // json indicates raw JSON output
+}
+
+// newCtlClient returns a new admin API client for addr, either a TCP
+// address or a unix socket path prefixed by "unix:".
+func newCtlClient(addr string) *ctlClient {
+	client := ctlClient{}
+	client.Timeout = 10 * time.Second
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		client.base = "http://unix"
+	} else {
+		client.base = "http://" + addr
+	}
+	return &client
+}
+
+// runCtl runs the ctl subcommand with args, exiting on completion.
+func runCtl(args []string) {
+	addr := defaultAdminAddr
+	raw := false
+
+	// Parse ctl flags
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-a", "--admin":
+			if len(args) < 2 {
+				ctlUsage(1)
+			}
+			addr = args[1]
+			args = args[2:]
+		case "-j", "--json":
+			raw = true
+			args = args[1:]
+		case "-h", "--help":
+			ctlUsage(0)
+		default:
+			ctlUsage(1)
+		}
+	}
+
+	if len(args) < 1 {
+		ctlUsage(1)
+	}
+
+	// Setup client for admin address
+	client := newCtlClient(addr)
+	client.json = raw
+
+	var err error
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "status" && len(args) == 0:
+		err = client.status()
+	case cmd == "conns":
+		err = client.conns(args)
+	case cmd == "kill" && len(args) > 0:
+		err = client.kill(args)
+	case cmd == "backends" && len(args) == 0:
+		err = client.backends()
+	case cmd == "drain" && len(args) == 1:
+		err = client.do(http.MethodPost, "/backends/"+url.PathEscape(args[0])+"/drain", nil)
+	case cmd == "undrain" && len(args) == 1:
+		err = client.do(http.MethodDelete, "/backends/"+url.PathEscape(args[0])+"/drain", nil)
+	case cmd == "reload" && len(args) == 0:
+		err = client.do(http.MethodPost, "/reload", nil)
+	default:
+		ctlUsage(1)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// status prints the per-proxy stats.
+func (client *ctlClient) status() error {
+	var stats []tcpee.ProxyStats
+	return client.table("/stats", &stats, func(tw io.Writer) {
+		fmt.Fprintln(tw, "PROXY\tOPEN\tCONNS\tIN\tOUT\tERRORS\tREJECTED\tDENIED\tBANNED")
+		for _, s := range stats {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%d\t%d\t%d\t%d\n",
+				s.Name, s.Open, s.Conns,
+				formatSize(s.BytesIn), formatSize(s.BytesOut),
+				s.Errors, s.Rejected, s.Denied, s.Banned,
+			)
+		}
+	})
+}
+
+// conns prints the active connections matching filter args.
+func (client *ctlClient) conns(args []string) error {
+	query, err := parseFilterArgs(args)
+	if err != nil {
+		return err
+	}
+
+	var conns []tcpee.Conn
+	now := time.Now()
+	return client.table("/conns?"+query, &conns, func(tw io.Writer) {
+		fmt.Fprintln(tw, "ID\tPROXY\tSRC\tLISTENER\tBACKEND\tAGE\tIN\tOUT")
+		for _, c := range conns {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				c.ID, c.Proxy, c.Src, c.Listener, c.Backend,
+				now.Sub(c.Start).Round(time.Second),
+				formatSize(c.BytesIn), formatSize(c.BytesOut),
+			)
+		}
+	})
+}
+
+// kill kills the active connection by ID, or those matching filter args.
+func (client *ctlClient) kill(args []string) error {
+	if len(args) == 1 && !strings.Contains(args[0], "=") {
+		return client.do(http.MethodDelete, "/conns/"+url.PathEscape(args[0]), nil)
+	}
+	query, err := parseFilterArgs(args)
+	if err != nil {
+		return err
+	}
+	return client.do(http.MethodDelete, "/conns?"+query, nil)
+}
+
+// backends prints the per-backend stats.
+func (client *ctlClient) backends() error {
+	var backends []tcpee.ProxyBackend
+	return client.table("/backends", &backends, func(tw io.Writer) {
+		fmt.Fprintln(tw, "PROXY\tBACKEND\tSTATE\tOPEN\tCONNS\tIN\tOUT\tERRORS\tREJECTED")
+		for _, b := range backends {
+			state := "active"
+			if b.Drained {
+				state = "draining"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%d\t%d\n",
+				b.Proxy, b.Backend, state, b.Open, b.Conns,
+				formatSize(b.BytesIn), formatSize(b.BytesOut),
+				b.Errors, b.Rejected,
+			)
+		}
+	})
+}
+
+// table fetches path into v, printing it as a table via write (or as raw JSON).
+func (client *ctlClient) table(path string, v interface{}, write func(io.Writer)) error {
+	if client.json {
+		return client.do(http.MethodGet, path, nil)
+	}
+	if err := client.do(http.MethodGet, path, v); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	write(tw)
+	return tw.Flush()
+}
+
+// do performs an admin API request, decoding the response into v if
+// set, else printing the raw response (or a short summary of it).
+func (client *ctlClient) do(method string, path string, v interface{}) error {
+	req, err := http.NewRequest(method, client.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(tcpee.AdminHeader, "1")
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s (%d)", e.Error, rsp.StatusCode)
+		}
+		return fmt.Errorf("unexpected status %s", rsp.Status)
+	}
+
+	if v != nil {
+		return json.Unmarshal(b, v)
+	}
+
+	if client.json {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	// Print summary of result
+	var m map[string]interface{}
+	if json.Unmarshal(b, &m) == nil {
+		var parts []string
+		for k, v := range m {
+			parts = append(parts, fmt.Sprintf("%s: %v", k, v))
+		}
+		fmt.Println(strings.Join(parts, ", "))
+	}
+
+	return nil
+}
+
+// parseFilterArgs parses "{key}={value}" connection filter arguments into a query string.
+func parseFilterArgs(args []string) (string, error) {
+	query := url.Values{}
+	for _, arg := range args {
+		split := strings.SplitN(arg, "=", 2)
+		if len(split) != 2 {
+			return "", fmt.Errorf("invalid filter %q, expected {key}={value}", arg)
+		}
+		switch split[0] {
+		case "proxy", "route", "backend", "src":
+			query.Set(split[0], split[1])
+		default:
+			return "", fmt.Errorf("unknown filter key %q", split[0])
+		}
+	}
+	return query.Encode(), nil
+}
+
+// formatSize formats a byte count in human readable form.
+func formatSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for n := n / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+func TestParseFilterArgs(t *testing.T) {
+	for _, test := range []struct {
+		args  []string
+		query string
+		err   string
+	}{
+		{nil, "", ""},
+		{[]string{"proxy=web"}, "proxy=web", ""},
+		{[]string{"src=10.0.0.0/8", "route=:80"}, "route=%3A80&src=10.0.0.0%2F8", ""},
+		{[]string{"backend=a=b"}, "backend=a%3Db", ""},
+		{[]string{"proxy"}, "", "invalid filter"},
+		{[]string{"id=1"}, "", "unknown filter key"},
+	} {
+		query, err := parseFilterArgs(test.args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: error = %v, expected %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil || query != test.query {
+			t.Errorf("%v = %q, %v, expected %q", test.args, query, err, test.query)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for n, str := range map[uint64]string{
+		0:           "0B",
+		1023:        "1023B",
+		1024:        "1.0KiB",
+		1536:        "1.5KiB",
+		1024 * 1024: "1.0MiB",
+		5 << 30:     "5.0GiB",
+	} {
+		if got := formatSize(n); got != str {
+			t.Errorf("formatSize(%d) = %q, expected %q", n, got, str)
+		}
+	}
+}
+
+func TestCtlClient(t *testing.T) {
+	proxy := &tcpee.TCPProxy{Name: "web"}
+	defer proxy.Close()
+	srv := httptest.NewServer(&tcpee.Admin{Proxies: []*tcpee.TCPProxy{proxy}})
+	defer srv.Close()
+
+	client := newCtlClient(strings.TrimPrefix(srv.URL, "http://"))
+
+	var stats []tcpee.ProxyStats
+	if err := client.do(http.MethodGet, "/stats", &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "web" {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// API errors are surfaced with their status
+	err := client.kill([]string{"unknown"})
+	if err == nil || err.Error() != "connection not found (404)" {
+		t.Fatalf("kill unknown = %v", err)
+	}
+	err = client.kill([]string{"bogus=1"})
+	if err == nil || !strings.Contains(err.Error(), "unknown filter key") {
+		t.Fatalf("kill bogus filter = %v", err)
+	}
+	err = client.do(http.MethodGet, "/unknown", nil)
+	if err == nil || err.Error() != "not found (404)" {
+		t.Fatalf("get unknown = %v", err)
+	}
+}
+
+func TestCtlClientUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: &tcpee.Admin{}}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	var conns []tcpee.Conn
+	client := newCtlClient("unix:" + path)
+	if err := client.do(http.MethodGet, "/conns", &conns); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 0 {
+		t.Fatalf("conns = %+v", conns)
+	}
+}
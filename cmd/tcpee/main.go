@@ -2,14 +2,12 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
 	"syscall"
-	"time"
 
-	"codeberg.org/gruf/go-config"
 	"codeberg.org/gruf/go-logger/v2/log"
 	"codeberg.org/gruf/tcpee"
 )
@@ -17,20 +15,27 @@ import (
 // usage prints usage string and exits with code.
 func usage(code int) {
 	fmt.Printf("Usage: %s [-c|--config $file]\n", os.Args[0])
+	fmt.Printf("       %s ctl [-a|--admin $addr] [-j|--json] $command [$args...]\n", os.Args[0])
+	fmt.Printf("       %s top [-a|--admin $addr] [-i|--interval $duration]\n", os.Args[0])
+	fmt.Printf("       %s replay -f|--file $file [-t|--target $addr] [-s|--speed $speed] [-c|--compare]\n", os.Args[0])
 	os.Exit(code)
 }
 
-// closeAll will block until all proxies have closed.
-func closeAll(proxies []*tcpee.TCPProxy) {
-	wg := sync.WaitGroup{}
-	for _, proxy := range proxies {
-		wg.Add(1)
-		go func(p *tcpee.TCPProxy) {
-			p.Close()
-			wg.Done()
-		}(proxy)
+// service is an admin / metrics HTTP server, closed once handed over on upgrade.
+type service struct {
+	name string       // name describes the service, for logging
+	ln   net.Listener // ln is the service listener
+	srv  http.Server  // srv is the HTTP server serving on ln
+}
+
+// serve serves the service on its listener, exiting on error
+// other than the server being closed.
+func (sv *service) serve() {
+	log.Printf("Serving %s on %s", sv.name, sv.ln.Addr())
+	err := sv.srv.Serve(sv.ln)
+	if err != http.ErrServerClosed {
+		log.Fatalf("Failed serving %s: %v", sv.name, err)
 	}
-	wg.Wait()
 }
 
 func main() {
@@ -45,106 +50,166 @@ func main() {
 				usage(1)
 			}
 			configFile = os.Args[2]
+		case "ctl":
+			runCtl(os.Args[2:])
+		case "top":
+			runTop(os.Args[2:])
+			os.Exit(0)
+		case "replay":
+			runReplay(os.Args[2:])
 		default:
 			usage(1)
 		}
 	}
 
+	// Listeners passed on by an upgrading parent
+	if err := inherited.load(); err != nil {
+		log.Fatalf("Failed loading inherited listeners: %v", err)
+	}
+
 	// Read config from file
-	tree := make(config.Tree)
-	proxies := tree.Wildcard("*", map[string]interface{}{
-		"server-timeout":   "",
-		"client-timeout":   "",
-		"server-keepalive": "",
-		"client-keepalive": "",
-		"proxy":            []interface{}{},
-		"transparent":      false,
-		"proxy-proto":      false,
-	}, false, true)
-	tree.Parse(configFile)
-	tree = nil // to the GC with you!
-
-	var running []*tcpee.TCPProxy
-	for name, details := range *proxies {
-		// Define used values
-		var sTimeout, cTimeout time.Duration
-		var sKeepAlive, cKeepAlive time.Duration
-		var proxyProto bool
-		var str string
-		var err error
-
-		// Parse provided details
-		str, _ = details["server-timeout"].(string)
-		sTimeout, err = time.ParseDuration(str)
-		if err != nil {
-			log.Fatalf("Failed parsing server-timeout: %v", err)
-		}
-		str, _ = details["client-timeout"].(string)
-		cTimeout, err = time.ParseDuration(str)
-		if err != nil {
-			log.Fatalf("Failed parsing client-timeout: %v", err)
-		}
-		str, _ = details["server-keepalive"].(string)
-		sKeepAlive, err = time.ParseDuration(str)
+	accessLogs := make(map[string]*tcpee.AccessLog)
+	cfg, err := loadConfig(configFile, accessLogs)
+	if err != nil {
+		log.Fatalf("Failed loading config file %s: %v", configFile, err)
+	}
+
+	// Process-wide client banlist
+	bans := &tcpee.Banlist{
+		Threshold:  int(cfg.banThreshold),
+		Window:     cfg.banWindow,
+		BanTime:    cfg.banTime,
+		MaxBanTime: cfg.banMaxTime,
+		ForgetTime: cfg.banForget,
+		StateFile:  cfg.banStateFile,
+	}
+	if err := bans.Load(); err != nil {
+		log.Fatalf("Failed loading ban state: %v", err)
+	}
+
+	// Admin / metrics services by address
+	services := make(map[string]*service)
+
+	// Optional prometheus metrics
+	var metrics *tcpee.Metrics
+	if cfg.metricsAddr != "" {
+		ln, err := listen(cfg.metricsAddr)
 		if err != nil {
-			log.Fatalf("Failed parsing server-keepalive: %v", err)
+			log.Fatalf("Failed serving metrics: %v", err)
 		}
-		str, _ = details["client-keepalive"].(string)
-		cKeepAlive, err = time.ParseDuration(str)
+		metrics = &tcpee.Metrics{}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		sv := &service{name: "metrics", ln: ln}
+		sv.srv.Handler = mux
+		services[cfg.metricsAddr] = sv
+		go sv.serve()
+	}
+
+	// Optional admin API listener
+	var adminSv *service
+	if cfg.adminAddr != "" {
+		ln, err := listen(cfg.adminAddr)
 		if err != nil {
-			log.Fatalf("Failed parsing client-keepalive: %v", err)
-		}
-		proxyProto, _ = details["proxy-proto"].(bool)
-
-		// Create new proxy server
-		log.Printf("Starting proxy \"%s\"", name)
-		proxy := tcpee.TCPProxy{
-			Name:            name,
-			ProxyProto:      proxyProto,
-			ClientKeepAlive: cKeepAlive,
-			ServerKeepAlive: sKeepAlive,
-			ClientTimeout:   cTimeout,
-			ServerTimeout:   sTimeout,
+			log.Fatalf("Failed serving admin API: %v", err)
 		}
+		adminSv = &service{name: "admin API", ln: ln}
+		services[cfg.adminAddr] = adminSv
+	}
 
-		// Iter supplied proxying addresses
-		for _, entry := range details["proxy"].([]interface{}) {
-			entry, _ := entry.(string)
+	srv := &server{
+		path:        configFile,
+		globalConns: tcpee.NewSemaphore(int(cfg.maxConns)),
+		bans:        bans,
+		metrics:     metrics,
+		routeErrs:   make(chan *tcpee.RouteError),
+		admin:       &tcpee.Admin{Bans: bans},
+		services:    services,
+	}
+	srv.admin.Reload = srv.reload
 
-			// Separate src + dst addresses
-			split := strings.Split(entry, " -> ")
-			if len(split) != 2 {
-				log.Fatal(`Bad proxy configuration, expect "{src} -> {dst}"`)
-			}
+	// Failed routes are logged and restarted
+	go srv.restartRoutes()
 
-			// Start proxying!
-			go func() {
-				err := proxy.Proxy(split[0], split[1])
-				if err != nil && err != tcpee.ErrProxyClosed {
-					closeAll(running)
-					log.Fatal(err)
-				}
-			}()
-		}
+	// Start proxying!
+	if err := srv.start(cfg, accessLogs); err != nil {
+		log.Fatal(err)
+	}
 
-		// Add to running proxies
-		running = append(running, &proxy)
+	// Optional admin API
+	if adminSv != nil {
+		adminSv.srv.Handler = srv.admin
+		go adminSv.serve()
 	}
 
-	// Wait on OS signals
+	// Signal upgrading parent / systemd we're ready
+	inherited.signalReady()
+	srv.notifyReady()
+	stopWatchdog := make(chan struct{})
+	go sdWatchdog(srv.alive, stopWatchdog)
+
+	// Reopen access logs on SIGUSR1
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGUSR1)
+	go func() {
+		for range reopen {
+			log.Print("Signal SIGUSR1 received, reopening access logs...")
+			srv.reopenLogs()
+		}
+	}()
+
+	// Reload config on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Print("Signal SIGHUP received, reloading configuration...")
+			_ = srv.reload()
+		}
+	}()
+
+	// Wait on OS signals, upgrading on SIGUSR2
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
-	sig := <-signals
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Signal %v received, draining proxies...", sig)
+			sdNotify("STOPPING=1\nSTATUS=Draining connections")
+			break wait
+
+		case <-upgrade:
+			log.Print("Signal SIGUSR2 received, upgrading binary...")
+			sdNotify("STATUS=Upgrading binary")
+			if err := srv.upgrade(); err != nil {
+				log.Errorf("Failed upgrading binary: %v", err)
+				sdNotify("STATUS=Upgrade failed: " + err.Error())
+				continue
+			}
+			log.Print("Upgraded binary, draining proxies...")
+			srv.closeServices()
+			break wait
+		}
+	}
+
+	// No longer watched while draining
+	close(stopWatchdog)
 
-	log.Printf("Signal %v received, closing proxies...", sig)
 	go func() {
-		// Close all + exit
-		closeAll(running)
+		// Drain all + exit
+		srv.shutdown()
+		srv.closeLogs()
+		bans.Flush()
+		log.Print("Proxies closed, exiting")
 		os.Exit(0)
 	}()
 
-	// Give time to finish
-	sleep := 30 * time.Second
-	time.Sleep(sleep)
-	log.Fatal("Proxies still running after %v, forcibly closing", sleep)
+	// Force exit on second signal
+	sig := <-signals
+	log.Errorf("Signal %v received, forcing exit", sig)
+	os.Exit(1)
 }
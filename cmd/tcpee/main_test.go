@@ -0,0 +1,19 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"testing"
+
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+func TestMain(m *testing.M) {
+	// Only log in verbose mode
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
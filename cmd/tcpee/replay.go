@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+// replayUsage prints replay usage string and exits with code.
+func replayUsage(code int) {
+	fmt.Printf(`Usage: %s replay -f|--file $file [-t|--target $addr] [-s|--speed $speed] [-c|--compare] [-w|--wait $duration]
+
+Replays the client -> server data of a session recording (see capture-format
+"session") against a backend, with the recorded timing.
+
+Options:
+  -f, --file $file        session recording to replay
+  -t, --target $addr      backend address, defaults to the recorded backend
+  -s, --speed $speed      replay speed multiplier, e.g. 2x or 0.5x, or max for no delays
+  -c, --compare           compare server responses to the recorded ones
+  -w, --wait $duration    time to wait for responses after replay (default 5s)
+
+Exits with status 2 if compared responses differ.
+`, os.Args[0])
+	os.Exit(code)
+}
+
+// runReplay runs the replay subcommand with args, exiting on completion.
+func runReplay(args []string) {
+	var file, target string
+	var compare bool
+	speed := 1.0
+	wait := 5 * time.Second
+
+	// Parse replay flags
+	for len(args) > 0 {
+		switch args[0] {
+		case "-c", "--compare":
+			compare = true
+			args = args[1:]
+			continue
+		case "-h", "--help":
+			replayUsage(0)
+		}
+
+		if len(args) < 2 {
+			replayUsage(1)
+		}
+
+		var err error
+		switch args[0] {
+		case "-f", "--file":
+			file = args[1]
+		case "-t", "--target":
+			target = args[1]
+		case "-s", "--speed":
+			speed, err = parseSpeed(args[1])
+		case "-w", "--wait":
+			wait, err = time.ParseDuration(args[1])
+		default:
+			replayUsage(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		args = args[2:]
+	}
+
+	if file == "" {
+		replayUsage(1)
+	}
+
+	match, err := replay(file, target, speed, compare, wait)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	} else if !match {
+		os.Exit(2)
+	}
+
+	os.Exit(0)
+}
+
+// parseSpeed parses a replay speed multiplier of form "2x", "0.5" or "max",
+// returning zero for max (i.e. no delays).
+func parseSpeed(str string) (float64, error) {
+	if str == "max" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSuffix(str, "x"), 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid speed %q", str)
+	}
+	return f, nil
+}
+
+// replay replays the session recording at file against target with speed,
+// printing a summary, and when compare is set reporting whether the server
+// responses matched the recorded ones.
+func replay(file string, target string, speed float64, compare bool, wait time.Duration) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sr, err := tcpee.NewSessionReader(f)
+	if err != nil {
+		return false, err
+	}
+
+	if target == "" {
+		target = sr.Header.Dst
+	}
+
+	fmt.Printf("Replaying session %s (%s -> %s) against %s\n",
+		sr.Header.ID, sr.Header.Src, sr.Header.Dst, target)
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Read server responses in the background
+	resp := &replayBuffer{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(resp, conn)
+		resp.finish(err)
+	}()
+
+	var expect bytes.Buffer
+	var sent, frames int
+	var inSkip bool  // inSkip indicates client data missing from recording
+	var outSkip bool // outSkip indicates server data missing from recording
+	start := time.Now()
+
+	for {
+		frame, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+
+		if !frame.In {
+			// Only compare up to the first gap in responses
+			if frame.Skip > 0 {
+				outSkip = true
+			}
+			if !outSkip {
+				expect.Write(frame.Data)
+			}
+			continue
+		}
+
+		if frame.Skip > 0 {
+			inSkip = true
+		}
+
+		if speed > 0 {
+			// Wait until frame's scaled offset
+			at := start.Add(time.Duration(float64(frame.Offset) / speed))
+			time.Sleep(time.Until(at))
+		}
+
+		if _, err := conn.Write(frame.Data); err != nil {
+			return false, fmt.Errorf("error writing to target: %w", err)
+		}
+
+		sent += len(frame.Data)
+		frames++
+	}
+
+	if !compare {
+		// Signal end of replay to server
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}
+
+	// Wait for the expected responses, server close, or timeout
+	deadline := time.Now().Add(wait)
+	for !resp.has(expect.Len(), compare) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+	<-done
+
+	got, rerr := resp.result()
+	fmt.Printf("Sent %d bytes in %d frames, received %d bytes in %s\n",
+		sent, frames, len(got), time.Since(start).Round(time.Millisecond))
+
+	if inSkip {
+		fmt.Println("Warning: recording is missing client data, the recorder fell behind")
+	}
+	if sr.Truncated {
+		fmt.Println("Warning: recording was truncated at max bytes")
+	}
+	if rerr != nil && !errors.Is(rerr, net.ErrClosed) {
+		fmt.Printf("Warning: error reading from target: %v\n", rerr)
+	}
+
+	if !compare {
+		return true, nil
+	}
+
+	if outSkip {
+		fmt.Printf("Warning: recording is missing server data, comparing first %d bytes only\n", expect.Len())
+		if len(got) > expect.Len() {
+			got = got[:expect.Len()]
+		}
+	} else if sr.Truncated && len(got) > expect.Len() {
+		got = got[:expect.Len()]
+	}
+
+	return compareResponses(expect.Bytes(), got), nil
+}
+
+// compareResponses compares the expected and received server responses,
+// printing the first difference (if any), and returns whether they match.
+func compareResponses(expect, got []byte) bool {
+	if bytes.Equal(expect, got) {
+		fmt.Printf("Responses match (%d bytes)\n", len(got))
+		return true
+	}
+
+	// Find first differing offset
+	i := 0
+	for i < len(expect) && i < len(got) && expect[i] == got[i] {
+		i++
+	}
+
+	fmt.Printf("Responses differ at offset %d (expected %d bytes, received %d bytes)\n",
+		i, len(expect), len(got))
+
+	// Print context around difference
+	from := i - i%16
+	if from >= 16 {
+		from -= 16
+	}
+	fmt.Print("Expected:\n" + hexContext(expect, from))
+	fmt.Print("Received:\n" + hexContext(got, from))
+
+	return false
+}
+
+// hexContext returns a hexdump of up to 64 bytes of b from offset.
+func hexContext(b []byte, from int) string {
+	if from >= len(b) {
+		return "  (none)\n"
+	}
+	b = b[from:]
+	if len(b) > 64 {
+		b = b[:64]
+	}
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(hex.Dump(b), "\n") {
+		if line == "" {
+			continue
+		}
+		// Rewrite the relative offsets to absolute
+		if off, err := strconv.ParseUint(line[:8], 16, 64); err == nil {
+			line = fmt.Sprintf("%08x", off+uint64(from)) + line[8:]
+		}
+		sb.WriteString("  " + line)
+	}
+	return sb.String()
+}
+
+// replayBuffer collects the server responses during replay.
+type replayBuffer struct {
+	mutex sync.Mutex
+	buf   []byte
+	err   error
+	eof   bool
+}
+
+func (rb *replayBuffer) Write(b []byte) (int, error) {
+	rb.mutex.Lock()
+	rb.buf = append(rb.buf, b...)
+	rb.mutex.Unlock()
+	return len(b), nil
+}
+
+// finish marks the response stream as finished with err.
+func (rb *replayBuffer) finish(err error) {
+	rb.mutex.Lock()
+	rb.err = err
+	rb.eof = true
+	rb.mutex.Unlock()
+}
+
+// has returns whether n bytes of responses have been received, if
+// compare is set, else only once the response stream has finished.
+func (rb *replayBuffer) has(n int, compare bool) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	return rb.eof || (compare && n > 0 && len(rb.buf) >= n)
+}
+
+// result returns the received responses and any read error.
+func (rb *replayBuffer) result() ([]byte, error) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	return rb.buf, rb.err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+// writeRecording writes a session recording of frames to a temporary file,
+// with the supplied backend address, optionally marked as truncated.
+func writeRecording(t *testing.T, dst string, frames []tcpee.SessionFrame, truncated bool) string {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("tcpee-session v1\n")
+	hdr, _ := json.Marshal(tcpee.SessionHeader{Proxy: "web", ID: "1", Src: "192.0.2.1:40000", Dst: dst})
+	buf.Write(hdr)
+	buf.WriteByte('\n')
+	for _, frame := range frames {
+		typ := byte('<')
+		if frame.In {
+			typ = '>'
+		}
+		var b [3 * binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(b[:], uint64(frame.Offset))
+		n += binary.PutUvarint(b[n:], frame.Skip)
+		n += binary.PutUvarint(b[n:], uint64(len(frame.Data)))
+		buf.WriteByte(typ)
+		buf.Write(b[:n])
+		buf.Write(frame.Data)
+	}
+	if truncated {
+		buf.WriteByte('!')
+	}
+	path := filepath.Join(t.TempDir(), "web-1.rec")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveTCP serves conns on a loopback TCP listener with handle until the test ends.
+func serveTCP(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// silence discards stdout until the test ends.
+func silence(t *testing.T) {
+	stdout := os.Stdout
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = null
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		null.Close()
+	})
+}
+
+func TestParseSpeed(t *testing.T) {
+	for _, test := range []struct {
+		str   string
+		speed float64
+		ok    bool
+	}{
+		{"max", 0, true},
+		{"1", 1, true},
+		{"2x", 2, true},
+		{"0.5x", 0.5, true},
+		{"0x", 0, false},
+		{"-1", 0, false},
+		{"fast", 0, false},
+	} {
+		speed, err := parseSpeed(test.str)
+		if (err == nil) != test.ok || speed != test.speed {
+			t.Errorf("parseSpeed(%q) = %v, %v", test.str, speed, err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	silence(t)
+
+	echo := serveTCP(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	upper := serveTCP(t, func(conn net.Conn) {
+		b := make([]byte, 64)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(bytes.ToUpper(b[:n]))
+		}
+	})
+
+	frames := []tcpee.SessionFrame{
+		{In: true, Data: []byte("hello ")},
+		{In: false, Offset: time.Millisecond, Data: []byte("hello ")},
+		{In: true, Offset: 20 * time.Millisecond, Data: []byte("world")},
+		{In: false, Offset: 21 * time.Millisecond, Data: []byte("world")},
+	}
+
+	for _, test := range []struct {
+		name      string
+		target    string
+		frames    []tcpee.SessionFrame
+		truncated bool
+		speed     float64
+		compare   bool
+		match     bool
+	}{
+		{"recorded target", echo, frames, false, 1, true, true},
+		{"differing responses", upper, frames, false, 0, true, false},
+		{"no compare", upper, frames, false, 0, false, true},
+		{"missing server data", echo, []tcpee.SessionFrame{
+			frames[0], frames[1], frames[2],
+			{Offset: 21 * time.Millisecond, Skip: 2, Data: []byte("rld")},
+		}, false, 0, true, true},
+		{"truncated", echo, frames[:3], true, 0, true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeRecording(t, echo, test.frames, test.truncated)
+			start := time.Now()
+			match, err := replay(path, test.target, test.speed, test.compare, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != test.match {
+				t.Fatalf("match = %v, expected %v", match, test.match)
+			}
+			if test.speed > 0 && time.Since(start) < 20*time.Millisecond {
+				t.Fatal("replay timing not kept")
+			}
+		})
+	}
+
+	// Unreachable target
+	path := writeRecording(t, "127.0.0.1:1", frames, false)
+	if _, err := replay(path, "", 0, true, time.Second); err == nil {
+		t.Fatal("replayed to unreachable target")
+	}
+}
+
+func TestHexContext(t *testing.T) {
+	b := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	ctx := hexContext(b, 32)
+	lines := strings.Split(strings.TrimSuffix(ctx, "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "  00000020") || !strings.HasPrefix(lines[3], "  00000050") {
+		t.Fatalf("context = %q", ctx)
+	}
+	if ctx := hexContext(b, len(b)); ctx != "  (none)\n" {
+		t.Fatalf("context past end = %q", ctx)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"codeberg.org/gruf/go-logger/v2/log"
+	"codeberg.org/gruf/tcpee"
+)
+
+// routeRestartDelay is the delay between attempts to restart a failed route.
+const routeRestartDelay = 5 * time.Second
+
+// settingsKeys are the proxy block keys updated in place on reload, see tcpee.Settings.
+var settingsKeys = []string{"server-timeout", "client-timeout", "server-keepalive", "client-keepalive"}
+
+// errStopping is returned by reload once the server has begun
+// shutting down, or has been upgraded.
+var errStopping = errors.New("server shutting down, reload disabled")
+
+// server is the running set of proxies, reconfigured in place on reload.
+type server struct {
+	path string // path is the configuration file path
+
+	globalConns *tcpee.Semaphore       // globalConns is the process-wide conn limit
+	bans        *tcpee.Banlist         // bans is the process-wide banlist
+	metrics     *tcpee.Metrics         // metrics are the optional prometheus metrics
+	routeErrs   chan *tcpee.RouteError // routeErrs receives failed routes
+	admin       *tcpee.Admin           // admin is the optional admin API
+	services    map[string]*service    // services are the admin / metrics services by address
+
+	mutex    sync.Mutex                  // mutex protects the below fields
+	cfg      *fileConfig                 // cfg is the running configuration
+	logs     map[string]*tcpee.AccessLog // logs are the access log sinks by path
+	proxies  map[string]*runningProxy    // proxies are the running proxies by name
+	draining []*tcpee.TCPProxy           // draining are the removed proxies still draining
+	upgraded bool                        // upgraded indicates a successful binary upgrade
+	stopping bool                        // stopping indicates shutdown has begun
+}
+
+// runningProxy is a running proxy and its routes.
+type runningProxy struct {
+	proxy    *tcpee.TCPProxy          // proxy is the running proxy
+	details  map[string]interface{}   // details are the raw block settings, sans routes
+	settings tcpee.Settings           // settings are the proxy's current updatable settings
+	routes   map[string]*runningRoute // routes are the running routes by listen address
+}
+
+// runningRoute is a running proxy route.
+type runningRoute struct {
+	handle *tcpee.RouteHandle // handle controls the running route
+	entry  interface{}        // entry is the raw route entry
+}
+
+// start starts the proxies in cfg, stopping any already started on error.
+func (s *server) start(cfg *fileConfig, logs map[string]*tcpee.AccessLog) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cfg = &fileConfig{drainTimeout: cfg.drainTimeout}
+	if err := s.apply(cfg); err != nil {
+		return err
+	}
+	s.cfg, s.logs = cfg, logs
+	s.admin.SetProxies(s.list())
+	return nil
+}
+
+// reload re-reads the configuration file and applies it to the running
+// proxies, keeping the running configuration if invalid or on error.
+// Returns errStopping once shutting down or upgraded.
+func (s *server) reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping || s.upgraded {
+		log.Errorf("Ignoring reload: %v", errStopping)
+		return errStopping
+	}
+
+	log.Printf("Reloading configuration from %s", s.path)
+	sdNotify("RELOADING=1")
+
+	// Parse config, sharing open access logs
+	logs := make(map[string]*tcpee.AccessLog, len(s.logs))
+	for path, al := range s.logs {
+		logs[path] = al
+	}
+	cfg, err := loadConfig(s.path, logs)
+	if err == nil {
+		err = s.apply(cfg)
+	}
+	if err != nil {
+		// Close any newly opened access logs
+		for path, al := range logs {
+			if s.logs[path] != al {
+				al.Close()
+			}
+		}
+		log.Errorf("Failed reloading configuration, keeping current: %v", err)
+		sdNotify("READY=1\nSTATUS=Reload failed: " + err.Error())
+		return err
+	}
+
+	// Warn on settings that can't be reloaded
+	for key, changed := range map[string]bool{
+		"max-connections": cfg.maxConns != s.cfg.maxConns,
+		"ban-threshold":   cfg.banThreshold != s.cfg.banThreshold,
+		"ban-window":      cfg.banWindow != s.cfg.banWindow,
+		"ban-time":        cfg.banTime != s.cfg.banTime,
+		"ban-max-time":    cfg.banMaxTime != s.cfg.banMaxTime,
+		"ban-forget-time": cfg.banForget != s.cfg.banForget,
+		"ban-state-file":  cfg.banStateFile != s.cfg.banStateFile,
+		"metrics-listen":  cfg.metricsAddr != s.cfg.metricsAddr,
+		"admin-listen":    cfg.adminAddr != s.cfg.adminAddr,
+	} {
+		if changed {
+			log.Errorf("Ignoring changed %s, requires restart", key)
+		}
+	}
+
+	s.cfg, s.logs = cfg, logs
+	s.closeUnusedLogs()
+	s.admin.SetProxies(s.list())
+	log.Print("Reloaded configuration")
+	sdNotify("READY=1\nSTATUS=" + s.status())
+	return nil
+}
+
+// notifyReady notifies systemd that the server is ready.
+func (s *server) notifyReady() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sdNotify("READY=1\nSTATUS=" + s.status())
+}
+
+// alive returns once the server mutex can be taken, blocking while held,
+// e.g. indefinitely if deadlocked. Used as the systemd watchdog liveness check.
+func (s *server) alive() {
+	s.mutex.Lock()
+	s.mutex.Unlock()
+}
+
+// status returns a summary of the running proxies, e.g. for systemd.
+// The server mutex must be held.
+func (s *server) status() string {
+	var routes int
+	for _, rp := range s.proxies {
+		routes += len(rp.routes)
+	}
+	return fmt.Sprintf("Proxying %d routes in %d proxies", routes, len(s.proxies))
+}
+
+// apply applies cfg to the running proxies: starting new proxies and routes,
+// replacing changed routes and updating timeouts, keep-alives and drain-idle
+// in place, moving the listeners of proxies with other changed settings to
+// new proxy instances, and draining removed ones. On error all changes are
+// undone. The server mutex must be held.
+func (s *server) apply(cfg *fileConfig) error {
+	var undo []func()          // undo are the changes to undo on error
+	var stop []*runningRoute   // stop are the removed routes to stop
+	var retire []*runningProxy // retire are the old proxies to drain
+
+	next := make(map[string]*runningProxy, len(cfg.proxies))
+	err := func() error {
+		for _, name := range sortedNames(cfg.proxies) {
+			pc := cfg.proxies[name]
+			old := s.proxies[name]
+
+			var rp *runningProxy
+			var err error
+
+			if old != nil && sameDetails(old.details, pc.details) {
+				// Unchanged proxy settings, update routes in place
+				rp, err = s.updateRoutes(old, pc, &undo)
+				if err == nil {
+					for src, rr := range old.routes {
+						if _, ok := rp.routes[src]; !ok {
+							stop = append(stop, rr)
+						}
+					}
+					s.updateSettings(rp, old.settings, &undo)
+				}
+			} else {
+				// New or changed proxy, start new instance
+				rp, err = s.startProxy(old, pc, &undo)
+				if old != nil {
+					retire = append(retire, old)
+				}
+			}
+
+			if err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+
+			next[name] = rp
+		}
+		return nil
+	}()
+
+	if err != nil {
+		// Undo in reverse
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+
+	// Drain removed proxies
+	for name, old := range s.proxies {
+		if _, ok := next[name]; !ok {
+			log.Printf("Stopping proxy \"%s\"", name)
+			retire = append(retire, old)
+		}
+	}
+
+	// Stop removed routes, leaving
+	// their open conns to finish
+	for _, rr := range stop {
+		log.Printf("Stopping proxy route %s", rr.handle.Route().Src)
+		rr.handle.Stop()
+	}
+
+	for _, old := range retire {
+		s.drain(old.proxy, cfg.drainTimeout)
+	}
+
+	s.proxies = next
+	return nil
+}
+
+// updateRoutes updates the routes of running proxy old to those in pc,
+// starting new routes and replacing changed ones. Removed routes are left
+// running. Changes are appended to undo. The server mutex must be held.
+func (s *server) updateRoutes(old *runningProxy, pc *proxyConfig, undo *[]func()) (*runningProxy, error) {
+	rp := runningProxy{
+		proxy:    old.proxy,
+		details:  pc.details,
+		settings: settingsOf(pc.proxy),
+		routes:   make(map[string]*runningRoute, len(pc.routes)),
+	}
+
+	for _, rc := range pc.routes {
+		rr := old.routes[rc.route.Src]
+
+		switch {
+		// New route
+		case rr == nil:
+			log.Printf("Starting proxy route %s -> %s", rc.route.Src, rc.route.Dst)
+			h, err := startRoute(rp.proxy, rc.route)
+			if err != nil {
+				return nil, err
+			}
+			*undo = append(*undo, h.Stop)
+			rp.routes[rc.route.Src] = &runningRoute{handle: h, entry: rc.entry}
+
+		// Unchanged route
+		case reflect.DeepEqual(rr.entry, rc.entry):
+			rp.routes[rc.route.Src] = rr
+
+		// Changed route
+		default:
+			log.Printf("Updating proxy route %s -> %s", rc.route.Src, rc.route.Dst)
+			prev := rr.handle.Route()
+			if err := rr.handle.Replace(rc.route); err != nil {
+				return nil, err
+			}
+			*undo = append(*undo, func() {
+				if err := rr.handle.Replace(prev); err != nil {
+					log.Errorf("Failed restoring proxy route %s: %v", prev.Src, err)
+				}
+			})
+			rp.routes[rc.route.Src] = &runningRoute{handle: rr.handle, entry: rc.entry}
+		}
+	}
+
+	return &rp, nil
+}
+
+// updateSettings updates the settings of running proxy rp in place if
+// changed from prev, applied to its conns accepted from then on. Changes
+// are appended to undo. The server mutex must be held.
+func (s *server) updateSettings(rp *runningProxy, prev tcpee.Settings, undo *[]func()) {
+	if rp.settings == prev {
+		return
+	}
+	log.Printf("Updating proxy \"%s\" settings", rp.proxy.Name)
+	rp.proxy.Update(rp.settings)
+	*undo = append(*undo, func() { rp.proxy.Update(prev) })
+}
+
+// settingsOf returns the updatable settings configured on proxy.
+func settingsOf(proxy *tcpee.TCPProxy) tcpee.Settings {
+	return tcpee.Settings{
+		ClientTimeout:   proxy.ClientTimeout,
+		ServerTimeout:   proxy.ServerTimeout,
+		ClientKeepAlive: proxy.ClientKeepAlive,
+		ServerKeepAlive: proxy.ServerKeepAlive,
+		DrainIdle:       proxy.DrainIdle,
+	}
+}
+
+// sameDetails returns whether raw proxy block settings a and b are
+// equal, ignoring those updated in place (see settingsKeys).
+func sameDetails(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if !contains(settingsKeys, key) && !reflect.DeepEqual(val, b[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains returns whether strs contains str.
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// startProxy starts the proxy in pc, taking over the listeners of any of
+// old's routes it shares. Changes are appended to undo. The server mutex
+// must be held.
+func (s *server) startProxy(old *runningProxy, pc *proxyConfig, undo *[]func()) (*runningProxy, error) {
+	proxy := pc.proxy
+	proxy.GlobalConns = s.globalConns
+	proxy.Bans = s.bans
+	proxy.Metrics = s.metrics
+	proxy.RouteErrors = s.routeErrs
+
+	if old == nil {
+		log.Printf("Starting proxy \"%s\"", proxy.Name)
+	} else {
+		log.Printf("Reconfiguring proxy \"%s\"", proxy.Name)
+	}
+
+	rp := runningProxy{
+		proxy:    proxy,
+		details:  pc.details,
+		settings: settingsOf(proxy),
+		routes:   make(map[string]*runningRoute, len(pc.routes)),
+	}
+	*undo = append(*undo, proxy.Close)
+
+	for _, rc := range pc.routes {
+		var rr *runningRoute
+		if old != nil {
+			rr = old.routes[rc.route.Src]
+		}
+
+		if rr != nil {
+			// Take over the old route's listener
+			h, err := s.moveRoute(old.proxy, rr, proxy, rc.route, undo)
+			if err == nil {
+				rp.routes[rc.route.Src] = &runningRoute{handle: h, entry: rc.entry}
+				continue
+			} else if !errors.Is(err, tcpee.ErrRouteStopped) {
+				return nil, err
+			}
+
+			// Old route had failed, start anew
+		}
+
+		// Start proxying!
+		h, err := startRoute(proxy, rc.route)
+		if err != nil {
+			return nil, err
+		}
+		*undo = append(*undo, h.Stop)
+		rp.routes[rc.route.Src] = &runningRoute{handle: h, entry: rc.entry}
+	}
+
+	return &rp, nil
+}
+
+// startRoute starts route r on proxy, serving any listener inherited for it.
+func startRoute(proxy *tcpee.TCPProxy, r tcpee.Route) (*tcpee.RouteHandle, error) {
+	ln := inherited.take(r.Src)
+	if ln == nil {
+		return proxy.StartRoute(r)
+	}
+	h, err := proxy.StartRouteListener(ln, r)
+	if err != nil {
+		ln.Close()
+	}
+	return h, err
+}
+
+// moveRoute moves running route rr of proxy from to proxy with route r, handing
+// over its listener so no conns are refused. Changes are appended to undo.
+func (s *server) moveRoute(from *tcpee.TCPProxy, rr *runningRoute, proxy *tcpee.TCPProxy, r tcpee.Route, undo *[]func()) (*tcpee.RouteHandle, error) {
+	prev := rr.handle
+	ln, err := prev.Detach()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := proxy.StartRouteListener(ln, r)
+	if err != nil {
+		// Hand back to the old proxy
+		restoreRoute(from, rr, ln)
+		return nil, err
+	}
+
+	*undo = append(*undo, func() {
+		if ln, err := h.Detach(); err != nil {
+			log.Errorf("Failed restoring proxy route %s: %v", r.Src, err)
+		} else {
+			restoreRoute(from, rr, ln)
+		}
+	})
+
+	return h, nil
+}
+
+// restoreRoute restarts running route rr on its original proxy with ln.
+func restoreRoute(proxy *tcpee.TCPProxy, rr *runningRoute, ln net.Listener) {
+	prev := rr.handle
+	h, err := proxy.StartRouteListener(ln, prev.Route())
+	if err != nil {
+		log.Errorf("Failed restoring proxy route %s: %v", prev.Route().Src, err)
+		ln.Close()
+		return
+	}
+	rr.handle = h
+}
+
+// drain gracefully shuts down removed proxy in the background, for up to
+// timeout. The server mutex must be held.
+func (s *server) drain(proxy *tcpee.TCPProxy, timeout time.Duration) {
+	s.draining = append(s.draining, proxy)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_ = proxy.Shutdown(ctx)
+		cancel()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for i, p := range s.draining {
+			if p == proxy {
+				s.draining = append(s.draining[:i], s.draining[i+1:]...)
+				break
+			}
+		}
+		s.closeUnusedLogs()
+		s.admin.SetProxies(s.list())
+	}()
+}
+
+// list returns all running and draining proxies. The server mutex must be held.
+func (s *server) list() []*tcpee.TCPProxy {
+	proxies := make([]*tcpee.TCPProxy, 0, len(s.proxies)+len(s.draining))
+	for _, name := range sortedNames(s.proxies) {
+		proxies = append(proxies, s.proxies[name].proxy)
+	}
+	return append(proxies, s.draining...)
+}
+
+// shutdown will block until all proxies have drained, or the configured
+// drain timeout has passed, at which point remaining conns are forcibly closed.
+// Reloads are disabled from the start of shutdown.
+func (s *server) shutdown() {
+	s.mutex.Lock()
+	s.stopping = true
+	proxies := s.list()
+	timeout := s.cfg.drainTimeout
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(p *tcpee.TCPProxy) {
+			_ = p.Shutdown(ctx)
+			wg.Done()
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+// closeLogs closes all access log sinks.
+func (s *server) closeLogs() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, al := range s.logs {
+		al.Close()
+	}
+}
+
+// closeUnusedLogs closes the access log sinks no longer used by any running
+// or draining proxy, e.g. once removed on reload. The server mutex must be held.
+func (s *server) closeUnusedLogs() {
+	used := make(map[*tcpee.AccessLog]bool, len(s.logs))
+	for _, proxy := range s.list() {
+		used[proxy.AccessLog] = true
+	}
+	for path, al := range s.logs {
+		if !used[al] {
+			al.Close()
+			delete(s.logs, path)
+		}
+	}
+}
+
+// reopenLogs reopens all access log sinks, e.g. after rotation.
+func (s *server) reopenLogs() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, al := range s.logs {
+		if err := al.Reopen(); err != nil {
+			log.Errorf("Failed reopening access log %s: %v", al.Path, err)
+		}
+	}
+}
+
+// restartRoutes logs the failed routes received on routeErrs, restarting
+// each after a delay until successful, or no longer configured.
+func (s *server) restartRoutes() {
+	for err := range s.routeErrs {
+		log.Errorf("Proxy route failed: %v", err)
+		go func(h *tcpee.RouteHandle) {
+			for {
+				time.Sleep(routeRestartDelay)
+				err := s.restart(h)
+				if err == nil {
+					log.Printf("Restarted proxy route %s", h.Route().Src)
+					return
+				} else if err == tcpee.ErrProxyClosed || err == tcpee.ErrRouteStopped {
+					return
+				}
+				log.Errorf("Failed restarting proxy route %s: %v", h.Route().Src, err)
+			}
+		}(err.Handle)
+	}
+}
+
+// restart restarts failed route handle h, returning ErrRouteStopped if
+// no longer configured or already restarted (e.g. by reload).
+func (s *server) restart(h *tcpee.RouteHandle) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-h.Done():
+	default:
+		// Already running
+		return tcpee.ErrRouteStopped
+	}
+
+	for _, rp := range s.proxies {
+		for _, rr := range rp.routes {
+			if rr.handle == h {
+				return h.Restart()
+			}
+		}
+	}
+
+	return tcpee.ErrRouteStopped
+}
+
+// sortedNames returns the sorted keys of proxies.
+func sortedNames(proxies interface{}) []string {
+	var names []string
+	switch proxies := proxies.(type) {
+	case map[string]*proxyConfig:
+		for name := range proxies {
+			names = append(names, name)
+		}
+	case map[string]*runningProxy:
+		for name := range proxies {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
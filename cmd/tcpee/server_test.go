@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+// freeAddr returns a currently unused loopback TCP address.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// echoAddr serves a TCP echo backend until the test ends, returning its address.
+func echoAddr(t *testing.T) string {
+	t.Helper()
+	return serveTCP(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+}
+
+// writeConfig writes the configuration file conf to path.
+func writeConfig(t *testing.T, path string, conf string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServer starts a server from configuration conf, shut down on test end.
+func newTestServer(t *testing.T, conf string) *server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tcpee.conf")
+	writeConfig(t, path, conf)
+
+	logs := make(map[string]*tcpee.AccessLog)
+	cfg, err := loadConfig(path, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{
+		path:      path,
+		bans:      &tcpee.Banlist{},
+		routeErrs: make(chan *tcpee.RouteError),
+		admin:     &tcpee.Admin{},
+		services:  make(map[string]*service),
+	}
+	srv.admin.Reload = srv.reload
+	if err := srv.start(cfg, logs); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.shutdown()
+		srv.closeLogs()
+	})
+	return srv
+}
+
+// roundTrip dials addr, expecting msg echoed back.
+func roundTrip(t *testing.T, addr string, msg string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestReloadWhileStopping(t *testing.T) {
+	addr := freeAddr(t)
+	srv := newTestServer(t, `
+drain-timeout = "1s"
+
+[web]`+timeouts+`
+    proxy = ["`+addr+` -> `+echoAddr(t)+`"]
+`)
+	roundTrip(t, addr, "hello")
+
+	if err := srv.reload(); err != nil {
+		t.Fatalf("reload = %v", err)
+	}
+
+	// Reloads disabled once draining
+	srv.shutdown()
+	if err := srv.reload(); err != errStopping {
+		t.Fatalf("reload while stopping = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/reload", nil)
+	req.Header.Set(tcpee.AdminHeader, "1")
+	srv.admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), errStopping.Error()) {
+		t.Fatalf("POST /reload = %d %s", rec.Code, rec.Body)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("listener reopened after shutdown")
+	}
+
+	// Likewise once handed over to an upgraded process
+	srv = &server{upgraded: true}
+	if err := srv.reload(); err != errStopping {
+		t.Fatalf("reload once upgraded = %v", err)
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	backend := echoAddr(t)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	block := func(settings string, routes ...string) string {
+		return "drain-timeout = \"1s\"\n[web]" + timeouts + settings +
+			"    access-log = \"" + logPath + "\"\n" +
+			"    proxy = [\"" + strings.Join(routes, "\", \"") + "\"]\n"
+	}
+	route1, route2 := addr1+" -> "+backend, addr2+" -> "+backend
+
+	srv := newTestServer(t, block("", route1, route2))
+	reload := func(conf string) error {
+		t.Helper()
+		writeConfig(t, srv.path, conf)
+		return srv.reload()
+	}
+	running := func() *runningProxy {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		return srv.proxies["web"]
+	}
+
+	rp := running()
+	proxy, h1 := rp.proxy, rp.routes[addr1].handle
+	conn, err := net.Dial("tcp", addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Timeouts and drain-idle updated in place
+	if err := reload("drain-idle = \"1s\"\n" + strings.Replace(block("", route1, route2), `client-timeout = "10s"`, `client-timeout = "20s"`, 1)); err != nil {
+		t.Fatal(err)
+	}
+	rp = running()
+	if rp.proxy != proxy || rp.routes[addr1].handle != h1 {
+		t.Fatal("proxy replaced on settings change")
+	}
+	if rp.settings.ClientTimeout != 20*time.Second || rp.settings.DrainIdle != time.Second {
+		t.Fatalf("settings = %+v", rp.settings)
+	}
+	roundTrip(t, addr1, "hello")
+
+	// Removed route stopped, open conns left open
+	if err := reload(block("", route1)); err != nil {
+		t.Fatal(err)
+	}
+	if rp = running(); rp.proxy != proxy || len(rp.routes) != 1 {
+		t.Fatalf("routes = %+v", rp.routes)
+	}
+	if _, err := net.DialTimeout("tcp", addr2, time.Second); err == nil {
+		t.Fatal("removed route still listening")
+	}
+
+	// Changed access log settings rejected, keeping current config
+	if err := reload(block("    access-log-format = \"json\"\n", route1, route2)); err == nil || !strings.Contains(err.Error(), "settings differ") {
+		t.Fatalf("reload = %v", err)
+	}
+	if rp = running(); rp.proxy != proxy || len(rp.routes) != 1 {
+		t.Fatal("failed reload applied")
+	}
+
+	// Other changed settings move routes to a new proxy
+	if err := reload(block("    reject-banner = \"busy\"\n", route1)); err != nil {
+		t.Fatal(err)
+	}
+	if rp = running(); rp.proxy == proxy || rp.proxy.RejectBanner != "busy" {
+		t.Fatal("proxy not replaced")
+	}
+	roundTrip(t, addr1, "hello")
+
+	// Open conn of the old proxy left to drain
+	if _, err := conn.Write([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "old" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestReloadAccessLogs(t *testing.T) {
+	addr, backend := freeAddr(t), echoAddr(t)
+	dir := t.TempDir()
+	block := func(logPath string) string {
+		conf := "drain-timeout = \"1s\"\n[web]" + timeouts
+		if logPath != "" {
+			conf += "    access-log = \"" + filepath.Join(dir, logPath) + "\"\n"
+		}
+		return conf + "    proxy = [\"" + addr + " -> " + backend + "\"]\n"
+	}
+	srv := newTestServer(t, block("a.log"))
+	logs := func() []string {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		var names []string
+		for path := range srv.logs {
+			names = append(names, filepath.Base(path))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, addr, "hello")
+
+	// Replaced log kept open while its proxy drains
+	writeConfig(t, srv.path, block("b.log"))
+	if err := srv.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if names := logs(); strings.Join(names, ",") != "a.log,b.log" {
+		t.Fatalf("logs = %v", names)
+	}
+	conn.Close()
+	for deadline := time.Now().Add(time.Second); strings.Join(logs(), ",") != "b.log"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("logs = %v", logs())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Removed log closed
+	writeConfig(t, srv.path, block(""))
+	if err := srv.reload(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(logs()) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("logs = %v", logs())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// activatedListener is a listener passed by systemd socket activation.
+type activatedListener struct {
+	name string       // name is the socket's FileDescriptorName
+	ln   net.Listener // ln is the activated listener
+}
+
+// loadActivated loads the listeners passed by systemd socket activation,
+// if any, see sd_listen_fds(3). The mutex must be held.
+func (il *inheritedListeners) loadActivated() error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Don't pass on to child processes
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+
+		fd := 3 + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("activated socket %d (%s): %w", fd, name, err)
+		}
+
+		il.activated = append(il.activated, activatedListener{name: name, ln: ln})
+	}
+
+	log.Printf("Inherited %d listeners from systemd", n)
+	return nil
+}
+
+// takeActivated returns the activated listener with name or address
+// addr, if any, which is then owned by the caller. The mutex must be held.
+func (il *inheritedListeners) takeActivated(addr string) net.Listener {
+	for i, al := range il.activated {
+		if al.name == addr || sameAddr(al.ln.Addr(), addr) {
+			il.activated = append(il.activated[:i], il.activated[i+1:]...)
+			return al.ln
+		}
+	}
+	return nil
+}
+
+// sameAddr returns whether listener address lnAddr is that configured as
+// addr, either a TCP address or a unix socket path prefixed by "unix:".
+// Unspecified IPs of either family are treated as equal, as systemd
+// listens on both families via "[::]" unless BindIPv6Only is set.
+func sameAddr(lnAddr net.Addr, addr string) bool {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return lnAddr.Network() == "unix" && lnAddr.String() == path
+	}
+
+	tcp, ok := lnAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(tcp.Port) {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		return tcp.IP == nil || tcp.IP.IsUnspecified()
+	}
+	return ip != nil && ip.Equal(tcp.IP)
+}
+
+// sdNotify sends state to the systemd notification socket, if
+// any, see sd_notify(3). Errors are logged and otherwise ignored.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Errorf("Failed notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Errorf("Failed notifying systemd: %v", err)
+	}
+}
+
+// sdWatchdog pings the systemd watchdog at half its timeout, if enabled for
+// this process (see sd_watchdog_enabled(3)), until stop is closed. Each ping
+// is sent only once alive returns, so a hung process is restarted.
+func sdWatchdog(alive func(), stop <-chan struct{}) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Printf("Pinging systemd watchdog every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			alive()
+			sdNotify("WATCHDOG=1")
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setenv sets environment variable key to val until the test ends.
+func setenv(t *testing.T, key string, val string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, val); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestSdWatchdog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	setenv(t, "NOTIFY_SOCKET", path)
+	setenv(t, "WATCHDOG_USEC", "20000")
+	setenv(t, "WATCHDOG_PID", "")
+
+	// Hung process not pinged for
+	var mutex sync.Mutex
+	mutex.Lock()
+	alive := func() {
+		mutex.Lock()
+		mutex.Unlock()
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		sdWatchdog(alive, stop)
+		close(done)
+	}()
+
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("pinged while hung: %q", buf[:n])
+	}
+
+	mutex.Unlock()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog didn't stop")
+	}
+}
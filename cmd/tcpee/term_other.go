@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// makeRaw is unsupported on this platform.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("terminal control not supported on this platform")
+}
+
+// termSize returns a default terminal size on this platform.
+func termSize(fd int) (int, int) {
+	return 80, 24
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+// topUsage prints top usage string and exits with code.
+func topUsage(code int) {
+	fmt.Printf(`Usage: %s top [-a|--admin $addr] [-i|--interval $duration]
+
+Keys:
+  tab        switch selection between connections and backends
+  up/down    move selection (also j/k)
+  x          kill selected connection
+  d          drain / undrain selected backend
+  s          sort connections by bytes / age
+  q          quit
+`, os.Args[0])
+	os.Exit(code)
+}
+
+// topState is the state of a running top dashboard.
+type topState struct {
+	client   *ctlClient
+	addr     string
+	interval time.Duration
+
+	stats    []tcpee.ProxyStats
+	backends []tcpee.ProxyBackend
+	conns    []tcpee.Conn
+	errs     []tcpee.ConnError
+	fetchErr error
+
+	prev     map[string]tcpee.Counters // prev are the previous route / backend counters
+	rates    map[string][2]float64     // rates are the route byte rates in / out
+	errRates map[string]float64        // errRates are the backend error rates
+	prevTime time.Time                 // prevTime is the previous fetch time
+
+	byAge    bool   // byAge sorts conns by age, else by bytes
+	backSel  bool   // backSel indicates backend selection, else conn
+	sel      int    // sel is the selected row index
+	status   string // status is the status line message
+	statusAt time.Time
+}
+
+// runTop runs the top subcommand with args, exiting on completion.
+func runTop(args []string) {
+	addr := defaultAdminAddr
+	interval := time.Second
+
+	// Parse top flags
+	for len(args) > 0 {
+		switch args[0] {
+		case "-a", "--admin":
+			if len(args) < 2 {
+				topUsage(1)
+			}
+			addr = args[1]
+			args = args[2:]
+		case "-i", "--interval":
+			if len(args) < 2 {
+				topUsage(1)
+			}
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d < 100*time.Millisecond {
+				topUsage(1)
+			}
+			interval = d
+			args = args[2:]
+		case "-h", "--help":
+			topUsage(0)
+		default:
+			topUsage(1)
+		}
+	}
+
+	top := topState{
+		client:   newCtlClient(addr),
+		addr:     addr,
+		interval: interval,
+		prev:     make(map[string]tcpee.Counters),
+	}
+
+	// Check we can reach the admin API
+	if err := top.client.do(http.MethodGet, "/stats", &top.stats); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Setup the terminal
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		restore()
+	}()
+
+	// Read keys in the background
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	top.fetch()
+	for {
+		top.render(fd)
+
+		select {
+		case <-tick.C:
+			top.fetch()
+
+		case sig := <-signals:
+			if sig != syscall.SIGWINCH {
+				return
+			}
+
+		case key, ok := <-keys:
+			if !ok || !top.handle(key) {
+				return
+			}
+		}
+	}
+}
+
+// fetch fetches the latest state from the admin API, updating rates.
+func (top *topState) fetch() {
+	var stats []tcpee.ProxyStats
+	var backends []tcpee.ProxyBackend
+	var conns []tcpee.Conn
+	var errs []tcpee.ConnError
+
+	for _, req := range []struct {
+		path string
+		v    interface{}
+	}{
+		{"/stats", &stats},
+		{"/backends", &backends},
+		{"/conns", &conns},
+		{"/errors", &errs},
+	} {
+		if err := top.client.do(http.MethodGet, req.path, req.v); err != nil {
+			top.fetchErr = err
+			return
+		}
+	}
+
+	now := time.Now()
+	secs := now.Sub(top.prevTime).Seconds()
+	rates := make(map[string][2]float64)
+	errRates := make(map[string]float64)
+	prev := make(map[string]tcpee.Counters)
+
+	for _, s := range stats {
+		for _, r := range s.Routes {
+			key := "r\x00" + s.Name + "\x00" + r.Listener
+			if p, ok := top.prev[key]; ok && secs > 0 {
+				rates[key] = [2]float64{
+					delta(r.BytesIn, p.BytesIn) / secs,
+					delta(r.BytesOut, p.BytesOut) / secs,
+				}
+			}
+			prev[key] = r.Counters
+		}
+	}
+
+	for _, b := range backends {
+		key := "b\x00" + b.Proxy + "\x00" + b.Backend
+		if p, ok := top.prev[key]; ok && secs > 0 {
+			errRates[key] = delta(b.Errors, p.Errors) / secs
+		}
+		prev[key] = b.Counters
+	}
+
+	top.stats, top.backends, top.conns, top.errs = stats, backends, conns, errs
+	top.rates, top.errRates, top.prev = rates, errRates, prev
+	top.prevTime = now
+	top.fetchErr = nil
+	top.sortConns()
+	top.clampSel()
+}
+
+// handle handles a key press, returning false on quit.
+func (top *topState) handle(key string) bool {
+	switch key {
+	case "q", "Q", "\x03":
+		return false
+	case "\t":
+		top.backSel = !top.backSel
+		top.sel = 0
+	case "j", "\x1b[B":
+		top.sel++
+	case "k", "\x1b[A":
+		top.sel--
+	case "s":
+		top.byAge = !top.byAge
+		top.sortConns()
+	case "x":
+		if !top.backSel && top.sel < len(top.conns) {
+			id := top.conns[top.sel].ID
+			var rsp map[string]interface{}
+			err := top.client.do(http.MethodDelete, "/conns/"+url.PathEscape(id), &rsp)
+			top.setStatus("kill "+id, err)
+			top.fetch()
+		}
+	case "d":
+		if top.backSel && top.sel < len(top.backends) {
+			b := top.backends[top.sel]
+			method, action := http.MethodPost, "drain "
+			if b.Drained {
+				method, action = http.MethodDelete, "undrain "
+			}
+			var rsp map[string]interface{}
+			path := "/backends/" + url.PathEscape(b.Backend) + "/drain?proxy=" + url.QueryEscape(b.Proxy)
+			err := top.client.do(method, path, &rsp)
+			top.setStatus(action+b.Backend, err)
+			top.fetch()
+		}
+	}
+	top.clampSel()
+	return true
+}
+
+// setStatus sets the status line message for action.
+func (top *topState) setStatus(action string, err error) {
+	if err != nil {
+		top.status = action + ": " + err.Error()
+	} else {
+		top.status = action + ": ok"
+	}
+	top.statusAt = time.Now()
+}
+
+// delta returns the increase of a counter from prev to cur, or
+// zero if it was reset in between, e.g. on route restart.
+func delta(cur, prev uint64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return float64(cur - prev)
+}
+
+// sortConns sorts connections by total bytes, or by age.
+func (top *topState) sortConns() {
+	sort.SliceStable(top.conns, func(i, j int) bool {
+		if top.byAge {
+			return top.conns[i].Start.Before(top.conns[j].Start)
+		}
+		return top.conns[i].BytesIn+top.conns[i].BytesOut >
+			top.conns[j].BytesIn+top.conns[j].BytesOut
+	})
+}
+
+// clampSel clamps the selected row index to the selectable rows.
+func (top *topState) clampSel() {
+	n := len(top.conns)
+	if top.backSel {
+		n = len(top.backends)
+	}
+	if top.sel >= n {
+		top.sel = n - 1
+	}
+	if top.sel < 0 {
+		top.sel = 0
+	}
+}
+
+// render draws the dashboard to the terminal.
+func (top *topState) render(fd int) {
+	width, height := termSize(fd)
+	var lines []string
+	selLine := -1
+
+	// table formats rows as aligned columns.
+	table := func(header string, rows []string) []string {
+		var buf bytes.Buffer
+		tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, header)
+		for _, row := range rows {
+			fmt.Fprintln(tw, row)
+		}
+		tw.Flush()
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	sortBy := "bytes"
+	if top.byAge {
+		sortBy = "age"
+	}
+	lines = append(lines, fmt.Sprintf("tcpee top - %s - %s - sort: %s",
+		top.addr, time.Now().Format("15:04:05"), sortBy))
+	lines = append(lines, "[tab] select  [j/k] move  [x] kill conn  [d] drain backend  [s] sort  [q] quit")
+	if top.fetchErr != nil {
+		lines = append(lines, "\x1b[31merror: "+top.fetchErr.Error()+"\x1b[0m")
+	}
+
+	// Routes with throughput rates
+	var rows []string
+	for _, s := range top.stats {
+		for _, r := range s.Routes {
+			rate := top.rates["r\x00"+s.Name+"\x00"+r.Listener]
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%s/s\t%s/s\t%d\t%d",
+				s.Name, r.Listener, r.Backend, r.Open, r.Conns,
+				formatSize(uint64(rate[0])), formatSize(uint64(rate[1])),
+				r.Errors, r.Rejected,
+			))
+		}
+	}
+	lines = append(lines, "", "\x1b[1mROUTES\x1b[0m")
+	lines = append(lines, table("PROXY\tLISTENER\tBACKEND\tOPEN\tCONNS\tIN\tOUT\tERRORS\tREJECTED", rows)...)
+
+	// Backend health
+	rows = rows[:0]
+	for _, b := range top.backends {
+		state := "ok"
+		switch errRate := top.errRates["b\x00"+b.Proxy+"\x00"+b.Backend]; {
+		case b.Drained:
+			state = "draining"
+		case errRate > 0:
+			state = fmt.Sprintf("failing (%.1f err/s)", errRate)
+		}
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d",
+			b.Proxy, b.Backend, state, b.Open, b.Conns, b.Errors,
+		))
+	}
+	lines = append(lines, "", "\x1b[1mBACKENDS\x1b[0m")
+	backStart := len(lines) + 1
+	lines = append(lines, table("PROXY\tBACKEND\tSTATE\tOPEN\tCONNS\tERRORS", rows)...)
+	if top.backSel && len(top.backends) > 0 {
+		selLine = backStart + top.sel
+	}
+
+	// Recent errors, rendered last
+	var errLines []string
+	if len(top.errs) > 0 {
+		rows = rows[:0]
+		for i, e := range top.errs {
+			if i == 5 {
+				break
+			}
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s",
+				e.Time.Format("15:04:05"), e.Proxy, e.ID, e.Msg, e.Error,
+			))
+		}
+		errLines = append([]string{"", "\x1b[1mRECENT ERRORS\x1b[0m"},
+			table("TIME\tPROXY\tID\tMSG\tERROR", rows)...)
+	}
+
+	// Active connections, as many as fit
+	lines = append(lines, "", fmt.Sprintf("\x1b[1mCONNECTIONS (%d)\x1b[0m", len(top.conns)))
+	room := height - len(lines) - len(errLines) - 2
+	first := 0
+	if !top.backSel && top.sel >= room {
+		first = top.sel - room + 1
+	}
+	now := time.Now()
+	rows = rows[:0]
+	for i := first; i < len(top.conns) && i-first < room; i++ {
+		c := top.conns[i]
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s",
+			c.ID, c.Proxy, c.Src, c.Backend,
+			now.Sub(c.Start).Round(time.Second),
+			formatSize(c.BytesIn), formatSize(c.BytesOut),
+		))
+	}
+	connStart := len(lines) + 1
+	lines = append(lines, table("ID\tPROXY\tSRC\tBACKEND\tAGE\tIN\tOUT", rows)...)
+	if !top.backSel && len(top.conns) > 0 {
+		selLine = connStart + top.sel - first
+	}
+
+	lines = append(lines, errLines...)
+
+	// Status line, shown for a few seconds
+	if top.status != "" && time.Since(top.statusAt) < 5*time.Second {
+		lines = append(lines, "", top.status)
+	}
+
+	// Draw the lines, truncated to terminal size
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if !strings.Contains(line, "\x1b") && len(line) > width {
+			line = line[:width]
+		}
+		if i == selLine {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+	}
+	os.Stdout.Write(buf.Bytes())
+}
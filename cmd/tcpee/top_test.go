@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/gruf/tcpee"
+)
+
+func TestDelta(t *testing.T) {
+	for _, test := range []struct {
+		cur, prev uint64
+		delta     float64
+	}{
+		{0, 0, 0},
+		{10, 4, 6},
+		{4, 10, 0},
+		{1 << 40, 0, 1 << 40},
+	} {
+		if d := delta(test.cur, test.prev); d != test.delta {
+			t.Errorf("delta(%d, %d) = %v, expected %v", test.cur, test.prev, d, test.delta)
+		}
+	}
+}
+
+// fakeAdmin is a fake admin API serving fixed route counters.
+type fakeAdmin struct {
+	mutex   sync.Mutex
+	bytesIn uint64
+	errors  uint64
+}
+
+func (a *fakeAdmin) set(bytesIn, errors uint64) {
+	a.mutex.Lock()
+	a.bytesIn, a.errors = bytesIn, errors
+	a.mutex.Unlock()
+}
+
+func (a *fakeAdmin) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var v interface{}
+	switch r.URL.Path {
+	case "/stats":
+		v = []tcpee.ProxyStats{{
+			Name: "web",
+			Routes: []tcpee.RouteStats{{
+				Listener: ":80",
+				Counters: tcpee.Counters{BytesIn: a.bytesIn},
+			}},
+		}}
+	case "/backends":
+		v = []tcpee.ProxyBackend{{
+			Proxy:        "web",
+			BackendStats: tcpee.BackendStats{Backend: "b:80", Counters: tcpee.Counters{Errors: a.errors}},
+		}}
+	default:
+		v = []struct{}{}
+	}
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func TestTopFetch(t *testing.T) {
+	admin := &fakeAdmin{}
+	srv := httptest.NewServer(admin)
+	defer srv.Close()
+
+	top := topState{
+		client: newCtlClient(strings.TrimPrefix(srv.URL, "http://")),
+		prev:   make(map[string]tcpee.Counters),
+	}
+
+	admin.set(1000, 5)
+	top.fetch()
+	if top.fetchErr != nil {
+		t.Fatal(top.fetchErr)
+	}
+	if len(top.rates) != 0 || len(top.errRates) != 0 {
+		t.Fatalf("rates on first fetch: %v %v", top.rates, top.errRates)
+	}
+
+	// Rates from counter increase
+	top.prevTime = time.Now().Add(-time.Second)
+	admin.set(3000, 7)
+	top.fetch()
+	in := top.rates["r\x00web\x00:80"][0]
+	errs := top.errRates["b\x00web\x00b:80"]
+	if in < 1500 || in > 2000 || errs < 1.5 || errs > 2 {
+		t.Fatalf("rates = %v %v", top.rates, top.errRates)
+	}
+
+	// Counter reset doesn't produce bogus rates
+	top.prevTime = time.Now().Add(-time.Second)
+	admin.set(100, 0)
+	top.fetch()
+	if in, errs := top.rates["r\x00web\x00:80"][0], top.errRates["b\x00web\x00b:80"]; in != 0 || errs != 0 {
+		t.Fatalf("rates after reset = %v %v", top.rates, top.errRates)
+	}
+
+	// Fetch error kept, state retained
+	srv.Close()
+	top.fetch()
+	if top.fetchErr == nil || len(top.stats) != 1 {
+		t.Fatalf("fetch after close = %v, %+v", top.fetchErr, top.stats)
+	}
+}
+
+func TestTopHandle(t *testing.T) {
+	top := topState{
+		conns:    make([]tcpee.Conn, 3),
+		backends: make([]tcpee.ProxyBackend, 1),
+	}
+
+	for _, test := range []struct {
+		key     string
+		sel     int
+		backSel bool
+	}{
+		{"j", 1, false},
+		{"\x1b[B", 2, false},
+		{"j", 2, false},
+		{"k", 1, false},
+		{"\t", 0, true},
+		{"j", 0, true},
+		{"\t", 0, false},
+		{"k", 0, false},
+	} {
+		if !top.handle(test.key) {
+			t.Fatalf("%q quit", test.key)
+		}
+		if top.sel != test.sel || top.backSel != test.backSel {
+			t.Fatalf("%q: sel = %d, %v, expected %d, %v", test.key, top.sel, top.backSel, test.sel, test.backSel)
+		}
+	}
+
+	for _, key := range []string{"q", "Q", "\x03"} {
+		if top.handle(key) {
+			t.Errorf("%q didn't quit", key)
+		}
+	}
+}
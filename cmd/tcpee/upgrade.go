@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// upgradeEnv is the environment variable passing the addresses of the
+// listeners inherited from an upgrading parent process, as a JSON array
+// in file descriptor order from fd 3, followed by the readiness pipe.
+const upgradeEnv = "TCPEE_UPGRADE_FDS"
+
+// upgradeTimeout is the maximum time to wait on an upgraded process
+// to start, before killing it and resuming.
+const upgradeTimeout = time.Minute
+
+// serviceCloseTimeout is the maximum time to wait on in-flight admin /
+// metrics requests when closing their servers after an upgrade.
+const serviceCloseTimeout = 5 * time.Second
+
+// inherited are the listeners inherited from a parent process.
+var inherited inheritedListeners
+
+// inheritedListeners are listeners inherited from a parent process: either
+// an upgrading tcpee process, by their configured address, with the pipe
+// to signal readiness on, or systemd via socket activation.
+type inheritedListeners struct {
+	mutex     sync.Mutex
+	lns       map[string]net.Listener
+	ready     *os.File
+	activated []activatedListener
+}
+
+// load loads the listeners inherited from an upgrading parent, or
+// otherwise passed by systemd socket activation, if any.
+func (il *inheritedListeners) load() error {
+	env := os.Getenv(upgradeEnv)
+	if env == "" {
+		il.mutex.Lock()
+		defer il.mutex.Unlock()
+		return il.loadActivated()
+	}
+	_ = os.Unsetenv(upgradeEnv)
+
+	var addrs []string
+	if err := json.Unmarshal([]byte(env), &addrs); err != nil {
+		return fmt.Errorf("invalid %s: %w", upgradeEnv, err)
+	}
+
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+	il.lns = make(map[string]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited listener %s: %w", addr, err)
+		}
+		il.lns[addr] = ln
+	}
+	il.ready = os.NewFile(uintptr(3+len(addrs)), "ready")
+
+	log.Printf("Inherited %d listeners from parent process", len(addrs))
+	return nil
+}
+
+// take returns the inherited listener for addr, if any,
+// which is then owned by the caller.
+func (il *inheritedListeners) take(addr string) net.Listener {
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+	if ln, ok := il.lns[addr]; ok {
+		delete(il.lns, addr)
+		return ln
+	}
+	return il.takeActivated(addr)
+}
+
+// signalReady closes any unused inherited listeners, signalling
+// to the parent process that this process is ready to take over.
+func (il *inheritedListeners) signalReady() {
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+	for addr, ln := range il.lns {
+		log.Printf("Closing unused inherited listener %s", addr)
+		ln.Close()
+		delete(il.lns, addr)
+	}
+	for _, al := range il.activated {
+		log.Printf("Closing unused activated listener %s (%s)", al.ln.Addr(), al.name)
+		al.ln.Close()
+	}
+	il.activated = nil
+	if il.ready != nil {
+		_, _ = il.ready.Write([]byte{1})
+		il.ready.Close()
+		il.ready = nil
+	}
+}
+
+// listen listens on addr, either a TCP address or a unix socket path
+// prefixed by "unix:", using any listener inherited for addr.
+func listen(addr string) (net.Listener, error) {
+	if ln := inherited.take(addr); ln != nil {
+		return ln, nil
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove any stale socket, but nothing else
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	// Create socket as owner-only (0600) from the
+	// start, rather than chmod-ing it after creation
+	mask := syscall.Umask(0o177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	// Leave socket file in place on close,
+	// e.g. when handed over on upgrade
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	return ln, nil
+}
+
+// upgrade starts the current binary as a new process, passing it the
+// listening sockets, and waits until it is ready to take over. The
+// caller should then drain its proxies and exit.
+func (s *server) upgrade() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.upgraded {
+		return errors.New("already upgraded")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Collect listening sockets
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(addr string, ln net.Listener) error {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s can't be passed on", addr)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", addr, err)
+		}
+		addrs = append(addrs, addr)
+		files = append(files, f)
+		return nil
+	}
+	for addr, sv := range s.services {
+		if err := add(addr, sv.ln); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedNames(s.proxies) {
+		for addr, rr := range s.proxies[name].routes {
+			if ln := rr.handle.Listener(); ln != nil {
+				if err := add(addr, ln); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	env, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+
+	// Readiness pipe, closed by the new
+	// process on startup or on exit
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, kv := range os.Environ() {
+		// Drop any previous listeners, and the systemd
+		// watchdog PID so the new process takes it over
+		if !strings.HasPrefix(kv, upgradeEnv+"=") &&
+			!strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"="+string(env))
+
+	log.Printf("Starting upgraded process %s with %d listeners", exe, len(addrs))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// Wait on new process readiness
+	ready := make(chan bool, 1)
+	go func() {
+		var b [1]byte
+		n, _ := io.ReadFull(r, b[:])
+		ready <- (n == 1)
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			err = cmd.Wait()
+			return fmt.Errorf("upgraded process failed to start: %v", err)
+		}
+	case <-time.After(upgradeTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("upgraded process not ready after %v", upgradeTimeout)
+	}
+
+	log.Printf("Upgraded process %d ready", cmd.Process.Pid)
+	sdNotify(fmt.Sprintf("MAINPID=%d\nSTATUS=Upgraded, draining connections", cmd.Process.Pid))
+	s.upgraded = true
+	return nil
+}
+
+// closeServices closes the admin / metrics servers, e.g. once their listeners
+// are served by an upgraded process, waiting on in-flight requests for up to
+// serviceCloseTimeout. Services are fixed on startup, so this needn't hold the
+// server mutex, which in-flight admin requests may be waiting on.
+func (s *server) closeServices() {
+	ctx, cancel := context.WithTimeout(context.Background(), serviceCloseTimeout)
+	defer cancel()
+	for addr, sv := range s.services {
+		log.Printf("Closing %s on %s", sv.name, addr)
+		if err := sv.srv.Shutdown(ctx); err != nil {
+			sv.srv.Close()
+		}
+	}
+}
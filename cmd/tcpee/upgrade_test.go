@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCloseServices(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	// Handler blocking until released
+	started, release := make(chan struct{}), make(chan struct{})
+	sv := &service{name: "admin API", ln: ln}
+	sv.srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(rw, "ok")
+	})
+	served := make(chan struct{})
+	go func() {
+		sv.serve()
+		close(served)
+	}()
+
+	resp := make(chan string, 1)
+	go func() {
+		r, err := http.Get("http://" + addr)
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		defer r.Body.Close()
+		b, _ := io.ReadAll(r.Body)
+		resp <- string(b)
+	}()
+	<-started
+
+	srv := &server{services: map[string]*service{addr: sv}}
+	closed := make(chan struct{})
+	go func() {
+		srv.closeServices()
+		close(closed)
+	}()
+
+	// Listener closed, in-flight request left to finish
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return on close")
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("listener not closed")
+	}
+	close(release)
+	if body := <-resp; body != "ok" {
+		t.Fatalf("in-flight response = %q", body)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close didn't return")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	// Owner-only socket, stale socket replaced
+	for i := 0; i < 2; i++ {
+		ln, err := listen("unix:" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+		stat, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode()&os.ModeSocket == 0 || stat.Mode().Perm() != 0o600 {
+			t.Fatalf("socket mode = %v", stat.Mode())
+		}
+	}
+
+	// Non-socket left in place
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:" + path); err == nil {
+		t.Fatal("listened over regular file")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "data" {
+		t.Fatalf("regular file = %q, %v", b, err)
+	}
+}
@@ -0,0 +1,202 @@
+package tcpee
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// LimitAction determines how a connection breaching a limit is rejected.
+type LimitAction int
+
+const (
+	// ActionClose immediately closes the rejected connection.
+	ActionClose LimitAction = iota
+
+	// ActionReset closes the rejected connection with a TCP RST.
+	ActionReset
+
+	// ActionTarpit holds the rejected connection open, without
+	// reading from it, until TCPProxy.TarpitTime has elapsed.
+	ActionTarpit
+)
+
+// String returns the config string representation of action.
+func (action LimitAction) String() string {
+	switch action {
+	case ActionClose:
+		return "close"
+	case ActionReset:
+		return "reset"
+	case ActionTarpit:
+		return "tarpit"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLimitAction parses a LimitAction from its string representation.
+func ParseLimitAction(str string) (LimitAction, bool) {
+	switch str {
+	case "", "close":
+		return ActionClose, true
+	case "reset":
+		return ActionReset, true
+	case "tarpit":
+		return ActionTarpit, true
+	default:
+		return 0, false
+	}
+}
+
+// defaultTarpitTime is the tarpit time used when none is set.
+const defaultTarpitTime = 30 * time.Second
+
+// defaultMaxTarpits is the max no. tarpitted conns used when none is set.
+const defaultMaxTarpits = 1024
+
+// srcConns tracks the connection limit state for one source prefix.
+type srcConns struct {
+	open int     // open is the no. currently open conns
+	rate *bucket // rate is the new connection rate bucket
+}
+
+// sourceKey returns the source prefix key used for connection limits.
+func (proxy *TCPProxy) sourceKey(ip net.IP) string {
+	bits, ones := 32, proxy.SourcePrefixV4
+	if !isIPv4(ip) {
+		bits, ones = 128, proxy.SourcePrefixV6
+	} else {
+		ip = ip.To4()
+	}
+	if ones < 1 || ones > bits {
+		ones = bits
+	}
+	return ip.Mask(net.CIDRMask(ones, bits)).String()
+}
+
+// limitsEnabled returns whether any per-source connection limits are set.
+func (proxy *TCPProxy) limitsEnabled() bool {
+	return proxy.SourceMaxConns > 0 || proxy.SourceConnRate.enabled()
+}
+
+// acquireConn checks the supplied conn against per-source connection limits,
+// returning the tracked source key and whether the conn was admitted.
+func (proxy *TCPProxy) acquireConn(conn net.Conn) (string, bool) {
+	ip := sourceIP(conn.RemoteAddr())
+	if ip == nil || !proxy.limitsEnabled() {
+		return "", true
+	}
+
+	key := proxy.sourceKey(ip)
+
+	proxy.srcMutex.Lock()
+	defer proxy.srcMutex.Unlock()
+
+	if proxy.srcConns == nil {
+		proxy.srcConns = make(map[string]*srcConns)
+	}
+
+	state, ok := proxy.srcConns[key]
+	if !ok {
+		state = &srcConns{rate: newBucket(proxy.SourceConnRate)}
+		proxy.srcConns[key] = state
+	}
+
+	var msg string
+	switch {
+	case proxy.SourceMaxConns > 0 && state.open >= proxy.SourceMaxConns:
+		msg = "source conn limit reached"
+	case state.rate != nil && !state.rate.take(1):
+		msg = "source conn rate exceeded"
+	default:
+		state.open++
+		return key, true
+	}
+
+	log.InfoKVs(kv.Fields{
+		{K: "proxy", V: proxy.Name},
+		{K: "src", V: ip.String()},
+		{K: "action", V: proxy.LimitAction.String()},
+		{K: "msg", V: msg},
+	}...)
+
+	return "", false
+}
+
+// releaseConn releases a conn previously admitted under source key.
+func (proxy *TCPProxy) releaseConn(key string) {
+	if len(key) < 1 {
+		return
+	}
+	proxy.srcMutex.Lock()
+	if state, ok := proxy.srcConns[key]; ok {
+		state.open--
+	}
+	proxy.srcMutex.Unlock()
+}
+
+// sweepConns drops source connection states no longer holding any limits.
+func (proxy *TCPProxy) sweepConns() {
+	proxy.srcMutex.Lock()
+	for key, state := range proxy.srcConns {
+		if state.open < 1 && (state.rate == nil || state.rate.full()) {
+			delete(proxy.srcConns, key)
+		}
+	}
+	proxy.srcMutex.Unlock()
+}
+
+// reject rejects the supplied conn according to the configured LimitAction.
+func (proxy *TCPProxy) reject(conn net.Conn) {
+	switch proxy.LimitAction {
+	case ActionReset:
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+		}
+		conn.Close()
+
+	case ActionTarpit:
+		d := proxy.TarpitTime
+		if d < 1 {
+			d = defaultTarpitTime
+		}
+
+		max := proxy.MaxTarpits
+		if max < 1 {
+			max = defaultMaxTarpits
+		}
+
+		// Close outright once too many held
+		if atomic.AddInt64(&proxy.tarpits, 1) > int64(max) {
+			atomic.AddInt64(&proxy.tarpits, -1)
+			conn.Close()
+			return
+		}
+
+		// Hold open in the background, tracked
+		// so that Close() waits for release
+		if !proxy.addServe() {
+			atomic.AddInt64(&proxy.tarpits, -1)
+			conn.Close()
+			return
+		}
+		go func() {
+			defer proxy.serveWg.Done()
+			defer atomic.AddInt64(&proxy.tarpits, -1)
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-proxy.baseCtx.Done():
+			case <-t.C:
+			}
+			conn.Close()
+		}()
+
+	default:
+		conn.Close()
+	}
+}
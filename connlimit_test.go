@@ -0,0 +1,132 @@
+package tcpee
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseLimitAction(t *testing.T) {
+	for _, test := range []struct {
+		str    string
+		action LimitAction
+		ok     bool
+	}{
+		{str: "", action: ActionClose, ok: true},
+		{str: "close", action: ActionClose, ok: true},
+		{str: "reset", action: ActionReset, ok: true},
+		{str: "tarpit", action: ActionTarpit, ok: true},
+		{str: "drop", ok: false},
+	} {
+		action, ok := ParseLimitAction(test.str)
+		if ok != test.ok || (ok && action != test.action) {
+			t.Errorf("ParseLimitAction(%q) = %v, %v", test.str, action, ok)
+		}
+		if ok && test.str != "" && action.String() != test.str {
+			t.Errorf("%v.String() = %q, expected %q", action, action.String(), test.str)
+		}
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	for _, test := range []struct {
+		v4, v6 int
+		ip     string
+		key    string
+	}{
+		{ip: "192.0.2.1", key: "192.0.2.1"},
+		{ip: "::ffff:192.0.2.1", key: "192.0.2.1"},
+		{v4: 24, ip: "192.0.2.77", key: "192.0.2.0"},
+		{v4: 33, ip: "192.0.2.77", key: "192.0.2.77"},
+		{ip: "2001:db8::1", key: "2001:db8::1"},
+		{v6: 64, ip: "2001:db8::1:2:3:4", key: "2001:db8::"},
+	} {
+		proxy := &TCPProxy{SourcePrefixV4: test.v4, SourcePrefixV6: test.v6}
+		if key := proxy.sourceKey(parseIP(t, test.ip)); key != test.key {
+			t.Errorf("sourceKey(%s) /%d /%d = %q, expected %q", test.ip, test.v4, test.v6, key, test.key)
+		}
+	}
+}
+
+func TestAcquireConnMax(t *testing.T) {
+	proxy := &TCPProxy{SourceMaxConns: 2, SourcePrefixV4: 24}
+
+	a, _ := pipeFrom(t, "192.0.2.1:1000")
+	b, _ := pipeFrom(t, "192.0.2.2:1000")
+	c, _ := pipeFrom(t, "192.0.2.3:1000")
+	other, _ := pipeFrom(t, "198.51.100.1:1000")
+
+	keyA, ok := proxy.acquireConn(a)
+	if !ok {
+		t.Fatal("first conn rejected")
+	}
+	if _, ok := proxy.acquireConn(b); !ok {
+		t.Fatal("second conn rejected")
+	}
+	if _, ok := proxy.acquireConn(c); ok {
+		t.Fatal("conn beyond source prefix limit admitted")
+	}
+	if _, ok := proxy.acquireConn(other); !ok {
+		t.Fatal("conn from other prefix rejected")
+	}
+
+	proxy.releaseConn(keyA)
+	if _, ok := proxy.acquireConn(c); !ok {
+		t.Fatal("conn rejected after release")
+	}
+}
+
+func TestAcquireConnRate(t *testing.T) {
+	proxy := &TCPProxy{SourceConnRate: RateLimit{Rate: 1, Burst: 2}}
+	conn, _ := pipeFrom(t, "192.0.2.1:1000")
+
+	for i := 0; i < 2; i++ {
+		key, ok := proxy.acquireConn(conn)
+		if !ok {
+			t.Fatalf("conn %d within burst rejected", i)
+		}
+		proxy.releaseConn(key)
+	}
+	if _, ok := proxy.acquireConn(conn); ok {
+		t.Fatal("conn beyond rate admitted")
+	}
+
+	// Drained bucket is kept until refilled
+	proxy.sweepConns()
+	if len(proxy.srcConns) != 1 {
+		t.Fatal("source state swept while rate limited")
+	}
+}
+
+func TestAcquireConnDisabled(t *testing.T) {
+	proxy := &TCPProxy{}
+	conn, _ := pipeFrom(t, "192.0.2.1:1000")
+	if key, ok := proxy.acquireConn(conn); !ok || key != "" {
+		t.Fatalf("acquireConn without limits = %q, %v", key, ok)
+	}
+}
+
+func TestRejectTarpitMax(t *testing.T) {
+	proxy := &TCPProxy{LimitAction: ActionTarpit, TarpitTime: time.Minute, MaxTarpits: 1}
+	proxy.init()
+	t.Cleanup(proxy.Close)
+
+	held, heldPeer := pipeFrom(t, "192.0.2.1:1000")
+	proxy.reject(held)
+
+	// Held conn stays open
+	_ = heldPeer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := heldPeer.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("tarpitted conn read = %v", err)
+	}
+
+	// Conns beyond the max closed outright
+	over, overPeer := pipeFrom(t, "192.0.2.1:1001")
+	proxy.reject(over)
+	_ = overPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := overPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("conn beyond tarpit max read = %v", err)
+	}
+}
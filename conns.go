@@ -0,0 +1,200 @@
+package tcpee
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is a snapshot of a single active proxied connection.
+type Conn struct {
+	// ID is the unique connection ID.
+	ID string `json:"id"`
+
+	// Proxy is the name of the proxy serving this connection.
+	Proxy string `json:"proxy"`
+
+	// Src is the client address.
+	Src string `json:"src"`
+
+	// Listener is the route address the client connected to.
+	Listener string `json:"listener"`
+
+	// Backend is the backend address, resolved if connected.
+	Backend string `json:"backend"`
+
+	// Start is the connection start time.
+	Start time.Time `json:"start"`
+
+	// BytesIn and BytesOut are the no. bytes proxied so far
+	// client -> server, and server -> client.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// liveConn is the registry entry of a single active proxied connection.
+type liveConn struct {
+	id       string    // id is the unique connection ID
+	src      string    // src is the client address
+	listener string    // listener is the route address
+	start    time.Time // start is the connection start time
+	nIn      uint64    // nIn tracks the no. bytes client -> server
+	nOut     uint64    // nOut tracks the no. bytes server -> client
+	killed   int32     // killed indicates the conn was killed
+	last     int64     // last is the unix nano time of last data transfer
+	halfed   int32     // halfed indicates the conn was half-closed
+
+	mutex   sync.Mutex // mutex protects backend + conns
+	backend string     // backend is the backend address
+	sConn   net.Conn   // sConn is the client conn
+	dConn   net.Conn   // dConn is the backend conn, once dialed
+}
+
+// attach sets the dialed backend conn, returning false (and closing
+// the backend conn) if the connection was killed in the meantime.
+func (lc *liveConn) attach(dConn net.Conn) bool {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if atomic.LoadInt32(&lc.killed) == 1 {
+		dConn.Close()
+		return false
+	}
+	lc.backend = dConn.RemoteAddr().String()
+	lc.dConn = dConn
+	return true
+}
+
+// kill marks the connection as killed and closes its conns, returning
+// false if it was already killed.
+func (lc *liveConn) kill() bool {
+	if !atomic.CompareAndSwapInt32(&lc.killed, 0, 1) {
+		return false
+	}
+	lc.mutex.Lock()
+	lc.sConn.Close()
+	if lc.dConn != nil {
+		lc.dConn.Close()
+	}
+	lc.mutex.Unlock()
+	return true
+}
+
+// halfClose half-closes the backend conn, signalling EOF to the backend as
+// though the client finished sending, returning false if not yet connected
+// or already half-closed. The client side is left open, so that any response
+// in flight is still proxied to the client before the backend closes, which
+// in turn closes the client conn. Backend conns unable to half-close are closed.
+func (lc *liveConn) halfClose() bool {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.dConn == nil || !atomic.CompareAndSwapInt32(&lc.halfed, 0, 1) {
+		return false
+	}
+	if cw, ok := lc.dConn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		lc.dConn.Close()
+	}
+	return true
+}
+
+// idle returns the time since the connection last transferred data.
+func (lc *liveConn) idle(now time.Time) time.Duration {
+	last := lc.start
+	if ns := atomic.LoadInt64(&lc.last); ns > 0 {
+		last = time.Unix(0, ns)
+	}
+	return now.Sub(last)
+}
+
+// isKilled returns whether the connection was killed.
+func (lc *liveConn) isKilled() bool {
+	return atomic.LoadInt32(&lc.killed) == 1
+}
+
+// snapshot returns a snapshot of the connection's current state.
+func (lc *liveConn) snapshot(name string) Conn {
+	lc.mutex.Lock()
+	backend := lc.backend
+	lc.mutex.Unlock()
+	return Conn{
+		ID:       lc.id,
+		Proxy:    name,
+		Src:      lc.src,
+		Listener: lc.listener,
+		Backend:  backend,
+		Start:    lc.start,
+		BytesIn:  atomic.LoadUint64(&lc.nIn),
+		BytesOut: atomic.LoadUint64(&lc.nOut),
+	}
+}
+
+// track adds the supplied connection to the active connection registry.
+func (proxy *TCPProxy) track(lc *liveConn) {
+	proxy.connMutex.Lock()
+	if proxy.live == nil {
+		proxy.live = make(map[string]*liveConn)
+	}
+	proxy.live[lc.id] = lc
+	proxy.connMutex.Unlock()
+}
+
+// untrack drops the supplied connection from the active connection registry.
+func (proxy *TCPProxy) untrack(lc *liveConn) {
+	proxy.connMutex.Lock()
+	delete(proxy.live, lc.id)
+	proxy.connMutex.Unlock()
+}
+
+// Conns returns a snapshot of the proxy's active connections, ordered by start time.
+func (proxy *TCPProxy) Conns() []Conn {
+	proxy.connMutex.Lock()
+	live := make([]*liveConn, 0, len(proxy.live))
+	for _, lc := range proxy.live {
+		live = append(live, lc)
+	}
+	proxy.connMutex.Unlock()
+
+	conns := make([]Conn, 0, len(live))
+	for _, lc := range live {
+		conns = append(conns, lc.snapshot(proxy.Name))
+	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Start.Before(conns[j].Start)
+	})
+
+	return conns
+}
+
+// halfCloseIdle half-closes active connections idle for at least d,
+// returning the no. connections half-closed.
+func (proxy *TCPProxy) halfCloseIdle(d time.Duration) int {
+	now := time.Now()
+	proxy.connMutex.Lock()
+	idle := make([]*liveConn, 0, len(proxy.live))
+	for _, lc := range proxy.live {
+		if lc.idle(now) >= d {
+			idle = append(idle, lc)
+		}
+	}
+	proxy.connMutex.Unlock()
+
+	var n int
+	for _, lc := range idle {
+		if lc.halfClose() {
+			n++
+		}
+	}
+	return n
+}
+
+// Kill forcibly closes the active connection with ID, returning whether it was found.
+func (proxy *TCPProxy) Kill(id string) bool {
+	proxy.connMutex.Lock()
+	lc, ok := proxy.live[id]
+	proxy.connMutex.Unlock()
+	return ok && lc.kill()
+}
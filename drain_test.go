@@ -0,0 +1,139 @@
+package tcpee
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// shutdown shuts down proxy in the background with timeout,
+// returning a channel receiving the result.
+func shutdown(proxy *TCPProxy, timeout time.Duration) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- proxy.Shutdown(ctx)
+	}()
+	return done
+}
+
+// waitShutdown waits on a shutdown result, failing the test after a second.
+func waitShutdown(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("shutdown didn't return")
+		return nil
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+
+	done := shutdown(proxy, 10*time.Second)
+
+	// Listener closed, open conns left to finish
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := mn.DialContext(context.Background(), "tcp", "front")
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	roundTrip(t, conn, "still here")
+
+	conn.Close()
+	if err := waitShutdown(t, done); err != nil {
+		t.Fatalf("shutdown = %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	hooks := newRecordHooks()
+	proxy, mn := newMemProxy(t, &TCPProxy{Hooks: hooks})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+
+	// Remaining conns forcibly closed
+	if err := waitShutdown(t, shutdown(proxy, 50*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown = %v", err)
+	}
+	if _, err := readAll(conn); err != nil {
+		t.Fatalf("conn not closed: %v", err)
+	}
+	if rec := hooks.next(t); rec.Reason != ReasonShutdown {
+		t.Fatalf("record = %+v", rec)
+	}
+}
+
+// byeBackend serves a TCP backend until the test ends, responding
+// with the data read and " bye" once the client is done sending.
+func byeBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				_, _ = conn.Write(append(b, " bye"...))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestShutdownDrainIdle(t *testing.T) {
+	for _, update := range []bool{false, true} {
+		proxy := &TCPProxy{}
+		defer proxy.Close()
+		if update {
+			// Enabled once running
+			proxy.Update(Settings{DrainIdle: 10 * time.Millisecond})
+		} else {
+			proxy.DrainIdle = 10 * time.Millisecond
+		}
+		h := startRoute(t, proxy, Route{Src: "127.0.0.1:0", Dst: byeBackend(t)})
+
+		conn := tcpDial(t, h.Listener().Addr().String())
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		waitOpen(t, proxy, 1)
+
+		// Idle conn half-closed to the backend, its response still proxied
+		done := shutdown(proxy, 10*time.Second)
+		if data, err := readAll(conn); err != nil || data != "hello bye" {
+			t.Fatalf("update=%t: read %q, %v", update, data, err)
+		}
+		if err := waitShutdown(t, done); err != nil {
+			t.Fatalf("update=%t: shutdown = %v", update, err)
+		}
+	}
+}
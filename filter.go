@@ -0,0 +1,119 @@
+package tcpee
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrBlocked may be returned by filters to block a conn, closing it
+// with ReasonBlocked rather than as a proxying error.
+var ErrBlocked = errors.New("tcpee: blocked by filter")
+
+// Direction is the direction of proxied data.
+type Direction int
+
+const (
+	// ClientToServer is data from the client to the backend.
+	ClientToServer Direction = iota
+
+	// ServerToClient is data from the backend to the client.
+	ServerToClient
+)
+
+// String returns a string representation of the direction.
+func (dir Direction) String() string {
+	if dir == ServerToClient {
+		return "out"
+	}
+	return "in"
+}
+
+// Filter is a stream filter, able to inspect, rewrite, inject or block the
+// data of proxied conns. Filters are composed into a chain per route, see
+// TCPProxy.Filters and Route.Filters, the first filter in the chain seeing
+// the data as read from source. Capture sinks and shadow backends are also
+// passed the data as read, before filtering.
+type Filter interface {
+	// Wrap returns a writer wrapping w, through which the data of conn
+	// in direction dir is written once connected to the backend, and
+	// which in turn writes the filtered data to w. Writes must not
+	// retain the passed buffer. A write error closes the conn, see
+	// ErrBlocked. If the returned writer implements io.Closer it is
+	// closed at the end of the stream (e.g. to flush buffered data),
+	// and must not close w.
+	Wrap(conn Conn, dir Direction, w io.Writer) io.Writer
+}
+
+// FilterFunc is a stateless Filter, called with each chunk of data
+// read for conn in direction dir and returning the data to write in its
+// place: either data itself (optionally modified in place), a new buffer
+// (e.g. injecting data), or nil to drop it. Returning an error closes
+// the conn, see ErrBlocked.
+type FilterFunc func(conn Conn, dir Direction, data []byte) ([]byte, error)
+
+// Wrap implements Filter.
+func (fn FilterFunc) Wrap(conn Conn, dir Direction, w io.Writer) io.Writer {
+	return &funcWriter{fn: fn, conn: conn, dir: dir, w: w}
+}
+
+// funcWriter is the io.Writer wrapping a FilterFunc.
+type funcWriter struct {
+	fn   FilterFunc
+	conn Conn
+	dir  Direction
+	w    io.Writer
+}
+
+func (fw *funcWriter) Write(b []byte) (int, error) {
+	out, err := fw.fn(fw.conn, fw.dir, b)
+	if err != nil {
+		return 0, err
+	}
+	if len(out) > 0 {
+		if _, err := fw.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// filterChain is a conn direction's chain of filter writers, ending
+// in the destination conn.
+type filterChain struct {
+	w       io.Writer   // w is the outermost filter writer
+	closers []io.Closer // closers are the closable writers, outermost first
+}
+
+// newFilterChain returns a new filterChain of filters for conn in direction
+// dir writing to dst, or nil if there are no filters.
+func newFilterChain(filters []Filter, conn Conn, dir Direction, dst io.Writer) *filterChain {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	fc := filterChain{w: dst}
+	for i := len(filters) - 1; i >= 0; i-- {
+		fc.w = filters[i].Wrap(conn, dir, fc.w)
+		if c, ok := fc.w.(io.Closer); ok {
+			fc.closers = append([]io.Closer{c}, fc.closers...)
+		}
+	}
+
+	return &fc
+}
+
+func (fc *filterChain) Write(b []byte) (int, error) {
+	return fc.w.Write(b)
+}
+
+// Close closes the chain's closable writers, outermost first
+// so that flushed data passes through the rest of the chain.
+func (fc *filterChain) Close() error {
+	var err error
+	for _, c := range fc.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package tcpee
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// appendFilter is a FilterFunc appending s to each chunk.
+func appendFilter(s string) FilterFunc {
+	return func(conn Conn, dir Direction, data []byte) ([]byte, error) {
+		return append(append([]byte(nil), data...), s...), nil
+	}
+}
+
+// upperFilter is a FilterFunc upper-casing client -> server data in place.
+func upperFilter(conn Conn, dir Direction, data []byte) ([]byte, error) {
+	if dir == ClientToServer {
+		copy(data, bytes.ToUpper(data))
+	}
+	return data, nil
+}
+
+// bufferFilter is a Filter buffering all data until closed.
+type bufferFilter struct {
+	closed *[]string
+	name   string
+}
+
+func (f bufferFilter) Wrap(conn Conn, dir Direction, w io.Writer) io.Writer {
+	return &bufferWriter{f: f, w: w}
+}
+
+type bufferWriter struct {
+	f   bufferFilter
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	return bw.buf.Write(b)
+}
+
+func (bw *bufferWriter) Close() error {
+	*bw.f.closed = append(*bw.f.closed, bw.f.name)
+	_, err := bw.w.Write(bw.buf.Bytes())
+	return err
+}
+
+func TestFilterChain(t *testing.T) {
+	if newFilterChain(nil, Conn{}, ClientToServer, io.Discard) != nil {
+		t.Fatal("empty chain not nil")
+	}
+
+	var closed []string
+	drop := FilterFunc(func(conn Conn, dir Direction, data []byte) ([]byte, error) {
+		if string(data) == "drop" {
+			return nil, nil
+		}
+		return data, nil
+	})
+
+	for _, test := range []struct {
+		name    string
+		filters []Filter
+		writes  []string
+		out     string
+		closed  string
+	}{
+		{"ordered", []Filter{appendFilter("a"), appendFilter("b")}, []string{"x", "y"}, "xabyab", ""},
+		{"dropped", []Filter{drop, appendFilter("!")}, []string{"drop", "keep"}, "keep!", ""},
+		{"flushed", []Filter{
+			bufferFilter{closed: &closed, name: "outer"},
+			appendFilter("."),
+			bufferFilter{closed: &closed, name: "inner"},
+		}, []string{"x", "y"}, "xy.", "outer inner"},
+	} {
+		closed = nil
+		var out bytes.Buffer
+		fc := newFilterChain(test.filters, Conn{}, ClientToServer, &out)
+		for _, w := range test.writes {
+			if n, err := fc.Write([]byte(w)); err != nil || n != len(w) {
+				t.Fatalf("%s: write = %d, %v", test.name, n, err)
+			}
+		}
+		if err := fc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.out || strings.Join(closed, " ") != test.closed {
+			t.Errorf("%s: wrote %q, closed %q", test.name, out.String(), closed)
+		}
+	}
+}
+
+func TestFilterProxy(t *testing.T) {
+	capture := &Capture{Dir: t.TempDir()}
+	if err := capture.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		Filters: []Filter{FilterFunc(upperFilter)},
+		Capture: capture,
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend", Filters: []Filter{appendFilter("!")}})
+
+	conn := mn.dial(t, "front")
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "HELLO!!" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	conn.Close()
+	waitOpen(t, proxy, 0)
+	proxy.Close()
+
+	// Capture tap sees data before filtering
+	entries, _ := os.ReadDir(capture.Dir)
+	for _, entry := range entries {
+		b, _ := os.ReadFile(filepath.Join(capture.Dir, entry.Name()))
+		if ext := filepath.Ext(entry.Name()); ext == ".in" && string(b) != "hello" ||
+			ext == ".out" && string(b) != "HELLO!" {
+			t.Errorf("%s = %q", entry.Name(), b)
+		}
+	}
+}
+
+func TestFilterBlocked(t *testing.T) {
+	block := FilterFunc(func(conn Conn, dir Direction, data []byte) ([]byte, error) {
+		if bytes.Contains(data, []byte("evil")) {
+			return nil, ErrBlocked
+		}
+		return data, nil
+	})
+	hooks := newRecordHooks()
+	proxy, mn := newMemProxy(t, &TCPProxy{Hooks: hooks})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend", Filters: []Filter{block}})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	if _, err := conn.Write([]byte("evil")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAll(conn); err != nil || data != "" {
+		t.Fatalf("blocked conn read %q, %v", data, err)
+	}
+
+	if rec := hooks.next(t); rec.Reason != ReasonBlocked || rec.BytesIn != 5 {
+		t.Fatalf("record = %+v", rec)
+	}
+}
@@ -0,0 +1,40 @@
+package tcpee
+
+// Hooks is an observer of proxied connection lifecycle events, for library
+// users to plug in their own auth, auditing and metrics. Embed NopHooks to
+// implement only a subset of the events.
+type Hooks interface {
+	// OnAccept is called for each accepted conn that passed the
+	// built-in bans, ACLs and limits, returning whether to serve it.
+	// Denied conns are closed, and receive no further events. It is
+	// called from the conn's serve goroutine, so may block on e.g. an
+	// external auth service without holding up other conns.
+	OnAccept(conn Conn) bool
+
+	// OnDial is called before dialing out to the conn's backend.
+	OnDial(conn Conn, backend string)
+
+	// OnConnected is called once connected to the backend, with
+	// conn.Backend set to the resolved backend address.
+	OnConnected(conn Conn)
+
+	// OnBytes is called as data is proxied, with the no. bytes
+	// copied client -> server (in) or server -> client (out) since
+	// the last call. It is called from the copying goroutines at
+	// least once a second while active, so must not block.
+	OnBytes(conn Conn, in int64, out int64)
+
+	// OnClose is called once a served conn has closed, with its final
+	// access record and the error that closed it (nil on clean close).
+	OnClose(rec AccessRecord, err error)
+}
+
+// NopHooks is a Hooks implementation that serves all conns and ignores
+// all events, to be embedded in partial Hooks implementations.
+type NopHooks struct{}
+
+func (NopHooks) OnAccept(Conn) bool          { return true }
+func (NopHooks) OnDial(Conn, string)         {}
+func (NopHooks) OnConnected(Conn)            {}
+func (NopHooks) OnBytes(Conn, int64, int64)  {}
+func (NopHooks) OnClose(AccessRecord, error) {}
@@ -0,0 +1,120 @@
+package tcpee
+
+import (
+	"sync"
+	"testing"
+)
+
+// eventHooks are Hooks recording lifecycle events, serving conns per accept.
+type eventHooks struct {
+	accept bool
+
+	mutex    sync.Mutex
+	events   []string
+	in, out  int64
+	backend  string
+	closeRec *AccessRecord
+}
+
+func (h *eventHooks) event(name string) {
+	h.mutex.Lock()
+	h.events = append(h.events, name)
+	h.mutex.Unlock()
+}
+
+func (h *eventHooks) OnAccept(conn Conn) bool {
+	h.event("accept")
+	return h.accept
+}
+
+func (h *eventHooks) OnDial(conn Conn, backend string) {
+	h.event("dial " + backend)
+}
+
+func (h *eventHooks) OnConnected(conn Conn) {
+	h.event("connected")
+	h.mutex.Lock()
+	h.backend = conn.Backend
+	h.mutex.Unlock()
+}
+
+func (h *eventHooks) OnBytes(conn Conn, in int64, out int64) {
+	h.mutex.Lock()
+	h.in += in
+	h.out += out
+	h.mutex.Unlock()
+}
+
+func (h *eventHooks) OnClose(rec AccessRecord, err error) {
+	h.event("close")
+	h.mutex.Lock()
+	h.closeRec = &rec
+	h.mutex.Unlock()
+}
+
+func (h *eventHooks) snapshot() ([]string, int64, int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string(nil), h.events...), h.in, h.out
+}
+
+func TestHooksLifecycle(t *testing.T) {
+	hooks := &eventHooks{accept: true}
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web", Hooks: hooks})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	roundTrip(t, conn, "world!")
+	conn.Close()
+	waitOpen(t, proxy, 0)
+	proxy.Close()
+
+	events, in, out := hooks.snapshot()
+	if want := []string{"accept", "dial backend", "connected", "close"}; !equalStrings(events, want) {
+		t.Fatalf("events = %q, expected %q", events, want)
+	}
+	if in != 11 || out != 11 {
+		t.Fatalf("hook bytes = %d / %d", in, out)
+	}
+	if hooks.backend != "backend" {
+		t.Fatalf("connected backend = %q", hooks.backend)
+	}
+	if rec := hooks.closeRec; rec.Proxy != "web" || rec.BytesIn != 11 || rec.BytesOut != 11 || rec.Closer != CloserClient {
+		t.Fatalf("close record = %+v", rec)
+	}
+}
+
+func TestHooksDeny(t *testing.T) {
+	hooks := &eventHooks{accept: false}
+	proxy, mn := newMemProxy(t, &TCPProxy{Hooks: hooks})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	if data, err := readAll(mn.dial(t, "front")); err != nil || data != "" {
+		t.Fatalf("denied conn read %q, %v", data, err)
+	}
+	proxy.Close()
+
+	// Denied conns receive no further events
+	if events, _, _ := hooks.snapshot(); !equalStrings(events, []string{"accept"}) {
+		t.Fatalf("events = %q", events)
+	}
+	if stats := proxy.Stats(); stats.Rejected != 1 || stats.Conns != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+// equalStrings returns whether string slices a and b are equal.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,387 @@
+package tcpee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// Access log formats.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// backupTimeFormat is the timestamp format used in rotated file names.
+const backupTimeFormat = "20060102-150405.000"
+
+// AccessLog is an access log sink, writing AccessRecords to a file in one of
+// several formats, with optional size / time based rotation and retention. It
+// may be shared between TCPProxy instances via the TCPProxy.AccessLog field.
+type AccessLog struct {
+	// Path is the access log file path.
+	Path string
+
+	// Format is the record format, one of FormatJSON, FormatLogfmt (the
+	// default), or a template string of $variables named as the keys of
+	// AccessRecord.Fields(), e.g. "$src -> $backend $bytes_in $reason".
+	Format string
+
+	// MaxSize is the file size in bytes at which it is rotated. If
+	// zero, the file is never rotated for size.
+	MaxSize int64
+
+	// Interval is the time after opening at which the file is rotated.
+	// If zero, the file is never rotated for time.
+	Interval time.Duration
+
+	// MaxBackups is the maximum no. rotated files to keep. If
+	// zero, all rotated files are kept (subject to MaxAge).
+	MaxBackups int
+
+	// MaxAge is the maximum age of rotated files to keep. If
+	// zero, rotated files are kept regardless of age.
+	MaxAge time.Duration
+
+	// Compress determines whether rotated files are gzip compressed.
+	Compress bool
+
+	mutex    sync.Mutex     // mutex protects file and backup state
+	file     *os.File       // file is the currently open log file
+	size     int64          // size is the current file size
+	opened   time.Time      // opened is the time file was opened
+	tmpl     []string       // tmpl is the parsed template, alternating literal / variable
+	buf      bytes.Buffer   // buf is the record formatting buffer
+	pending  []string       // pending are the rotated files awaiting compress + prune
+	rotating bool           // rotating indicates a running backups routine
+	rotWg    sync.WaitGroup // rotWg tracks the backups routine
+}
+
+// Open opens the access log file for appending, parsing the configured format.
+func (al *AccessLog) Open() error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	switch al.Format {
+	case "", FormatJSON, FormatLogfmt:
+		al.tmpl = nil
+	default:
+		al.tmpl = parseTemplate(al.Format)
+	}
+
+	return al.open()
+}
+
+// Reopen reopens the access log file, e.g. after external rotation. On
+// error the current file is kept, continuing to be written to.
+func (al *AccessLog) Reopen() error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	file := al.file
+	if err := al.open(); err != nil {
+		return err
+	}
+	if file != nil {
+		file.Close()
+	}
+	return nil
+}
+
+// Close closes the access log file, waiting on any background rotation tasks.
+func (al *AccessLog) Close() error {
+	al.mutex.Lock()
+	var err error
+	if al.file != nil {
+		err = al.file.Close()
+		al.file = nil
+	}
+	al.mutex.Unlock()
+	al.rotWg.Wait()
+	return err
+}
+
+// Write formats and writes the supplied access record, rotating the file as needed.
+func (al *AccessLog) Write(rec *AccessRecord) error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.file == nil {
+		return os.ErrClosed
+	}
+
+	// Format record into buffer
+	al.buf.Reset()
+	al.format(rec)
+	al.buf.WriteByte('\n')
+
+	// Check whether rotation is due, still
+	// writing the record to the current
+	// file should rotation fail
+	var rerr error
+	if (al.MaxSize > 0 && al.size+int64(al.buf.Len()) > al.MaxSize && al.size > 0) ||
+		(al.Interval > 0 && time.Since(al.opened) >= al.Interval) {
+		rerr = al.rotate()
+	}
+
+	n, err := al.file.Write(al.buf.Bytes())
+	al.size += int64(n)
+	if err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// format appends the formatted access record to the buffer.
+func (al *AccessLog) format(rec *AccessRecord) {
+	fields := rec.Fields()
+
+	switch {
+	// Template format
+	case al.tmpl != nil:
+		for i, part := range al.tmpl {
+			if i%2 == 0 {
+				al.buf.WriteString(part)
+			} else if f, ok := fields.Get(part); ok {
+				fmt.Fprint(&al.buf, f.V)
+			} else {
+				al.buf.WriteString("-")
+			}
+		}
+
+	// JSON lines format
+	case al.Format == FormatJSON:
+		al.buf.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				al.buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(f.K)
+			v, _ := json.Marshal(f.V)
+			al.buf.Write(k)
+			al.buf.WriteByte(':')
+			al.buf.Write(v)
+		}
+		al.buf.WriteByte('}')
+
+	// Logfmt format
+	default:
+		al.buf.WriteString(fields.String())
+	}
+}
+
+// open opens the access log file, expecting the mutex held.
+func (al *AccessLog) open() error {
+	file, err := os.OpenFile(al.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file = file
+	al.size = stat.Size()
+	al.opened = time.Now()
+	return nil
+}
+
+// rotate renames the current file to a timestamped backup and opens a new
+// file, compressing and pruning backups in the background. On error the
+// current file is left open at Path. Expects mutex held.
+func (al *AccessLog) rotate() error {
+	// Find unused backup name, bumping the timestamp on
+	// collision so that names still sort oldest first
+	t := time.Now()
+	backup := al.Path + "." + t.Format(backupTimeFormat)
+	for exists(backup) || exists(backup+".gz") {
+		t = t.Add(time.Millisecond)
+		backup = al.Path + "." + t.Format(backupTimeFormat)
+	}
+
+	if err := os.Rename(al.Path, backup); err != nil {
+		return err
+	}
+
+	file := al.file
+	if err := al.open(); err != nil {
+		// Move back to continue appending
+		_ = os.Rename(backup, al.Path)
+		return err
+	}
+	file.Close()
+
+	// Queue for the backups routine
+	al.pending = append(al.pending, backup)
+	if !al.rotating {
+		al.rotating = true
+		al.rotWg.Add(1)
+		go al.backups()
+	}
+
+	return nil
+}
+
+// backups compresses the pending rotated files in order, pruning once none
+// remain pending, such that no backup is pruned while being compressed.
+func (al *AccessLog) backups() {
+	defer al.rotWg.Done()
+
+	for {
+		al.mutex.Lock()
+		if len(al.pending) == 0 {
+			al.rotating = false
+			al.mutex.Unlock()
+			return
+		}
+		backup := al.pending[0]
+		al.pending = al.pending[1:]
+		last := len(al.pending) == 0
+		compress := al.Compress
+		maxBackups, maxAge := al.MaxBackups, al.MaxAge
+		al.mutex.Unlock()
+
+		if compress {
+			if err := compressFile(backup); err != nil {
+				log.ErrorKVs(kv.Fields{
+					{K: "file", V: backup},
+					{K: "error", V: err},
+					{K: "msg", V: "access log compress error"},
+				}...)
+			}
+		}
+
+		if last {
+			al.prune(maxBackups, maxAge)
+		}
+	}
+}
+
+// prune removes rotated files exceeding maxBackups or maxAge.
+func (al *AccessLog) prune(maxBackups int, maxAge time.Duration) {
+	if maxBackups < 1 && maxAge < 1 {
+		return
+	}
+
+	matches, err := filepath.Glob(al.Path + ".*")
+	if err != nil {
+		return
+	}
+
+	// Only consider our own backups
+	backups := matches[:0]
+	for _, path := range matches {
+		if al.isBackup(path) {
+			backups = append(backups, path)
+		}
+	}
+
+	// Timestamped names sort oldest first, newest last
+	sort.Strings(backups)
+
+	for i, backup := range backups {
+		remove := maxBackups > 0 && i < len(backups)-maxBackups
+		if !remove && maxAge > 0 {
+			if stat, err := os.Stat(backup); err == nil {
+				remove = time.Since(stat.ModTime()) > maxAge
+			}
+		}
+		if remove {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+// isBackup returns whether path is named as a (possibly compressed) backup by rotate().
+func (al *AccessLog) isBackup(path string) bool {
+	stamp := strings.TrimPrefix(path, al.Path+".")
+	stamp = strings.TrimSuffix(stamp, ".gz")
+	_, err := time.Parse(backupTimeFormat, stamp)
+	return err == nil
+}
+
+// exists returns whether a file exists at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// compressFile gzip compresses file at path to path + ".gz", removing the original.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// parseTemplate parses a template string of $variables into alternating
+// literal and variable name parts, starting with a literal.
+func parseTemplate(str string) []string {
+	var parts []string
+	for {
+		i := strings.IndexByte(str, '$')
+		if i < 0 {
+			return append(parts, str)
+		}
+		parts = append(parts, str[:i])
+		str = str[i+1:]
+
+		j := 0
+		for j < len(str) && (str[j] == '_' ||
+			(str[j] >= 'a' && str[j] <= 'z') ||
+			(str[j] >= '0' && str[j] <= '9')) {
+			j++
+		}
+		parts = append(parts, str[:j])
+		str = str[j:]
+	}
+}
+
+// ParseAccessFormat checks that the supplied access log format is valid.
+func ParseAccessFormat(format string) error {
+	switch format {
+	case "", FormatJSON, FormatLogfmt:
+		return nil
+	}
+	tmpl := parseTemplate(format)
+	fields := (&AccessRecord{}).Fields()
+	for i := 1; i < len(tmpl); i += 2 {
+		if _, ok := fields.Get(tmpl[i]); !ok {
+			return errors.New("unknown access log variable $" + tmpl[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package tcpee
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecord returns an access record with fixed values.
+func testRecord() *AccessRecord {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	return &AccessRecord{
+		ID:       "abc-1",
+		Proxy:    "web",
+		Src:      "192.0.2.1:1234",
+		Listener: "0.0.0.0:80",
+		Backend:  "10.0.0.2:80",
+		Start:    start,
+		End:      start.Add(1500 * time.Millisecond),
+		BytesIn:  10,
+		BytesOut: 20,
+		Closer:   CloserClient,
+		Reason:   ReasonEOF,
+	}
+}
+
+// readLines reads the lines of file at path.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		line   string
+	}{
+		{
+			format: FormatJSON,
+			line:   `{"id":"abc-1","proxy":"web","src":"192.0.2.1:1234","listener":"0.0.0.0:80","backend":"10.0.0.2:80","start":"2024-01-02T03:04:05Z","end":"2024-01-02T03:04:06.5Z","duration":"1.5s","bytes_in":10,"bytes_out":20,"closer":"client","reason":"eof"}`,
+		},
+		{
+			format: "",
+			line:   `id=abc-1 proxy=web src=192.0.2.1:1234 listener=0.0.0.0:80 backend=10.0.0.2:80 start=2024-01-02T03:04:05Z end=2024-01-02T03:04:06.5Z duration=1.5s bytes_in=10 bytes_out=20 closer=client reason=eof`,
+		},
+		{
+			format: "$src -> $backend [$duration] $bytes_in/$bytes_out $reason$",
+			line:   `192.0.2.1:1234 -> 10.0.0.2:80 [1.5s] 10/20 eof-`,
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "access.log")
+		al := &AccessLog{Path: path, Format: test.format}
+		if err := al.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := al.Write(testRecord()); err != nil {
+			t.Fatal(err)
+		}
+		if err := al.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := al.Write(testRecord()); err != os.ErrClosed {
+			t.Fatalf("write after close = %v", err)
+		}
+		if lines := readLines(t, path); len(lines) != 1 || lines[0] != test.line {
+			t.Errorf("format %q wrote %q, expected %q", test.format, lines, test.line)
+		}
+	}
+}
+
+func TestParseAccessFormat(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		ok     bool
+	}{
+		{format: "", ok: true},
+		{format: "json", ok: true},
+		{format: "logfmt", ok: true},
+		{format: "$src $reason", ok: true},
+		{format: "no variables", ok: true},
+		{format: "$src $nope", ok: false},
+	} {
+		if err := ParseAccessFormat(test.format); (err == nil) != test.ok {
+			t.Errorf("ParseAccessFormat(%q) = %v", test.format, err)
+		}
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	al := &AccessLog{
+		Path:       path,
+		Format:     "$id",
+		MaxSize:    1,
+		MaxBackups: 3,
+		Compress:   true,
+	}
+	if err := al.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotates on every write after the first,
+	// many times within the same millisecond
+	rec := testRecord()
+	for i := 0; i < 10; i++ {
+		rec.ID = string(rune('a' + i))
+		if err := al.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := al.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(backups)
+	if len(backups) != 3 {
+		t.Fatalf("backups = %v, expected 3", backups)
+	}
+
+	// Newest backups kept, all compressed, in order
+	for i, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Fatalf("backup %s not compressed", backup)
+		}
+		f, err := os.Open(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(gz)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := string(rune('g'+i)) + "\n"; string(b) != expect {
+			t.Errorf("backup %s = %q, expected %q", backup, b, expect)
+		}
+	}
+	if lines := readLines(t, path); len(lines) != 1 || lines[0] != "j" {
+		t.Fatalf("current file = %q", lines)
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	al := &AccessLog{Path: path, Format: "$id"}
+	if err := al.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	// Externally rotated
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Write(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLines(t, path); len(lines) != 1 || lines[0] != "abc-1" {
+		t.Fatalf("reopened file = %q", lines)
+	}
+
+	// Failed reopen keeps writing to the current file
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Reopen(); err == nil {
+		t.Fatal("reopened directory")
+	}
+	if err := al.Write(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLines(t, path+".old"); len(lines) != 2 {
+		t.Fatalf("current file = %q", lines)
+	}
+}
+
+func TestAccessLogPruneUnrelated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	for _, name := range []string{"access.log.bak", "access.log.json", "access.log.1.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	al := &AccessLog{Path: path, Format: "$id", MaxSize: 1, MaxBackups: 1}
+	if err := al.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := al.Write(testRecord()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := al.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only our own backups pruned
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 4 {
+		t.Fatalf("files = %v, expected 3 unrelated + 1 backup", matches)
+	}
+}
+
+func TestAccessLogRotateError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	al := &AccessLog{Path: path, Format: "$id", MaxSize: 1}
+	if err := al.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	if err := al.Write(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotation fails with the file gone
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Write(testRecord()); err == nil || errors.Is(err, os.ErrClosed) {
+		t.Fatalf("write on failed rotation = %v", err)
+	}
+
+	// File still open for writing once rotation succeeds
+	if err := al.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Write(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Write(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,383 @@
+package tcpee
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reject reasons, used as metric labels.
+const (
+	rejectBanned = iota
+	rejectACL
+	rejectLimit
+	rejectOverload
+	rejectDrain
+	rejectHook
+	rejectUnready
+	numRejectReasons
+)
+
+// rejectReasons are the metric label values for reject reasons.
+var rejectReasons = [numRejectReasons]string{
+	rejectBanned:   "banned",
+	rejectACL:      "acl",
+	rejectLimit:    "limit",
+	rejectOverload: "overload",
+	rejectDrain:    "drain",
+	rejectHook:     "hook",
+	rejectUnready:  "unready",
+}
+
+// dial error classes, used as metric labels.
+const (
+	dialTimeout = iota
+	dialRefused
+	dialUnreachable
+	dialDNS
+	dialReset
+	dialOther
+	numDialErrors
+)
+
+// dialErrors are the metric label values for dial error classes.
+var dialErrors = [numDialErrors]string{
+	dialTimeout:     "timeout",
+	dialRefused:     "refused",
+	dialUnreachable: "unreachable",
+	dialDNS:         "dns",
+	dialReset:       "reset",
+	dialOther:       "other",
+}
+
+// classifyDialError returns the dial error class for err.
+func classifyDialError(err error) int {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return dialDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialRefused
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return dialUnreachable
+	case errors.Is(err, syscall.ECONNRESET):
+		return dialReset
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return dialTimeout
+	default:
+		return dialOther
+	}
+}
+
+// dialBuckets are the dial latency histogram bucket bounds, in seconds.
+var dialBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// connBuckets are the conn duration histogram bucket bounds, in seconds.
+var connBuckets = []float64{.1, 1, 10, 60, 300, 900, 3600, 14400, 86400}
+
+// Metrics collects per-route and per-backend proxy metrics, served via
+// ServeHTTP in the Prometheus text exposition format. A single Metrics may
+// be shared between TCPProxy instances via the TCPProxy.Metrics field.
+type Metrics struct {
+	mutex    sync.Mutex                    // mutex protects the maps
+	routes   map[[2]string]*routeMetrics   // routes keyed by proxy+route
+	backends map[[3]string]*backendMetrics // backends keyed by proxy+route+backend
+}
+
+// routeMetrics holds the metrics for a single proxy route.
+type routeMetrics struct {
+	accepted uint64                   // accepted is the no. accepted conns
+	rejected [numRejectReasons]uint64 // rejected are the no. rejected conns by reason
+	held     int64                    // held is the no. conns held on an unready backend
+}
+
+// backendMetrics holds the metrics for a single proxy route backend.
+type backendMetrics struct {
+	closed     uint64                // closed is the no. closed conns
+	active     int64                 // active is the no. open conns
+	bytesIn    uint64                // bytesIn is the no. bytes client -> server
+	bytesOut   uint64                // bytesOut is the no. bytes server -> client
+	dialErrors [numDialErrors]uint64 // dialErrors are the no. dial errors by class
+	dialTime   histogram             // dialTime is the dial latency histogram
+	connTime   histogram             // connTime is the conn duration histogram
+}
+
+// route fetches (or allocates) the metrics for route on proxy.
+func (m *Metrics) route(proxy, route string) *routeMetrics {
+	if m == nil {
+		return nil
+	}
+	key := [2]string{proxy, route}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.routes == nil {
+		m.routes = make(map[[2]string]*routeMetrics)
+	}
+	rm, ok := m.routes[key]
+	if !ok {
+		rm = &routeMetrics{}
+		m.routes[key] = rm
+	}
+	return rm
+}
+
+// backend fetches (or allocates) the metrics for backend of route on proxy.
+func (m *Metrics) backend(proxy, route, backend string) *backendMetrics {
+	if m == nil {
+		return nil
+	}
+	key := [3]string{proxy, route, backend}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.backends == nil {
+		m.backends = make(map[[3]string]*backendMetrics)
+	}
+	bm, ok := m.backends[key]
+	if !ok {
+		bm = &backendMetrics{
+			dialTime: newHistogram(dialBuckets),
+			connTime: newHistogram(connBuckets),
+		}
+		m.backends[key] = bm
+	}
+	return bm
+}
+
+// accept records an accepted conn.
+func (rm *routeMetrics) accept() {
+	if rm != nil {
+		atomic.AddUint64(&rm.accepted, 1)
+	}
+}
+
+// reject records a rejected conn with reason.
+func (rm *routeMetrics) reject(reason int) {
+	if rm != nil {
+		atomic.AddUint64(&rm.rejected[reason], 1)
+	}
+}
+
+// hold records a conn held on (delta 1) or released from (delta -1) an unready backend.
+func (rm *routeMetrics) hold(delta int64) {
+	if rm != nil {
+		atomic.AddInt64(&rm.held, delta)
+	}
+}
+
+// open records a newly opened conn.
+func (bm *backendMetrics) open() {
+	if bm != nil {
+		atomic.AddInt64(&bm.active, 1)
+	}
+}
+
+// close records a closed conn that was open for d.
+func (bm *backendMetrics) close(d time.Duration) {
+	if bm != nil {
+		atomic.AddInt64(&bm.active, -1)
+		atomic.AddUint64(&bm.closed, 1)
+		bm.connTime.observe(d)
+	}
+}
+
+// dial records a dial attempt taking d, with result err.
+func (bm *backendMetrics) dial(d time.Duration, err error) {
+	if bm == nil {
+		return
+	}
+	if err != nil {
+		atomic.AddUint64(&bm.dialErrors[classifyDialError(err)], 1)
+		return
+	}
+	bm.dialTime.observe(d)
+}
+
+// addBytesIn records n bytes client -> server.
+func (bm *backendMetrics) addBytesIn(n int64) {
+	if bm != nil {
+		atomic.AddUint64(&bm.bytesIn, uint64(n))
+	}
+}
+
+// addBytesOut records n bytes server -> client.
+func (bm *backendMetrics) addBytesOut(n int64) {
+	if bm != nil {
+		atomic.AddUint64(&bm.bytesOut, uint64(n))
+	}
+}
+
+// ServeHTTP implements http.Handler, writing all collected metrics
+// in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(rw)
+	m.write(bw)
+	bw.Flush()
+}
+
+// write writes all collected metrics in the Prometheus text exposition format.
+func (m *Metrics) write(bw *bufio.Writer) {
+	type routeEntry struct {
+		labels string
+		rm     *routeMetrics
+	}
+	type backendEntry struct {
+		labels string
+		bm     *backendMetrics
+	}
+
+	// Take snapshots of the metrics maps
+	m.mutex.Lock()
+	routes := make([]routeEntry, 0, len(m.routes))
+	for key, rm := range m.routes {
+		routes = append(routes, routeEntry{
+			labels: routeLabels(key[0], key[1]),
+			rm:     rm,
+		})
+	}
+	backends := make([]backendEntry, 0, len(m.backends))
+	for key, bm := range m.backends {
+		backends = append(backends, backendEntry{
+			labels: routeLabels(key[0], key[1]) + `,backend="` + escapeLabel(key[2]) + `"`,
+			bm:     bm,
+		})
+	}
+	m.mutex.Unlock()
+
+	// Sort for stable output
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].labels < routes[j].labels
+	})
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].labels < backends[j].labels
+	})
+
+	header(bw, "tcpee_connections_accepted_total", "counter", "Total connections accepted.")
+	for _, e := range routes {
+		sample(bw, "tcpee_connections_accepted_total", e.labels, float64(atomic.LoadUint64(&e.rm.accepted)))
+	}
+
+	header(bw, "tcpee_connections_rejected_total", "counter", "Total connections rejected, by reason.")
+	for _, e := range routes {
+		for reason, name := range rejectReasons {
+			labels := e.labels + `,reason="` + name + `"`
+			sample(bw, "tcpee_connections_rejected_total", labels, float64(atomic.LoadUint64(&e.rm.rejected[reason])))
+		}
+	}
+
+	header(bw, "tcpee_connections_held", "gauge", "Connections held waiting on an unready backend.")
+	for _, e := range routes {
+		sample(bw, "tcpee_connections_held", e.labels, float64(atomic.LoadInt64(&e.rm.held)))
+	}
+
+	header(bw, "tcpee_connections_closed_total", "counter", "Total connections closed.")
+	for _, e := range backends {
+		sample(bw, "tcpee_connections_closed_total", e.labels, float64(atomic.LoadUint64(&e.bm.closed)))
+	}
+
+	header(bw, "tcpee_connections_active", "gauge", "Currently open connections.")
+	for _, e := range backends {
+		sample(bw, "tcpee_connections_active", e.labels, float64(atomic.LoadInt64(&e.bm.active)))
+	}
+
+	header(bw, "tcpee_bytes_total", "counter", "Total bytes proxied, by direction.")
+	for _, e := range backends {
+		sample(bw, "tcpee_bytes_total", e.labels+`,direction="in"`, float64(atomic.LoadUint64(&e.bm.bytesIn)))
+		sample(bw, "tcpee_bytes_total", e.labels+`,direction="out"`, float64(atomic.LoadUint64(&e.bm.bytesOut)))
+	}
+
+	header(bw, "tcpee_dial_errors_total", "counter", "Total backend dial errors, by class.")
+	for _, e := range backends {
+		for class, name := range dialErrors {
+			labels := e.labels + `,class="` + name + `"`
+			sample(bw, "tcpee_dial_errors_total", labels, float64(atomic.LoadUint64(&e.bm.dialErrors[class])))
+		}
+	}
+
+	header(bw, "tcpee_dial_duration_seconds", "histogram", "Backend dial latency.")
+	for _, e := range backends {
+		e.bm.dialTime.write(bw, "tcpee_dial_duration_seconds", e.labels)
+	}
+
+	header(bw, "tcpee_connection_duration_seconds", "histogram", "Proxied connection duration.")
+	for _, e := range backends {
+		e.bm.connTime.write(bw, "tcpee_connection_duration_seconds", e.labels)
+	}
+}
+
+// routeLabels formats the metric labels for a proxy route.
+func routeLabels(proxy, route string) string {
+	return `proxy="` + escapeLabel(proxy) + `",route="` + escapeLabel(route) + `"`
+}
+
+// escapeLabel escapes a metric label value.
+func escapeLabel(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(str)
+}
+
+// header writes metric HELP and TYPE lines.
+func header(bw *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single metric sample line.
+func sample(bw *bufio.Writer, name, labels string, value float64) {
+	fmt.Fprintf(bw, "%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+// formatFloat formats a float metric value.
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+// histogram is a simple fixed-bucket, lock-free duration histogram.
+type histogram struct {
+	bounds []float64 // bounds are the bucket upper bounds in seconds
+	counts []uint64  // counts are the per-bucket (non-cumulative) counts
+	count  uint64    // count is the total no. observations
+	sum    int64     // sum is the total of observations in nanoseconds
+}
+
+// newHistogram returns a new histogram with supplied bucket bounds.
+func newHistogram(bounds []float64) histogram {
+	return histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// observe records a single duration observation.
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, secs)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// write writes the histogram samples with supplied name and labels.
+func (h *histogram) write(bw *bufio.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		sample(bw, name+"_bucket", labels+`,le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	sample(bw, name+"_bucket", labels+`,le="+Inf"`, float64(cumulative))
+	sample(bw, name+"_sum", labels, time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	sample(bw, name+"_count", labels, float64(atomic.LoadUint64(&h.count)))
+}
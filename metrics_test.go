@@ -0,0 +1,102 @@
+package tcpee
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyDialError(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class int
+	}{
+		{err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, class: dialRefused},
+		{err: &net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, class: dialUnreachable},
+		{err: &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, class: dialUnreachable},
+		{err: &net.OpError{Op: "dial", Err: syscall.ECONNRESET}, class: dialReset},
+		{err: &net.DNSError{Err: "no such host", Name: "example.invalid"}, class: dialDNS},
+		{err: context.DeadlineExceeded, class: dialTimeout},
+		{err: errors.New("other"), class: dialOther},
+	} {
+		if class := classifyDialError(test.err); class != test.class {
+			t.Errorf("classifyDialError(%v) = %s, expected %s", test.err, dialErrors[class], dialErrors[test.class])
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(time.Second)
+	h.observe(2 * time.Second)
+
+	var sb strings.Builder
+	bw := bufio.NewWriter(&sb)
+	h.write(bw, "test", `a="b"`)
+	bw.Flush()
+
+	expect := `test_bucket{a="b",le="0.1"} 1
+test_bucket{a="b",le="1"} 2
+test_bucket{a="b",le="+Inf"} 3
+test_sum{a="b"} 3.05
+test_count{a="b"} 3
+`
+	if sb.String() != expect {
+		t.Fatalf("histogram wrote:\n%s\nexpected:\n%s", sb.String(), expect)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if str := escapeLabel("a\\b\"c\nd"); str != `a\\b\"c\nd` {
+		t.Fatalf("escapeLabel = %s", str)
+	}
+}
+
+func TestMetricsServe(t *testing.T) {
+	metrics := &Metrics{}
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		Name:         "web",
+		Metrics:      metrics,
+		MaxConns:     1,
+		OverloadMode: OverloadReject,
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	_, _ = readAll(mn.dial(t, "front"))
+	conn.Close()
+	waitOpen(t, proxy, 0)
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	labels := `proxy="web",route="front"`
+	for _, line := range []string{
+		`tcpee_connections_accepted_total{` + labels + `} 2`,
+		`tcpee_connections_rejected_total{` + labels + `,reason="overload"} 1`,
+		`tcpee_connections_rejected_total{` + labels + `,reason="acl"} 0`,
+		`tcpee_connections_closed_total{` + labels + `,backend="backend"} 1`,
+		`tcpee_connections_active{` + labels + `,backend="backend"} 0`,
+		`tcpee_bytes_total{` + labels + `,backend="backend",direction="in"} 5`,
+		`tcpee_bytes_total{` + labels + `,backend="backend",direction="out"} 5`,
+		`tcpee_dial_duration_seconds_count{` + labels + `,backend="backend"} 1`,
+		`tcpee_connection_duration_seconds_count{` + labels + `,backend="backend"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
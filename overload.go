@@ -0,0 +1,215 @@
+package tcpee
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// OverloadMode determines how a proxy behaves once its maximum
+// no. connections has been reached.
+type OverloadMode int
+
+const (
+	// OverloadBackpressure stops accepting new connections until a
+	// slot is free, leaving the kernel listen backlog to absorb bursts.
+	OverloadBackpressure OverloadMode = iota
+
+	// OverloadQueue accepts new connections, waiting up to
+	// TCPProxy.QueueTimeout for a free slot before rejecting.
+	OverloadQueue
+
+	// OverloadReject immediately rejects new connections, first
+	// writing TCPProxy.RejectBanner to the client if set.
+	OverloadReject
+)
+
+// String returns the config string representation of mode.
+func (mode OverloadMode) String() string {
+	switch mode {
+	case OverloadBackpressure:
+		return "backpressure"
+	case OverloadQueue:
+		return "queue"
+	case OverloadReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOverloadMode parses an OverloadMode from its string representation.
+func ParseOverloadMode(str string) (OverloadMode, bool) {
+	switch str {
+	case "", "backpressure":
+		return OverloadBackpressure, true
+	case "queue":
+		return OverloadQueue, true
+	case "reject":
+		return OverloadReject, true
+	default:
+		return 0, false
+	}
+}
+
+// Semaphore limits the no. concurrently open connections. A single
+// Semaphore may be shared between TCPProxy instances via the
+// TCPProxy.GlobalConns field to enforce a process-wide limit.
+type Semaphore struct{ slots chan struct{} }
+
+// NewSemaphore returns a new Semaphore with n slots, or nil if n < 1.
+func NewSemaphore(n int) *Semaphore {
+	if n < 1 {
+		return nil
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// Len returns the no. currently acquired slots.
+func (sem *Semaphore) Len() int {
+	if sem == nil {
+		return 0
+	}
+	return len(sem.slots)
+}
+
+// Cap returns the total no. slots, zero being unlimited.
+func (sem *Semaphore) Cap() int {
+	if sem == nil {
+		return 0
+	}
+	return cap(sem.slots)
+}
+
+// acquire acquires a slot, waiting up to timeout (negative waits until
+// ctx is cancelled, zero does not wait). Returns whether a slot acquired.
+func (sem *Semaphore) acquire(ctx context.Context, timeout time.Duration) bool {
+	if sem == nil {
+		return true
+	}
+
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	default:
+		if timeout == 0 {
+			return false
+		}
+	}
+
+	var expire <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expire = t.C
+	}
+
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	case <-expire:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release releases a previously acquired slot.
+func (sem *Semaphore) release() {
+	if sem != nil {
+		<-sem.slots
+	}
+}
+
+// acquireSlots acquires a conn slot from both the route and global
+// semaphores, with timeout semantics as Semaphore.acquire().
+func (proxy *TCPProxy) acquireSlots(ctx context.Context, rt *route, timeout time.Duration) bool {
+	if !rt.slots.acquire(ctx, timeout) {
+		return false
+	}
+	if !proxy.GlobalConns.acquire(ctx, timeout) {
+		rt.slots.release()
+		return false
+	}
+	return true
+}
+
+// releaseSlots releases conn slots acquired by acquireSlots().
+func (proxy *TCPProxy) releaseSlots(rt *route) {
+	proxy.GlobalConns.release()
+	rt.slots.release()
+}
+
+// defaultQueueTimeout is the queue timeout used when none is set.
+const defaultQueueTimeout = 10 * time.Second
+
+// defaultMaxQueue is the max no. queued conns used when none is set.
+const defaultMaxQueue = 1024
+
+// queue waits on free conn slots for an accepted conn according to the
+// OverloadMode, serving it if acquired and otherwise rejecting it.
+func (proxy *TCPProxy) queue(conn net.Conn, rt *route, key string) {
+	if !proxy.acquireSlots(proxy.baseCtx, rt, 0) && !proxy.enqueue(rt) {
+		// Untrack serve routine
+		proxy.releaseConn(key)
+		proxy.serveWg.Done()
+		rt.reject(rejectOverload)
+		proxy.overload(conn)
+		return
+	}
+
+	proxy.serve(conn, rt, key)
+}
+
+// enqueue waits on free conn slots under OverloadQueue, if the queue isn't
+// full, returning whether they were acquired.
+func (proxy *TCPProxy) enqueue(rt *route) bool {
+	if proxy.OverloadMode != OverloadQueue {
+		return false
+	}
+
+	timeout := proxy.QueueTimeout
+	if timeout < 1 {
+		timeout = defaultQueueTimeout
+	}
+
+	max := proxy.MaxQueue
+	if max < 1 {
+		max = defaultMaxQueue
+	}
+
+	// Reject outright once queue is full
+	defer atomic.AddInt64(&proxy.queued, -1)
+	if atomic.AddInt64(&proxy.queued, 1) > int64(max) {
+		return false
+	}
+
+	return proxy.acquireSlots(proxy.baseCtx, rt, timeout)
+}
+
+// overload rejects the supplied conn due to max conns being reached.
+func (proxy *TCPProxy) overload(conn net.Conn) {
+	log.InfoKVs(kv.Fields{
+		{K: "proxy", V: proxy.Name},
+		{K: "src", V: conn.RemoteAddr().String()},
+		{K: "mode", V: proxy.OverloadMode.String()},
+		{K: "msg", V: "max connections reached"},
+	}...)
+
+	proxy.rejectBanner(conn)
+}
+
+// rejectBanner writes the RejectBanner, if set, to the conn before closing it.
+func (proxy *TCPProxy) rejectBanner(conn net.Conn) {
+	if len(proxy.RejectBanner) > 0 {
+		// Write banner, without blocking on a slow client
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write([]byte(proxy.RejectBanner))
+	}
+
+	conn.Close()
+}
@@ -0,0 +1,199 @@
+package tcpee
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseOverloadMode(t *testing.T) {
+	for _, test := range []struct {
+		str  string
+		mode OverloadMode
+		ok   bool
+	}{
+		{str: "", mode: OverloadBackpressure, ok: true},
+		{str: "backpressure", mode: OverloadBackpressure, ok: true},
+		{str: "queue", mode: OverloadQueue, ok: true},
+		{str: "reject", mode: OverloadReject, ok: true},
+		{str: "drop", ok: false},
+	} {
+		mode, ok := ParseOverloadMode(test.str)
+		if ok != test.ok || (ok && mode != test.mode) {
+			t.Errorf("ParseOverloadMode(%q) = %v, %v", test.str, mode, ok)
+		}
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	if NewSemaphore(0) != nil {
+		t.Fatal("NewSemaphore(0) != nil")
+	}
+
+	var nilSem *Semaphore
+	if !nilSem.acquire(context.Background(), 0) || nilSem.Len() != 0 || nilSem.Cap() != 0 {
+		t.Fatal("nil semaphore not unlimited")
+	}
+
+	sem := NewSemaphore(1)
+	if !sem.acquire(context.Background(), 0) {
+		t.Fatal("acquire on free semaphore failed")
+	}
+	if sem.acquire(context.Background(), 0) {
+		t.Fatal("acquire on full semaphore succeeded without waiting")
+	}
+
+	start := time.Now()
+	if sem.acquire(context.Background(), 50*time.Millisecond) {
+		t.Fatal("acquire on full semaphore succeeded")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("acquire timed out after %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sem.acquire(ctx, -1) {
+		t.Fatal("acquire with cancelled ctx succeeded")
+	}
+
+	// Released slot handed to waiter
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sem.release()
+	}()
+	if !sem.acquire(context.Background(), -1) {
+		t.Fatal("waiter not handed released slot")
+	}
+	if sem.Len() != 1 || sem.Cap() != 1 {
+		t.Fatalf("Len()=%d Cap()=%d", sem.Len(), sem.Cap())
+	}
+}
+
+func TestOverloadBackpressure(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{MaxConns: 1})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	first := mn.dial(t, "front")
+	roundTrip(t, first, "one")
+
+	// Not accepted while the slot is held
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := mn.DialContext(ctx, "tcp", "front"); err == nil {
+		t.Fatal("conn accepted beyond max conns")
+	}
+
+	first.Close()
+	roundTrip(t, mn.dial(t, "front"), "two")
+}
+
+func TestOverloadQueue(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		MaxConns:     1,
+		OverloadMode: OverloadQueue,
+		QueueTimeout: 100 * time.Millisecond,
+		RejectBanner: "busy\n",
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	first := mn.dial(t, "front")
+	roundTrip(t, first, "one")
+
+	// Queued conn served once the slot frees up
+	queued := mn.dial(t, "front")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.Close()
+	}()
+	roundTrip(t, queued, "two")
+
+	// Queued conn rejected after timeout
+	start := time.Now()
+	rejected := mn.dial(t, "front")
+	if msg, _ := readAll(rejected); msg != "busy\n" {
+		t.Fatalf("rejected conn read %q", msg)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("queued conn rejected after %v", d)
+	}
+}
+
+func TestOverloadReject(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		MaxConns:     1,
+		OverloadMode: OverloadReject,
+		RejectBanner: "busy\n",
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	first := mn.dial(t, "front")
+	roundTrip(t, first, "one")
+
+	if msg, _ := readAll(mn.dial(t, "front")); msg != "busy\n" {
+		t.Fatalf("rejected conn read %q", msg)
+	}
+	if stats := proxy.Stats(); stats.Rejected != 1 {
+		t.Fatalf("proxy rejected = %d", stats.Rejected)
+	}
+}
+
+func TestGlobalConns(t *testing.T) {
+	global := NewSemaphore(1)
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		GlobalConns:  global,
+		OverloadMode: OverloadReject,
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "a", Dst: "backend"})
+	startRoute(t, proxy, Route{Src: "b", Dst: "backend"})
+
+	roundTrip(t, mn.dial(t, "a"), "one")
+	if msg, err := readAll(mn.dial(t, "b")); msg != "" || err != nil {
+		t.Fatalf("conn beyond global limit read %q, %v", msg, err)
+	}
+	if global.Len() != 1 {
+		t.Fatalf("global slots = %d", global.Len())
+	}
+}
+
+func TestOverloadQueueFull(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		MaxConns:     1,
+		OverloadMode: OverloadQueue,
+		QueueTimeout: time.Minute,
+		MaxQueue:     1,
+		RejectBanner: "busy\n",
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	first := mn.dial(t, "front")
+	roundTrip(t, first, "one")
+
+	// Fill the queue
+	queued := mn.dial(t, "front")
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&proxy.queued) < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("conn never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Conns beyond the max queue rejected without waiting
+	start := time.Now()
+	if msg, _ := readAll(mn.dial(t, "front")); msg != "busy\n" {
+		t.Fatalf("rejected conn read %q", msg)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("conn beyond max queue rejected after %v", d)
+	}
+
+	// Queued conn still served once the slot frees up
+	first.Close()
+	roundTrip(t, queued, "two")
+}
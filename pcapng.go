@@ -0,0 +1,251 @@
+package tcpee
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+// pcapng block types.
+const (
+	pcapngSHB = 0x0A0D0D0A // section header block
+	pcapngIDB = 0x00000001 // interface description block
+	pcapngEPB = 0x00000006 // enhanced packet block
+)
+
+// linktypeRaw is the pcap link type of raw IPv4 / IPv6 packets.
+const linktypeRaw = 101
+
+// TCP header flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapngMaxSegment is the maximum TCP payload per synthesized packet.
+const pcapngMaxSegment = 65000
+
+// pcapngWriter writes captured data as a pcapng file of synthesized TCP/IP
+// packets, including handshake and close, between client and backend.
+type pcapngWriter struct {
+	file *os.File
+	bw   *bufio.Writer
+	buf  []byte // buf is the packet building buffer
+
+	src, dst net.IP // src and dst are the client / backend IPs
+	ports    [2]uint16
+	seq      [2]uint32 // seq are the next client / backend sequence nos.
+	v4       bool      // v4 indicates IPv4 packets, else IPv6
+}
+
+// newPcapngWriter creates a pcapng capture file at name + ".pcapng",
+// writing the file headers and a synthesized TCP handshake.
+func newPcapngWriter(name string, src, dst *net.TCPAddr) (*pcapngWriter, error) {
+	file, err := os.OpenFile(name+".pcapng", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &pcapngWriter{
+		file:  file,
+		bw:    bufio.NewWriter(file),
+		ports: [2]uint16{uint16(src.Port), uint16(dst.Port)},
+		seq:   [2]uint32{rand.Uint32(), rand.Uint32()},
+	}
+
+	// Use IPv4 only if both ends are, else map to IPv6
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		w.src, w.dst, w.v4 = src4, dst4, true
+	} else {
+		w.src, w.dst = src.IP.To16(), dst.IP.To16()
+	}
+
+	// Section header block
+	w.block(pcapngSHB, func(b []byte) []byte {
+		b = appendLE32(b, 0x1A2B3C4D)                            // byte-order magic
+		b = appendLE16(b, 1)                                     // major version
+		b = appendLE16(b, 0)                                     // minor version
+		return appendLE32(appendLE32(b, ^uint32(0)), ^uint32(0)) // section length
+	})
+
+	// Interface description block
+	w.block(pcapngIDB, func(b []byte) []byte {
+		b = appendLE16(b, linktypeRaw)
+		b = appendLE16(b, 0) // reserved
+		return appendLE32(b, 0)
+	})
+
+	// Synthesized three-way handshake
+	now := time.Now()
+	w.packet(now, 0, tcpSYN, nil)
+	w.seq[0]++
+	w.packet(now, 1, tcpSYN|tcpACK, nil)
+	w.seq[1]++
+	w.packet(now, 0, tcpACK, nil)
+
+	return w, nil
+}
+
+func (w *pcapngWriter) write(chunk captureChunk) error {
+	dir := 1
+	if chunk.in {
+		dir = 0
+	}
+
+	// Skip dropped bytes, so they show as a gap
+	w.seq[dir] += uint32(chunk.skip)
+
+	for data := chunk.data; len(data) > 0; {
+		n := len(data)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+		w.packet(chunk.time, dir, tcpPSH|tcpACK, data[:n])
+		w.seq[dir] += uint32(n)
+		data = data[n:]
+	}
+
+	return nil
+}
+
+func (w *pcapngWriter) close(truncated bool) error {
+	// Synthesized close
+	now := time.Now()
+	w.packet(now, 0, tcpFIN|tcpACK, nil)
+	w.seq[0]++
+	w.packet(now, 1, tcpFIN|tcpACK, nil)
+	w.seq[1]++
+	w.packet(now, 0, tcpACK, nil)
+
+	err := w.bw.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// block writes a pcapng block of type, with body appended by fn.
+func (w *pcapngWriter) block(typ uint32, fn func([]byte) []byte) {
+	b := w.buf[:0]
+	b = appendLE32(b, typ)
+	b = appendLE32(b, 0) // length, set below
+	b = fn(b)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	b = appendLE32(b, uint32(len(b)+4))
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	w.bw.Write(b)
+	w.buf = b
+}
+
+// packet writes an enhanced packet block containing a synthesized TCP/IP
+// packet with flags and payload, sent by client if dir == 0, else backend.
+func (w *pcapngWriter) packet(t time.Time, dir int, flags byte, payload []byte) {
+	w.block(pcapngEPB, func(b []byte) []byte {
+		ts := uint64(t.UnixNano() / 1000)
+		b = appendLE32(b, 0) // interface ID
+		b = appendLE32(b, uint32(ts>>32))
+		b = appendLE32(b, uint32(ts))
+
+		// Packet lengths, set below
+		lenAt := len(b)
+		b = append(b, make([]byte, 8)...)
+
+		start := len(b)
+		b = w.appendPacket(b, dir, flags, payload)
+		binary.LittleEndian.PutUint32(b[lenAt:], uint32(len(b)-start))
+		binary.LittleEndian.PutUint32(b[lenAt+4:], uint32(len(b)-start))
+		return b
+	})
+}
+
+// appendPacket appends a synthesized TCP/IP packet to b.
+func (w *pcapngWriter) appendPacket(b []byte, dir int, flags byte, payload []byte) []byte {
+	src, dst := w.src, w.dst
+	if dir == 1 {
+		src, dst = dst, src
+	}
+	tcpLen := 20 + len(payload)
+
+	// IP header
+	ipStart := len(b)
+	if w.v4 {
+		b = append(b, 0x45, 0) // version + IHL, TOS
+		b = appendBE16(b, uint16(20+tcpLen))
+		b = append(b, 0, 0, 0x40, 0, 64, 6, 0, 0) // ID, DF, TTL, TCP, checksum
+		b = append(b, src...)
+		b = append(b, dst...)
+		binary.BigEndian.PutUint16(b[ipStart+10:], checksum(b[ipStart:], 0))
+	} else {
+		b = append(b, 0x60, 0, 0, 0) // version, class, flow
+		b = appendBE16(b, uint16(tcpLen))
+		b = append(b, 6, 64) // TCP, hop limit
+		b = append(b, src...)
+		b = append(b, dst...)
+	}
+
+	// TCP header
+	tcpStart := len(b)
+	b = appendBE16(b, w.ports[dir])
+	b = appendBE16(b, w.ports[1-dir])
+	b = appendBE32(b, w.seq[dir])
+	if flags&tcpACK != 0 {
+		b = appendBE32(b, w.seq[1-dir])
+	} else {
+		b = appendBE32(b, 0)
+	}
+	b = append(b, 5<<4, flags, 0xff, 0xff, 0, 0, 0, 0) // offset, flags, window, checksum, urgent
+	b = append(b, payload...)
+
+	// TCP checksum over pseudo-header
+	var sum uint32
+	for _, ip := range []net.IP{src, dst} {
+		for i := 0; i < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	sum += 6 + uint32(tcpLen)
+	binary.BigEndian.PutUint16(b[tcpStart+16:], checksum(b[tcpStart:], sum))
+
+	return b
+}
+
+// checksum returns the internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// appendLE16 appends v to b in little-endian byte order.
+func appendLE16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+// appendLE32 appends v to b in little-endian byte order.
+func appendLE32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// appendBE16 appends v to b in big-endian byte order.
+func appendBE16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendBE32 appends v to b in big-endian byte order.
+func appendBE32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"codeberg.org/gruf/go-kv"
@@ -18,6 +19,30 @@ import (
 // ErrProxyClosed will be returned upon proxy close.
 var ErrProxyClosed = errors.New("tcpee: proxy closed")
 
+// drainCheckInterval is the interval at which Shutdown() checks remaining conns.
+const drainCheckInterval = 100 * time.Millisecond
+
+// drainLogInterval is the interval at which Shutdown() logs remaining conns.
+const drainLogInterval = 5 * time.Second
+
+// countInterval is the maximum interval between byte count updates
+// of an active connection, bounding the lag of stats and metrics.
+const countInterval = time.Second
+
+// defaultKeepAlive is the keep-alive period used for a zero ClientKeepAlive
+// or ServerKeepAlive, as by net.ListenConfig and net.Dialer.
+const defaultKeepAlive = 15 * time.Second
+
+// Settings are the TCPProxy settings that may be changed while running via
+// Update(), each as documented on the TCPProxy field of the same name.
+type Settings struct {
+	ClientTimeout   time.Duration
+	ServerTimeout   time.Duration
+	ClientKeepAlive time.Duration
+	ServerKeepAlive time.Duration
+	DrainIdle       time.Duration
+}
+
 type TCPProxy struct {
 	// Name is the name of this proxy server, used when
 	// logging via the supplied logger
@@ -34,13 +59,13 @@ type TCPProxy struct {
 	DialTimeout time.Duration
 
 	// ClientTimeout is the maximum time a client conn may idle before
-	// being forcibly closed. Note that longer timeout periods
-	// will be more efficient as they require less-frequent checks
+	// being forcibly closed, i.e. without any data read from it. Idle
+	// checks are made alongside the byte count updates each second
 	ClientTimeout time.Duration
 
 	// ServerTimeout is the maximum time a server conn may idle before
-	// being forcibly closed. Note that longer timeout periods
-	// will be more efficient as they require less-frequent checks
+	// being forcibly closed, i.e. without any data read from it. Idle
+	// checks are made alongside the byte count updates each second
 	ServerTimeout time.Duration
 
 	// ClientKeepAlive specifies the keep-alive period for conns from
@@ -53,24 +78,285 @@ type TCPProxy struct {
 	// value.If negative, keep-alives are disabled.
 	ServerKeepAlive time.Duration
 
-	lnCfg   net.ListenConfig // lnCfg is the set listener config
-	dialer  net.Dialer       // dialer is the set dialer we use
-	cancel  func()           // cancel is the proxy context cancel
-	baseCtx context.Context  // baseCtx is the proxy base context
-	serveWg sync.WaitGroup   // serveWg tracks running serve routines
-	doOnce  sync.Once        // doOnce is the proxy init routine protector
-	ppool   sync.Pool        // ppool is the proxy proto buffer pool
-	open    int64            // open tracks the no. open proxy connections
+	// DrainIdle is the time after which conns left idle during
+	// Shutdown() are half-closed, signalling EOF to the backend so
+	// that well-behaved backends finish responding and close. If
+	// zero, conns are left open until the shutdown deadline.
+	DrainIdle time.Duration
+
+	// Note that the above timeouts, keep-alives and DrainIdle are
+	// only read on first use, after which they may be changed via
+	// Update(), see Settings.
+
+	// Dialer is an optional dialer for backend conns, in place of
+	// a net.Dialer using DialTimeout and ServerKeepAlive. Any set
+	// DialTimeout is still applied via the dial context.
+	Dialer Dialer
+
+	// Listener is an optional listener opener for routes, in place
+	// of a net.ListenConfig using ClientKeepAlive.
+	Listener Listener
+
+	// ConnLimits are the bandwidth limits applied to each
+	// individual proxied connection.
+	ConnLimits BandwidthLimits
+
+	// SourceLimits are the bandwidth limits shared between
+	// all proxied connections from a single source IP.
+	SourceLimits BandwidthLimits
+
+	// RouteLimits are the bandwidth limits shared between all
+	// proxied connections on a single route, i.e. per Proxy() call.
+	RouteLimits BandwidthLimits
+
+	// SourceConnRate limits the rate of new connections accepted from
+	// a single source prefix, in connections per second.
+	SourceConnRate RateLimit
+
+	// SourceMaxConns is the maximum no. concurrently open connections
+	// from a single source prefix. If zero, no limit is applied.
+	SourceMaxConns int
+
+	// SourcePrefixV4 and SourcePrefixV6 are the CIDR prefix lengths by
+	// which source addresses are grouped for connection limits. If
+	// zero, each source IP address is limited individually.
+	SourcePrefixV4 int
+	SourcePrefixV6 int
+
+	// LimitAction is the action taken on connections that breach the
+	// per-source connection limits.
+	LimitAction LimitAction
+
+	// TarpitTime is the time a rejected connection is held open for
+	// under ActionTarpit. If zero, a default of 30s is used.
+	TarpitTime time.Duration
+
+	// MaxTarpits is the maximum no. connections held open at once under
+	// ActionTarpit, beyond which they're closed. If zero, a default of
+	// 1024 is used.
+	MaxTarpits int
+
+	// MaxConns is the maximum no. concurrently open connections on
+	// a single route, i.e. per Proxy() call. If zero, no limit.
+	MaxConns int
+
+	// GlobalConns is an optional Semaphore limiting the no. open
+	// connections, shared between all routes (and any other TCPProxy
+	// instances using the same Semaphore).
+	GlobalConns *Semaphore
+
+	// OverloadMode determines how new connections are handled once
+	// MaxConns or GlobalConns have been reached.
+	OverloadMode OverloadMode
+
+	// QueueTimeout is the maximum time a connection will wait for a
+	// free slot under OverloadQueue. If zero, a default of 10s is used.
+	QueueTimeout time.Duration
+
+	// MaxQueue is the maximum no. connections waiting at once for a free
+	// slot under OverloadQueue, beyond which they're rejected as under
+	// OverloadReject. If zero, a default of 1024 is used.
+	MaxQueue int
+
+	// RejectBanner is an optional message written to connections
+	// rejected due to overload, or an unready backend without a
+	// Fallback, before they are closed.
+	RejectBanner string
+
+	// StartupPolicy determines how routes are started when their
+	// backend can't be dialed, see StartupPolicy. A Route's own
+	// policy, if set, takes the place of this for that route.
+	StartupPolicy StartupPolicy
+
+	// StartupTimeout is the maximum time from route start that conns
+	// are held waiting on an unreachable backend under StartupWait.
+	// If zero, they're held until it can be dialed.
+	StartupTimeout time.Duration
+
+	// Fallback is an optional address to which conns are proxied
+	// while a route's backend has been unreachable since startup.
+	// If empty, such conns are rejected. It only applies at startup:
+	// once the backend has been reached, conns are always proxied to
+	// it, even if it later goes down. A Route's own Fallback, if set,
+	// takes the place of this for that route.
+	Fallback string
+
+	// ACL is an optional access control list checked against the
+	// source address of each accepted connection. A Route's own
+	// ACL, if set, takes the place of this for that route.
+	ACL *ACL
+
+	// Bans is an optional Banlist, checked against the source address
+	// of each accepted connection and fed with abusive client events.
+	Bans *Banlist
+
+	// Metrics is an optional metrics collector, updated with
+	// per-route and per-backend metrics for this proxy.
+	Metrics *Metrics
+
+	// AccessLog is an optional access log sink, to which connection
+	// access records are written in place of the global logger.
+	AccessLog *AccessLog
+
+	// Capture is an optional traffic capture sink, to which both
+	// directions of proxied conns are teed.
+	Capture *Capture
+
+	// Shadow is an optional shadow backend, to which the client -> server
+	// data of a sample of proxied conns is duplicated.
+	Shadow *Shadow
+
+	// Hooks is an optional observer of connection lifecycle events,
+	// which may also deny conns, see Hooks.
+	Hooks Hooks
+
+	// Filters is an optional chain of stream filters, applied to
+	// both directions of every route's conns, see Filter.
+	Filters []Filter
+
+	// RouteErrors is an optional channel to which errors stopping
+	// routes started via StartRoute() are sent. If set, it must be
+	// read from until the proxy is closed.
+	RouteErrors chan<- *RouteError
+
+	lnCfg    Listener        // lnCfg is the set listener config
+	dialer   Dialer          // dialer is the set dialer we use
+	settings atomic.Value    // settings are the current *Settings
+	cancel   func()          // cancel is the proxy context cancel
+	baseCtx  context.Context // baseCtx is the proxy base context
+
+	stopAccept func()          // stopAccept is the accept context cancel
+	acceptCtx  context.Context // acceptCtx is the route accept context
+
+	serveWg sync.WaitGroup // serveWg tracks running serve routines
+	wgMutex sync.Mutex     // wgMutex protects serveWg additions + closed
+	closed  bool           // closed indicates Close() waiting on serveWg
+	doOnce  sync.Once      // doOnce is the proxy init routine protector
+	ppool   sync.Pool      // ppool is the proxy proto buffer pool
+	bpool   sync.Pool      // bpool is the limited copy buffer pool
+	open    int64          // open tracks the no. open proxy connections
+	tarpits int64          // tarpits tracks the no. tarpitted connections
+	queued  int64          // queued tracks the no. connections awaiting a slot
 
 	// 流量统计字段
-	bytesIn  uint64 // 入站流量统计(字节)
-	bytesOut uint64 // 出站流量统计(字节)
-	
-	// 统计锁
-	statsMutex sync.RWMutex
-	
+	totals counters // totals are the proxy traffic counters, across all routes ever run
+	denied uint64   // denied tracks the no. conns denied by ACLs / hooks
+	banned uint64   // banned tracks the no. conns from banned sources
+
+	errMutex sync.Mutex  // errMutex protects errs + errNext
+	errs     []ConnError // errs is the recent conn errors ring
+	errNext  int         // errNext is the next errs ring index
+
+	rtMutex  sync.Mutex               // rtMutex protects routes + backends
+	routes   []*route                 // routes are the proxy's started routes
+	backends map[string]*backendState // backends are the per-backend states
+
 	// 统计定时器
 	statsTimer *time.Timer
+
+	connMutex sync.Mutex           // connMutex protects live
+	live      map[string]*liveConn // live tracks the active conns by ID
+
+	srcMutex sync.Mutex           // srcMutex protects sources + srcConns
+	sources  map[string]*source   // sources tracks per-source-IP buckets
+	srcConns map[string]*srcConns // srcConns tracks per-source conn limits
+}
+
+// Route describes a single proxied listener and its destination, along
+// with any per-route overrides of the TCPProxy settings.
+type Route struct {
+	// Src is the address to listen on.
+	Src string
+
+	// Dst is the address to proxy connections to.
+	Dst string
+
+	// ACL overrides the TCPProxy's ACL for this route, if set.
+	ACL *ACL
+
+	// MaxConns overrides the TCPProxy's MaxConns for this route, if set.
+	MaxConns int
+
+	// Capture overrides the TCPProxy's Capture for this route, if set.
+	Capture *Capture
+
+	// Shadow overrides the TCPProxy's Shadow for this route, if set.
+	Shadow *Shadow
+
+	// Filters are appended to the TCPProxy's Filters for this route.
+	Filters []Filter
+
+	// Startup overrides the TCPProxy's StartupPolicy for this route, if set.
+	Startup StartupPolicy
+
+	// Fallback overrides the TCPProxy's Fallback for this route, if set.
+	Fallback string
+}
+
+// route holds the state shared by all conns on a single proxied listener.
+type route struct {
+	src  string  // src is the listening address
+	dst  string  // dst is the destination address
+	up   *bucket // up is the route upload bucket
+	down *bucket // down is the route download bucket
+
+	slots   *Semaphore // slots limits the route's open conns
+	acl     *ACL       // acl is the route's access control list
+	capture *Capture   // capture is the route's capture sink
+	shadow  *Shadow    // shadow is the route's shadow backend
+	filters []Filter   // filters is the route's filter chain
+
+	fallback  string        // fallback is the route's fallback address
+	unready   int32         // unready indicates the backend is yet to be reached
+	probing   int32         // probing indicates the backend is being probed
+	readyCh   chan struct{} // readyCh is closed once an unready backend is reached
+	checkCh   chan struct{} // checkCh is closed once an unready backend is first dialed
+	wait      bool          // wait indicates conns are held while the backend is unready
+	waitUntil time.Time     // waitUntil is the end of any wait, zero for none
+
+	metrics   *routeMetrics   // metrics are the route metrics
+	backend   *backendMetrics // backend are the route backend metrics
+	fbBackend *backendMetrics // fbBackend are the route fallback backend metrics
+
+	stats   *counters     // stats are the route traffic counters
+	bstats  *backendState // bstats are the (shared) backend state
+	fbStats *backendState // fbStats are the (shared) fallback backend state
+	totals  *counters     // totals are the (shared) proxy traffic counters
+
+	stop context.CancelFunc // stop ends the route's registration, e.g. its ACL watch
+
+	shadowStats shadowCounters // shadowStats are the route shadow counters
+}
+
+// reject updates the route metrics and counters for a rejected conn.
+func (rt *route) reject(reason int) {
+	rt.metrics.reject(reason)
+	rt.stats.addReject()
+	rt.bstats.addReject()
+	rt.totals.addReject()
+}
+
+// addError updates the route counters for a dial / proxying error to target.
+func (rt *route) addError(t target) {
+	rt.stats.addError()
+	t.state.addError()
+	rt.totals.addError()
+}
+
+// target is the backend a conn is proxied to: the route's own backend,
+// or its fallback while the route's backend is unready.
+type target struct {
+	addr    string          // addr is the backend address
+	metrics *backendMetrics // metrics are the backend metrics
+	state   *backendState   // state is the (shared) backend state
+}
+
+// target returns the route's current conn target.
+func (rt *route) target() target {
+	if !rt.ready() && rt.fallback != "" {
+		return target{addr: rt.fallback, metrics: rt.fbBackend, state: rt.fbStats}
+	}
+	return target{addr: rt.dst, metrics: rt.backend, state: rt.bstats}
 }
 
 func (proxy *TCPProxy) init() {
@@ -80,13 +366,29 @@ func (proxy *TCPProxy) init() {
 			proxy.Name = "proxy"
 		}
 
-		// Setup the listener cfg and dialer
-		proxy.lnCfg = net.ListenConfig{
-			KeepAlive: proxy.ClientKeepAlive,
+		// Load the initial updatable settings
+		proxy.settings.Store(&Settings{
+			ClientTimeout:   proxy.ClientTimeout,
+			ServerTimeout:   proxy.ServerTimeout,
+			ClientKeepAlive: proxy.ClientKeepAlive,
+			ServerKeepAlive: proxy.ServerKeepAlive,
+			DrainIdle:       proxy.DrainIdle,
+		})
+
+		// Setup the listener cfg and dialer, with
+		// keep-alives set per conn from settings
+		proxy.lnCfg = proxy.Listener
+		if proxy.lnCfg == nil {
+			proxy.lnCfg = &net.ListenConfig{
+				KeepAlive: -1,
+			}
 		}
-		proxy.dialer = net.Dialer{
-			KeepAlive: proxy.ServerKeepAlive,
-			Timeout:   proxy.DialTimeout,
+		proxy.dialer = proxy.Dialer
+		if proxy.dialer == nil {
+			proxy.dialer = &net.Dialer{
+				KeepAlive: -1,
+				Timeout:   proxy.DialTimeout,
+			}
 		}
 
 		// Setup proxy proto buffer pool
@@ -95,14 +397,64 @@ func (proxy *TCPProxy) init() {
 			return make([]byte, 0, 107)
 		}
 
+		// Setup limited copy buffer pool
+		proxy.bpool.New = func() interface{} {
+			return make([]byte, 32*1024)
+		}
+
 		// Setup proxy base context
 		proxy.baseCtx, proxy.cancel = context.WithCancel(context.Background())
+		proxy.acceptCtx, proxy.stopAccept = context.WithCancel(proxy.baseCtx)
+
+		// Start stats timer
+		proxy.startStatsTimer()
 	})
 }
 
+// Update atomically replaces the proxy's updatable settings, e.g. on a
+// configuration reload. Changes apply to conns accepted from then on,
+// open conns keeping the settings they were accepted with, except for
+// DrainIdle which applies to any (following) Shutdown().
+func (proxy *TCPProxy) Update(s Settings) {
+	proxy.init()
+	proxy.settings.Store(&s)
+}
+
+// current returns the current updatable settings.
+func (proxy *TCPProxy) current() *Settings {
+	return proxy.settings.Load().(*Settings)
+}
+
+// setKeepAlive applies keep-alive period d to conn as net.ListenConfig and
+// net.Dialer would, i.e. a default period if zero, disabled if negative.
+// Non-TCP conns are ignored.
+func setKeepAlive(conn net.Conn, d time.Duration) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	} else if d < 0 {
+		_ = tc.SetKeepAlive(false)
+		return
+	} else if d == 0 {
+		d = defaultKeepAlive
+	}
+	_ = tc.SetKeepAlive(true)
+	_ = tc.SetKeepAlivePeriod(d)
+}
+
 // dial dials a TCP connection to supplied address
 func (proxy *TCPProxy) dial(dst string) (net.Conn, error) {
-	return proxy.dialer.DialContext(proxy.baseCtx, "tcp", dst)
+	ctx := proxy.baseCtx
+	if proxy.DialTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, proxy.DialTimeout)
+		defer cancel()
+	}
+	conn, err := proxy.dialer.DialContext(ctx, "tcp", dst)
+	if err == nil && proxy.Dialer == nil {
+		setKeepAlive(conn, proxy.current().ServerKeepAlive)
+	}
+	return conn, err
 }
 
 // listen starts a TCP listener on on supplied address
@@ -110,44 +462,259 @@ func (proxy *TCPProxy) listen(src string) (net.Listener, error) {
 	return proxy.lnCfg.Listen(proxy.baseCtx, "tcp", src)
 }
 
-// Close closes the TCPProxy, waiting for all serve routines to finish
+// Close closes the TCPProxy, forcibly closing all open conns and waiting
+// for all serve routines to finish
 func (proxy *TCPProxy) Close() {
+	proxy.init()
 	proxy.cancel()
+
+	// Prevent new serve routines
+	proxy.wgMutex.Lock()
+	proxy.closed = true
+	proxy.wgMutex.Unlock()
+
 	proxy.serveWg.Wait()
 }
 
+// addServe starts tracking a serve routine, returning false if the proxy is
+// closed. Routines started from within a tracked routine may serveWg.Add().
+func (proxy *TCPProxy) addServe() bool {
+	proxy.wgMutex.Lock()
+	defer proxy.wgMutex.Unlock()
+	if proxy.closed {
+		return false
+	}
+	proxy.serveWg.Add(1)
+	return true
+}
+
+// Shutdown gracefully shuts down the TCPProxy, first closing all route
+// listeners, then waiting for open conns to finish until ctx is done, at
+// which point any remaining conns are forcibly closed as by Close(). If
+// DrainIdle is set, conns idle for that long while draining are half-closed,
+// signalling EOF to the backend. The no. remaining conns is logged periodically.
+// Returns ctx.Err() if conns were forcibly closed
+func (proxy *TCPProxy) Shutdown(ctx context.Context) error {
+	proxy.init()
+	proxy.stopAccept()
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	lastLog := time.Now()
+	for {
+		open := atomic.LoadInt64(&proxy.open)
+		if open == 0 {
+			proxy.Close()
+			return nil
+		}
+
+		if time.Since(lastLog) >= drainLogInterval {
+			lastLog = time.Now()
+			log.InfoKVs(kv.Fields{
+				{K: "proxy", V: proxy.Name},
+				{K: "remaining", V: open},
+				{K: "msg", V: "draining connections"},
+			}...)
+		}
+
+		if idle := proxy.current().DrainIdle; idle > 0 {
+			if n := proxy.halfCloseIdle(idle); n > 0 {
+				log.InfoKVs(kv.Fields{
+					{K: "proxy", V: proxy.Name},
+					{K: "count", V: n},
+					{K: "msg", V: "half-closed idle connections"},
+				}...)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.InfoKVs(kv.Fields{
+				{K: "proxy", V: proxy.Name},
+				{K: "remaining", V: atomic.LoadInt64(&proxy.open)},
+				{K: "msg", V: "drain timeout, closing remaining connections"},
+			}...)
+			proxy.Close()
+			return ctx.Err()
+		}
+	}
+}
+
 // Proxy starts a proxy handler listening on the supplied src address, and
 // proxying it to the supplied dst address
 func (proxy *TCPProxy) Proxy(src string, dst string) error {
-	// Ensure initialized
-	proxy.init()
+	return proxy.ProxyRoute(Route{Src: src, Dst: dst})
+}
 
-	// Start stats timer
-	proxy.startStatsTimer()
+// ProxyRoute starts a proxy handler for the supplied route, applying any
+// per-route overrides of the TCPProxy settings
+func (proxy *TCPProxy) ProxyRoute(r Route) error {
+	return proxy.ProxyRouteContext(context.Background(), r)
+}
 
-	// Ensure we can dial-out
-	conn, err := proxy.dial(dst)
-	if err != nil {
-		return err
+// Serve starts a proxy handler accepting conns on the supplied listener,
+// and proxying them to the supplied dst address. The listener is closed
+// on return
+func (proxy *TCPProxy) Serve(ln net.Listener, dst string) error {
+	return proxy.ServeRoute(ln, Route{Dst: dst})
+}
+
+// ServeRoute starts a proxy handler for the supplied route, accepting conns
+// on the supplied listener in place of listening on the route's Src, which
+// if empty is set from the listener address. The listener is closed on return
+func (proxy *TCPProxy) ServeRoute(ln net.Listener, r Route) error {
+	if r.Src == "" {
+		r.Src = ln.Addr().String()
 	}
-	err = conn.Close()
+
+	// Setup route state
+	rt, err := proxy.newRoute(r)
 	if err != nil {
+		ln.Close()
 		return err
 	}
 
-	// Start TCP listener
-	ln, err := proxy.listen(src)
-	if err != nil {
-		return err
+	defer proxy.removeRoute(rt)
+	return proxy.accept(context.Background(), ln, rt)
+}
+
+// newRoute checks the supplied route's destination can be dialed, as
+// per its startup policy, returning the registered route state. Under
+// non-strict policies the backend is instead checked, waited on and
+// probed in the background, see probe()
+func (proxy *TCPProxy) newRoute(r Route) (*route, error) {
+	// Ensure initialized
+	proxy.init()
+
+	// Ensure we can dial-out
+	ready := true
+	policy := proxy.startupPolicy(r)
+	switch policy {
+	case StartupLazy, StartupWait:
+		ready = false
+	default:
+		if err := proxy.checkBackend(r); err != nil {
+			return nil, err
+		}
 	}
-	defer ln.Close()
 
-	for {
-		// Break-out on close
+	// Setup route state
+	rt := &route{
+		src:   r.Src,
+		dst:   r.Dst,
+		up:    newBucket(proxy.RouteLimits.Upload),
+		down:  newBucket(proxy.RouteLimits.Download),
+		slots: NewSemaphore(proxy.MaxConns),
+		acl:   proxy.ACL,
+
+		capture: proxy.Capture,
+		shadow:  proxy.Shadow,
+		totals:  &proxy.totals,
+
+		fallback: proxy.Fallback,
+
+		metrics: proxy.Metrics.route(proxy.Name, r.Src),
+		backend: proxy.Metrics.backend(proxy.Name, r.Src, r.Dst),
+	}
+	if r.MaxConns > 0 {
+		rt.slots = NewSemaphore(r.MaxConns)
+	}
+	if r.ACL != nil {
+		rt.acl = r.ACL
+	}
+	if r.Capture != nil {
+		rt.capture = r.Capture
+	}
+	if r.Shadow != nil {
+		rt.shadow = r.Shadow
+	}
+	if len(proxy.Filters)+len(r.Filters) > 0 {
+		rt.filters = append(rt.filters, proxy.Filters...)
+		rt.filters = append(rt.filters, r.Filters...)
+	}
+	if r.Fallback != "" {
+		rt.fallback = r.Fallback
+	}
+	if rt.fallback != "" {
+		rt.fbBackend = proxy.Metrics.backend(proxy.Name, r.Src, rt.fallback)
+	}
+	if !ready {
+		rt.unready = 1
+		rt.readyCh = make(chan struct{})
+		rt.checkCh = make(chan struct{})
+		if policy == StartupWait {
+			rt.wait = true
+			if proxy.StartupTimeout > 0 {
+				rt.waitUntil = time.Now().Add(proxy.StartupTimeout)
+			}
+		}
+	}
+
+	// Ensure ACL loaded
+	if rt.acl != nil {
+		if _, ok := rt.acl.trie.Load().(*aclTrie); !ok {
+			if err := rt.acl.Load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Register route for stats,
+	// watching its ACL meanwhile
+	proxy.addRoute(rt)
+	proxy.probe(rt)
+
+	return rt, nil
+}
+
+// accept accepts conns on the supplied listener for route until the proxy
+// is closed, ctx is cancelled or an accept error occurs, closing listener
+func (proxy *TCPProxy) accept(ctx context.Context, ln net.Listener, rt *route) error {
+	// Close listener on return, proxy shutdown or cancel,
+	// waiting on it to be closed before returning
+	actx, cancel := context.WithCancel(ctx)
+	lnClosed := make(chan struct{})
+	defer func() {
+		cancel()
+		<-lnClosed
+	}()
+	go func() {
+		defer close(lnClosed)
+		select {
+		case <-proxy.acceptCtx.Done():
+			cancel()
+		case <-actx.Done():
+		}
+		ln.Close()
+	}()
+
+	// closed returns the error for a shutdown proxy / cancelled
+	// ctx if either the case, else nil
+	closed := func() error {
 		select {
-		case <-proxy.baseCtx.Done():
+		case <-proxy.acceptCtx.Done():
 			return ErrProxyClosed
 		default:
+			return ctx.Err()
+		}
+	}
+
+	for {
+		// Break-out on close
+		if err := closed(); err != nil {
+			return err
+		}
+
+		// Under backpressure, wait on a free
+		// conn slot before accepting the next
+		backpressure := (proxy.OverloadMode == OverloadBackpressure)
+		if backpressure && !proxy.acquireSlots(actx, rt, -1) {
+			if err := closed(); err != nil {
+				return err
+			}
+			return ErrProxyClosed
 		}
 
 		// Define pre-loop
@@ -159,6 +726,14 @@ func (proxy *TCPProxy) Proxy(src string, dst string) error {
 			// Accept next connection
 			conn, err = ln.Accept()
 			if err != nil {
+				if err := closed(); err != nil {
+					// Listener closed by us
+					if backpressure {
+						proxy.releaseSlots(rt)
+					}
+					return err
+				}
+
 				// Check for temporary errors
 				if nErr, ok := err.(net.Error); ok && nErr.Temporary() {
 					log.ErrorKVs(kv.Fields{
@@ -170,6 +745,10 @@ func (proxy *TCPProxy) Proxy(src string, dst string) error {
 					continue inner
 				}
 
+				if backpressure {
+					proxy.releaseSlots(rt)
+				}
+
 				if errors.Is(err, io.EOF) {
 					// EOF is NOT an error
 					err = nil
@@ -189,19 +768,180 @@ func (proxy *TCPProxy) Proxy(src string, dst string) error {
 			break inner
 		}
 
+		// Update accepted metrics
+		rt.metrics.accept()
+		if proxy.Listener == nil {
+			setKeepAlive(conn, proxy.current().ClientKeepAlive)
+		}
+
+		// Check conn is allowed and within limits
+		key, ok := proxy.admit(conn, rt)
+		if !ok {
+			if backpressure {
+				proxy.releaseSlots(rt)
+			}
+			continue
+		}
+
 		// Start tracking serve routine
-		proxy.serveWg.Add(1)
-		atomic.AddInt64(&proxy.open, 1)
+		if !proxy.addServe() {
+			conn.Close()
+			proxy.releaseConn(key)
+			if backpressure {
+				proxy.releaseSlots(rt)
+			}
+			return ErrProxyClosed
+		}
+
+		if backpressure {
+			// Serve this connection
+			go proxy.serve(conn, rt, key)
+		} else {
+			// Queue this connection
+			go proxy.queue(conn, rt, key)
+		}
+	}
+}
+
+// admit checks an accepted conn against the route's ACL and the per-source
+// connection limits, returning the tracked source key and whether the conn
+// was admitted. Conns not admitted will already have been closed / rejected
+func (proxy *TCPProxy) admit(conn net.Conn, rt *route) (string, bool) {
+	ip := sourceIP(conn.RemoteAddr())
+
+	// Drop banned sources
+	if proxy.Bans.Banned(ip) {
+		atomic.AddUint64(&proxy.banned, 1)
+		rt.reject(rejectBanned)
+		conn.Close()
+		return "", false
+	}
+
+	// Check access control list
+	if !rt.acl.Allowed(ip) {
+		atomic.AddUint64(&proxy.denied, 1)
+		rt.reject(rejectACL)
+		proxy.Bans.Record(ip, EventACLDenied)
+		log.InfoKVs(kv.Fields{
+			{K: "proxy", V: proxy.Name},
+			{K: "src", V: ip.String()},
+			{K: "route", V: rt.src},
+			{K: "msg", V: "access denied"},
+		}...)
+		conn.Close()
+		return "", false
+	}
+
+	// Drop conns to draining backend
+	if rt.target().state.draining() {
+		rt.reject(rejectDrain)
+		conn.Close()
+		return "", false
+	}
+
+	// Reject conns to unready backend without fallback
+	if !rt.ready() && rt.fallback == "" && !rt.waiting() {
+		rt.reject(rejectUnready)
+		proxy.rejectBanner(conn)
+		return "", false
+	}
 
-		// Serve this connection
-		go proxy.serve(conn, dst)
+	// Check per-source connection limits
+	key, ok := proxy.acquireConn(conn)
+	if !ok {
+		rt.reject(rejectLimit)
+		proxy.Bans.Record(ip, EventLimitBreached)
+		proxy.reject(conn)
+		return "", false
 	}
+
+	return key, true
 }
 
 // serve is the main proxy routine that manages serving data between conns
-func (proxy *TCPProxy) serve(sConn net.Conn, dst string) {
+func (proxy *TCPProxy) serve(sConn net.Conn, rt *route, key string) {
+	// Count as open from here, i.e. also while held
+	atomic.AddInt64(&proxy.open, 1)
+
+	// Hold conns while waiting on an unready backend,
+	// rejecting those left unready without a fallback
+	if !proxy.awaitReady(rt) && rt.fallback == "" {
+		rt.reject(rejectUnready)
+		proxy.rejectBanner(sConn)
+		proxy.releaseSlots(rt)
+		proxy.releaseConn(key)
+		atomic.AddInt64(&proxy.open, -1)
+		proxy.serveWg.Done()
+		return
+	}
+
+	// Serve fallback while backend unready
+	t := rt.target()
+	dst := t.addr
+
+	// Prepare the conn access record
+	rec := AccessRecord{
+		ID:       newConnID(),
+		Proxy:    proxy.Name,
+		Src:      sConn.RemoteAddr().String(),
+		Listener: rt.src,
+		Backend:  dst,
+		Start:    time.Now(),
+		Closer:   CloserProxy,
+	}
+
+	// Register in the active conn registry
+	lc := &liveConn{
+		id:       rec.ID,
+		src:      rec.Src,
+		listener: rec.Listener,
+		start:    rec.Start,
+		backend:  rec.Backend,
+		sConn:    sConn,
+	}
+
+	// Check conn allowed by hooks
+	if proxy.Hooks != nil && !proxy.Hooks.OnAccept(lc.snapshot(proxy.Name)) {
+		atomic.AddUint64(&proxy.denied, 1)
+		rt.reject(rejectHook)
+		log.InfoKVs(kv.Fields{
+			{K: "proxy", V: proxy.Name},
+			{K: "id", V: rec.ID},
+			{K: "src", V: rec.Src},
+			{K: "route", V: rt.src},
+			{K: "msg", V: "access denied by hook"},
+		}...)
+		sConn.Close()
+		proxy.releaseSlots(rt)
+		proxy.releaseConn(key)
+		atomic.AddInt64(&proxy.open, -1)
+		proxy.serveWg.Done()
+		return
+	}
+
+	proxy.track(lc)
+	var err error
+
+	rt.stats.openConn()
+	t.state.openConn()
+	rt.totals.openConn()
+	t.metrics.open()
 	defer func() {
+		// Emit the access record
+		rec.End = time.Now()
+		proxy.logAccess(&rec)
+		if proxy.Hooks != nil {
+			proxy.Hooks.OnClose(rec, err)
+		}
+
 		// Untrack serve routine
+		proxy.untrack(lc)
+		t.metrics.close(rec.Duration())
+		rt.stats.closeConn()
+		t.state.closeConn()
+		rt.totals.closeConn()
+		proxy.releaseSlots(rt)
+		proxy.releaseConn(key)
 		atomic.AddInt64(&proxy.open, -1)
 		proxy.serveWg.Done()
 	}()
@@ -212,33 +952,48 @@ func (proxy *TCPProxy) serve(sConn net.Conn, dst string) {
 	//       but read has closed
 
 	// Dial-out to destination address
+	if proxy.Hooks != nil {
+		proxy.Hooks.OnDial(lc.snapshot(proxy.Name), dst)
+	}
 	dConn, err := proxy.dial(dst)
+	t.metrics.dial(time.Since(rec.Start), err)
 	if err != nil {
-		log.ErrorKVs(kv.Fields{
-			{K: "proxy", V: proxy.Name},
-			{K: "error", V: err},
-			{K: "msg", V: "dial error"},
-		}...)
+		rec.Reason = ReasonDial
+		sConn.Close()
+		proxy.connError(rt, t, rec.ID, "dial error", err)
 		return
 	}
 
-	// Cast our connections and addrs
-	dTCPConn := dConn.(*net.TCPConn)
-	sTCPConn := sConn.(*net.TCPConn)
-	dTCPAddr := dTCPConn.RemoteAddr().(*net.TCPAddr)
-	sTCPAddr := sTCPConn.RemoteAddr().(*net.TCPAddr)
+	// Attach backend conn, unless killed
+	if !lc.attach(dConn) {
+		rec.Reason = ReasonKilled
+		return
+	}
+
+	// Resolve our connection addrs
+	dTCPAddr := tcpAddr(dConn.RemoteAddr())
+	sTCPAddr := tcpAddr(sConn.RemoteAddr())
+	srcAddr := sourceIP(sConn.RemoteAddr())
 	srcIP := sTCPAddr.IP.String()
 	dstIP := dTCPAddr.IP.String()
 	dstPort := strconv.Itoa(dTCPAddr.Port)
+	rec.Backend = dConn.RemoteAddr().String()
 
 	// Log proxying
 	log.InfoKVs(kv.Fields{
 		// {K: "proxy", V: proxy.Name},
+		{K: "id", V: rec.ID},
 		{K: "count", V: atomic.LoadInt64(&proxy.open)},
 		{K: "src", V: srcIP},
 		{K: "dst", V: dstIP + ":" + dstPort},
 	}...)
 
+	// Start shadowing if enabled for conn
+	sc := proxy.openShadow(rt, rec.ID)
+	if sc != nil {
+		defer sc.close()
+	}
+
 	// Set proxy header if required
 	if proxy.ProxyProto {
 		// Acquire header buffer
@@ -250,119 +1005,252 @@ func (proxy *TCPProxy) serve(sConn net.Conn, dst string) {
 
 		// Append protocol version
 		hdr = append(hdr, `PROXY `...)
-		if isIPv4(sTCPAddr.IP) {
+		unknown := sTCPAddr.IP.IsUnspecified() || dTCPAddr.IP.IsUnspecified()
+		switch {
+		case unknown:
+			// Non-IP transport addresses
+			hdr = append(hdr, `UNKNOWN`...)
+		case isIPv4(sTCPAddr.IP):
 			hdr = append(hdr, `TCP4 `...)
-		} else {
+		default:
 			hdr = append(hdr, `TCP6 `...)
 		}
 
-		// Append src + dst addresses
-		hdr = append(hdr, srcIP...)
-		hdr = append(hdr, ' ')
-		hdr = append(hdr, dstIP...)
-		hdr = append(hdr, ' ')
+		if !unknown {
+			// Append src + dst addresses
+			hdr = append(hdr, srcIP...)
+			hdr = append(hdr, ' ')
+			hdr = append(hdr, dstIP...)
+			hdr = append(hdr, ' ')
+
+			// Append src + dst ports
+			hdr = strconv.AppendInt(hdr, int64(sTCPAddr.Port), 10)
+			hdr = append(hdr, ' ')
+			hdr = append(hdr, dstPort...)
+		}
 
-		// Append src + dst ports, then final CRLF
-		hdr = strconv.AppendInt(hdr, int64(sTCPAddr.Port), 10)
-		hdr = append(hdr, ' ')
-		hdr = append(hdr, dstPort...)
+		// Append final CRLF
 		hdr = append(hdr, '\r', '\n')
 
 		// Finally write proxy header
-		_, err := dTCPConn.Write(hdr)
+		_, err = dConn.Write(hdr)
 		if err != nil {
-			log.ErrorKVs(kv.Fields{
-				{K: "proxy", V: proxy.Name},
-				{K: "error", V: err},
-				{K: "msg", V: "output error"},
-			}...)
+			rec.Closer = CloserServer
+			rec.Reason = closeReason(err)
+			dConn.Close()
+			sConn.Close()
+			proxy.connError(rt, t, rec.ID, "output error", err)
 			return
 		}
+
+		if sc != nil {
+			// Shadow receives same header
+			sc.tap(hdr)
+		}
 	}
 
 	// Setup error channels
 	errIn := make(chan error, 1)
 	errOut := make(chan error, 1)
 
-	// Prepare the timeout-setting functions
-	clientTimeout := timeoutFunc(proxy.ClientTimeout, sTCPConn.SetReadDeadline)
-	serverTimeout := timeoutFunc(proxy.ServerTimeout, sTCPConn.SetWriteDeadline)
+	// Fetch shared source-IP bandwidth buckets
+	srcState := proxy.acquireSource(srcAddr)
+	defer proxy.releaseSource(srcAddr)
+
+	// Prepare the bandwidth limiters for each direction
+	upLimit := newLimiter(newBucket(proxy.ConnLimits.Upload), srcState.up, rt.up)
+	downLimit := newLimiter(newBucket(proxy.ConnLimits.Download), srcState.down, rt.down)
+
+	connected := time.Now()
+
+	// Prepare the byte counting functions
+	countIn := func(n int64) {
+		atomic.AddUint64(&lc.nIn, uint64(n))
+		atomic.StoreInt64(&lc.last, time.Now().UnixNano())
+		t.metrics.addBytesIn(n)
+		rt.stats.addBytesIn(n)
+		t.state.addBytesIn(n)
+		rt.totals.addBytesIn(n)
+	}
+	countOut := func(n int64) {
+		atomic.AddUint64(&lc.nOut, uint64(n))
+		atomic.StoreInt64(&lc.last, time.Now().UnixNano())
+		t.metrics.addBytesOut(n)
+		rt.stats.addBytesOut(n)
+		t.state.addBytesOut(n)
+		rt.totals.addBytesOut(n)
+	}
+	if hooks := proxy.Hooks; hooks != nil {
+		hooks.OnConnected(lc.snapshot(proxy.Name))
+
+		// Pass byte counts on to hooks
+		in, out := countIn, countOut
+		countIn = func(n int64) {
+			in(n)
+			hooks.OnBytes(lc.snapshot(proxy.Name), n, 0)
+		}
+		countOut = func(n int64) {
+			out(n)
+			hooks.OnBytes(lc.snapshot(proxy.Name), 0, n)
+		}
+	}
+
+	// Start capture if enabled for conn
+	var tapIn, tapOut func([]byte)
+	if cc := rt.capture.open(proxy.Name, rec.ID, sTCPAddr, dTCPAddr, &proxy.serveWg); cc != nil {
+		defer cc.close()
+		tapIn = func(b []byte) { cc.tap(true, b) }
+		tapOut = func(b []byte) { cc.tap(false, b) }
+	}
+	if sc != nil {
+		tapIn = joinTaps(tapIn, sc.tap)
+	}
+
+	// Build filter chains if route filtered
+	var filterIn, filterOut *filterChain
+	if len(rt.filters) > 0 {
+		conn := lc.snapshot(proxy.Name)
+		filterIn = newFilterChain(rt.filters, conn, ClientToServer, dConn)
+		filterOut = newFilterChain(rt.filters, conn, ServerToClient, sConn)
+	}
 
 	// Start handling proxying
-	go copyConn(dTCPConn, sTCPConn, errIn, clientTimeout, proxy, true)
-	go copyConn(sTCPConn, dTCPConn, errOut, serverTimeout, proxy, false)
+	set := proxy.current()
+	go copyConn(dConn, sConn, errIn, set.ClientTimeout, upLimit, tapIn, filterIn, proxy, countIn)
+	go copyConn(sConn, dConn, errOut, set.ServerTimeout, downLimit, tapOut, filterOut, proxy, countOut)
 
 	select {
 	// Wait on input error
-	case err := <-errIn:
-		if err != nil {
-			log.ErrorKVs(kv.Fields{
-				{K: "proxy", V: proxy.Name},
-				{K: "error", V: err},
-				{K: "msg", V: "input error"},
-			}...)
+	case err = <-errIn:
+		rec.Closer = CloserClient
+		if err == nil && atomic.LoadUint64(&lc.nIn) == 0 && !lc.isKilled() {
+			// Client closed before sending anything
+			proxy.Bans.Record(srcAddr, EventEmptyConn)
+		}
+		if err != nil && err != errIdleTimeout && !errors.Is(err, ErrBlocked) {
+			proxy.connError(rt, t, rec.ID, "input error", err)
 		}
 
 	// Wait on output error
-	case err := <-errOut:
-		if err != nil {
-			log.ErrorKVs(kv.Fields{
-				{K: "proxy", V: proxy.Name},
-				{K: "error", V: err},
-				{K: "msg", V: "output error"},
-			}...)
+	case err = <-errOut:
+		rec.Closer = CloserServer
+		if errors.Is(err, syscall.ECONNRESET) && time.Since(connected) < time.Second {
+			// Backend reset shortly after connect
+			proxy.Bans.Record(srcAddr, EventBackendReset)
+		}
+		if err != nil && err != errIdleTimeout && !errors.Is(err, ErrBlocked) {
+			proxy.connError(rt, t, rec.ID, "output error", err)
 		}
 
 	// Server ctx cancelled
 	case <-proxy.baseCtx.Done():
-		dTCPConn.Close()
-		sTCPConn.Close()
+		err = ErrProxyClosed
+		dConn.Close()
+		sConn.Close()
+	}
+
+	// Wait on both directions to
+	// finish so byte counts are final
+	proxy.wait(dConn, sConn, errIn, errOut)
+	rec.Reason = closeReason(err)
+	rec.BytesIn = atomic.LoadUint64(&lc.nIn)
+	rec.BytesOut = atomic.LoadUint64(&lc.nOut)
+	if lc.isKilled() {
+		rec.Closer = CloserProxy
+		rec.Reason = ReasonKilled
+	} else if errors.Is(err, ErrBlocked) {
+		rec.Closer = CloserProxy
+	}
+}
+
+// wait waits on the supplied copyConn error channels to be closed, forcibly
+// closing both conns if the proxy is closed in the meantime
+func (proxy *TCPProxy) wait(dConn net.Conn, sConn net.Conn, errIn, errOut chan error) {
+	done := proxy.baseCtx.Done()
+	for errIn != nil || errOut != nil {
+		select {
+		case _, ok := <-errIn:
+			if !ok {
+				errIn = nil
+			}
+		case _, ok := <-errOut:
+			if !ok {
+				errOut = nil
+			}
+		case <-done:
+			dConn.Close()
+			sConn.Close()
+			done = nil
+		}
 	}
 }
 
-// copyConn copies from once TCPConn to another, using TCPConn's ReadFrom implementation
-// to take advantage of the splice optimization. this also handles connection timeouts
-func copyConn(dst *net.TCPConn, src *net.TCPConn, errChan chan error, setTimeout func(), proxy *TCPProxy, isClientToServer bool) {
+// copyConn copies from one conn to another, using TCPConn's ReadFrom implementation (for TCP
+// conns) to take advantage of the splice optimization. this also handles connection timeouts.
+// If a bandwidth limiter, capture / shadow tap or filter chain is supplied, the data must pass
+// through userspace, so a pooled-buffer copy loop is used instead, writing via the filter chain
+// if set. This costs a copy in and out of the buffer per read, hence these features are only
+// enabled per route where configured. Taps are expected not to block, queueing the data for
+// elsewhere. The copy is interrupted by read deadline every countInterval, so that count() is
+// called with the bytes copied so far even on long-lived connections
+func copyConn(dst net.Conn, src net.Conn, errChan chan error, idle time.Duration, limit limiter, tap func([]byte), filter *filterChain, proxy *TCPProxy, count func(int64)) {
 	defer func() {
 		// Ensure dst conn and error chan
 		// closed on function close (even panic)
 		close(errChan)
+		if filter != nil {
+			_ = filter.Close()
+		}
 		dst.Close()
 	}()
 
+	// Writer to copy to
+	var w io.Writer = dst
+	if filter != nil {
+		w = filter
+	}
+
+	// Time of last data transfer
+	last := time.Now()
+
 	for {
-		// Set timeout
-		setTimeout()
+		// Set read deadline at the next count
+		// interval, or idle timeout if sooner
+		deadline := time.Now().Add(countInterval)
+		if idle > 0 && last.Add(idle).Before(deadline) {
+			deadline = last.Add(idle)
+		}
+		src.SetReadDeadline(deadline)
 
 		// Copy from source to destination
-		n, err := dst.ReadFrom(src)
-		if err == nil || err == io.EOF || err == net.ErrClosed {
-			// 统计流量
-			if isClientToServer {
-				proxy.addBytesIn(n)
-			} else {
-				proxy.addBytesOut(n)
-			}
-			
+		var n int64
+		var err error
+		if tcp, ok := dst.(*net.TCPConn); ok && len(limit) == 0 && tap == nil && filter == nil {
+			n, err = tcp.ReadFrom(src)
+		} else {
+			n, err = proxy.copyLimited(w, src, limit, tap)
+		}
+
+		// 统计流量
+		if n > 0 {
+			last = time.Now()
+			count(n)
+		}
+
+		if err == nil || err == io.EOF || errors.Is(err, net.ErrClosed) || err == io.ErrClosedPipe {
 			// EOF / conn close -- no error
 			break
 		}
 
 		// Timeouts are expected. This indicates we
-		// should check the data transfer-rate
+		// should count, and check for idle timeout
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			if n < 1 {
+			if idle > 0 && time.Since(last) >= idle {
+				errChan <- errIdleTimeout
 				break
 			}
 
-			// 统计流量
-			if isClientToServer {
-				proxy.addBytesIn(n)
-			} else {
-				proxy.addBytesOut(n)
-			}
-
-			// Rate is acceptable, keep-going
+			// Not idle, keep-going
 			continue
 		}
 
@@ -371,13 +1259,44 @@ func copyConn(dst *net.TCPConn, src *net.TCPConn, errChan chan error, setTimeout
 	}
 }
 
-// timeoutFunc returns a valid timeout function for copyConn() only if d > 0.
-func timeoutFunc(d time.Duration, fn func(time.Time) error) func() {
-	if d < 1 {
-		return func() {}
-	}
-	return func() {
-		fn(time.Now().Add(d))
+// copyLimited copies from src to dst using a pooled buffer, waiting on the supplied
+// bandwidth limiter between reads, and passing read data to tap if set before it is
+// written (i.e. unfiltered). Return semantics match those of ReadFrom()
+func (proxy *TCPProxy) copyLimited(dst io.Writer, src io.Reader, limit limiter, tap func([]byte)) (int64, error) {
+	// Acquire copy buffer
+	buf := proxy.bpool.Get().([]byte)
+	defer proxy.bpool.Put(buf)
+
+	// Limit reads to within bucket sizes
+	buf = buf[:limit.chunk(len(buf))]
+
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			// Wait on available bandwidth
+			if err := limit.wait(proxy.baseCtx, int64(n)); err != nil {
+				return total, net.ErrClosed
+			}
+
+			// Pass the chunk to tap as read,
+			// before any filter may modify it
+			if tap != nil {
+				tap(buf[:n])
+			}
+
+			// Write the read chunk to destination
+			n, err := dst.Write(buf[:n])
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
 	}
 }
 
@@ -397,30 +1316,6 @@ func isZeros(ip net.IP) bool {
 	return true
 }
 
-// addBytesIn 增加入站流量统计
-func (proxy *TCPProxy) addBytesIn(n int64) {
-	proxy.statsMutex.Lock()
-	proxy.bytesIn += uint64(n)
-	proxy.statsMutex.Unlock()
-}
-
-// addBytesOut 增加出站流量统计
-func (proxy *TCPProxy) addBytesOut(n int64) {
-	proxy.statsMutex.Lock()
-	proxy.bytesOut += uint64(n)
-	proxy.statsMutex.Unlock()
-}
-
-// getStats 获取当前统计信息
-func (proxy *TCPProxy) getStats() (bytesIn uint64, bytesOut uint64, connections int64) {
-	proxy.statsMutex.RLock()
-	bytesIn = proxy.bytesIn
-	bytesOut = proxy.bytesOut
-	connections = atomic.LoadInt64(&proxy.open)
-	proxy.statsMutex.RUnlock()
-	return
-}
-
 // formatBytes 格式化字节数为人类可读格式
 func formatBytes(bytes uint64) string {
 	const unit = 1024
@@ -447,14 +1342,24 @@ func (proxy *TCPProxy) startStatsTimer() {
 				}
 				return
 			case <-proxy.statsTimer.C:
-				bytesIn, bytesOut, conns := proxy.getStats()
+				stats := proxy.Stats()
 				log.InfoKVs(kv.Fields{
 					{K: "proxy", V: proxy.Name},
-					{K: "bytes_in", V: formatBytes(bytesIn)},
-					{K: "bytes_out", V: formatBytes(bytesOut)},
-					{K: "active_connections", V: conns},
+					{K: "bytes_in", V: formatBytes(stats.BytesIn)},
+					{K: "bytes_out", V: formatBytes(stats.BytesOut)},
+					{K: "active_connections", V: stats.Open},
+					{K: "total_connections", V: stats.Conns},
+					{K: "errors", V: stats.Errors},
+					{K: "rejected_connections", V: stats.Rejected},
+					{K: "denied_connections", V: stats.Denied},
+					{K: "banned_connections", V: stats.Banned},
 					{K: "msg", V: "stats"},
 				}...)
+
+				// Drop stale source limit + ban states
+				proxy.sweepConns()
+				proxy.sweepSources()
+				proxy.Bans.sweep()
 				proxy.statsTimer.Reset(time.Minute)
 			}
 		}
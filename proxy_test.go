@@ -0,0 +1,106 @@
+package tcpee
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns a connected pair of loopback TCP conns.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() { c1.Close(); c2.Close() })
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+// benchmarkCopy benchmarks copying b.N chunks between loopback TCP conns
+// client -> src, dst -> server via copy.
+func benchmarkCopy(b *testing.B, copy func(dst, src *net.TCPConn)) {
+	const chunk = 32 * 1024
+
+	client, src := tcpPair(b)
+	dst, server := tcpPair(b)
+
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		buf := make([]byte, chunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(buf); err != nil {
+				return
+			}
+		}
+		_ = client.CloseWrite()
+	}()
+
+	done := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, server)
+		done <- n
+	}()
+
+	copy(dst, src)
+	_ = dst.CloseWrite()
+
+	if n := <-done; n != int64(b.N)*chunk {
+		b.Fatalf("copied %d bytes, expected %d", n, int64(b.N)*chunk)
+	}
+}
+
+// BenchmarkCopyConn compares the overhead of copyConn's periodic byte
+// counting against splicing until EOF, as well as the buffered path.
+func BenchmarkCopyConn(b *testing.B) {
+	proxy := &TCPProxy{}
+	proxy.init()
+	defer proxy.Close()
+
+	b.Run("splice", func(b *testing.B) {
+		benchmarkCopy(b, func(dst, src *net.TCPConn) {
+			_, _ = dst.ReadFrom(src)
+		})
+	})
+
+	b.Run("counted", func(b *testing.B) {
+		var total int64
+		benchmarkCopy(b, func(dst, src *net.TCPConn) {
+			errCh := make(chan error, 1)
+			copyConn(dst, src, errCh, 0, nil, nil, nil, proxy, func(n int64) { total += n })
+			if err := <-errCh; err != nil {
+				b.Fatal(err)
+			}
+		})
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		var total int64
+		benchmarkCopy(b, func(dst, src *net.TCPConn) {
+			errCh := make(chan error, 1)
+			copyConn(dst, src, errCh, 0, nil, func([]byte) {}, nil, proxy, func(n int64) { total += n })
+			if err := <-errCh; err != nil {
+				b.Fatal(err)
+			}
+		})
+	})
+}
@@ -0,0 +1,223 @@
+package tcpee
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit defines a token-bucket rate limit. For bandwidth limits
+// the unit is bytes, for connection rate limits it is connections.
+type RateLimit struct {
+	// Rate is the sustained rate in units per second. If zero (or
+	// negative) the limit is disabled.
+	Rate int64
+
+	// Burst is the maximum no. units that may be taken at once above
+	// the sustained rate, i.e. the bucket size. If zero, a burst of
+	// one second's worth of Rate is used.
+	Burst int64
+}
+
+// enabled returns whether this rate limit is enabled.
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// BandwidthLimits defines separate rate limits for each direction of
+// a proxied connection.
+type BandwidthLimits struct {
+	// Upload is the limit for bytes from client to server.
+	Upload RateLimit
+
+	// Download is the limit for bytes from server to client.
+	Download RateLimit
+}
+
+// bucket is a simple token-bucket, where tokens are refilled at
+// rate per second up to a maximum of burst. Tokens may be taken
+// on credit, leaving the caller to wait until the debt is repaid.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64   // rate is the no. tokens refilled per second
+	burst  float64   // burst is the max no. tokens held
+	tokens float64   // tokens is the current no. tokens held
+	last   time.Time // last is the last refill time
+}
+
+// newBucket returns a new full bucket for given limit, or nil if disabled.
+func newBucket(l RateLimit) *bucket {
+	if !l.enabled() {
+		return nil
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = l.Rate
+	}
+	return &bucket{
+		rate:   float64(l.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill tops-up the bucket with tokens accrued since last refill.
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes n tokens from the bucket, returning the time the
+// caller must wait before the tokens are considered available.
+func (b *bucket) reserve(n int64) time.Duration {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	tokens := b.tokens
+	b.mu.Unlock()
+	if tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / b.rate * float64(time.Second))
+}
+
+// take attempts to take n tokens from the bucket without credit,
+// returning whether there were enough tokens available.
+func (b *bucket) take(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// full returns whether the bucket is currently full.
+func (b *bucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
+
+// size returns the bucket burst size.
+func (b *bucket) size() int64 {
+	return int64(b.burst)
+}
+
+// limiter is a set of buckets that must all be satisfied
+// before data may be transferred in one direction.
+type limiter []*bucket
+
+// newLimiter returns a limiter for the supplied buckets, dropping nil entries.
+func newLimiter(buckets ...*bucket) limiter {
+	var l limiter
+	for _, b := range buckets {
+		if b != nil {
+			l = append(l, b)
+		}
+	}
+	return l
+}
+
+// chunk returns the max chunk size that should be read at once
+// to stay within all of the limiter's buckets, capped at max.
+func (l limiter) chunk(max int) int {
+	for _, b := range l {
+		if sz := b.size(); sz < int64(max) {
+			max = int(sz)
+		}
+	}
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// wait reserves n tokens from each bucket, sleeping until they are
+// all available or the context is cancelled.
+func (l limiter) wait(ctx context.Context, n int64) error {
+	var wait time.Duration
+	for _, b := range l {
+		if d := b.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait < 1 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// source tracks the bandwidth buckets shared by all conns from one source IP.
+type source struct {
+	refs int     // refs is the no. conns using this source
+	up   *bucket // up is the source upload bucket
+	down *bucket // down is the source download bucket
+}
+
+// acquireSource fetches (or allocates) the shared source buckets for IP.
+// A nil IP, i.e. a non-IP source, is given no buckets.
+func (proxy *TCPProxy) acquireSource(ip net.IP) *source {
+	if ip == nil {
+		return &source{}
+	}
+	key := ip.String()
+	proxy.srcMutex.Lock()
+	defer proxy.srcMutex.Unlock()
+	if proxy.sources == nil {
+		proxy.sources = make(map[string]*source)
+	}
+	src, ok := proxy.sources[key]
+	if !ok {
+		src = &source{
+			up:   newBucket(proxy.SourceLimits.Upload),
+			down: newBucket(proxy.SourceLimits.Download),
+		}
+		proxy.sources[key] = src
+	}
+	src.refs++
+	return src
+}
+
+// releaseSource drops a reference to the shared source buckets for IP. The
+// buckets are kept once unreferenced, until dropped by sweepSources(), so
+// that a source reconnecting can't reset its limits to a full burst.
+func (proxy *TCPProxy) releaseSource(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	proxy.srcMutex.Lock()
+	defer proxy.srcMutex.Unlock()
+	if src, ok := proxy.sources[key]; ok {
+		src.refs--
+	}
+}
+
+// sweepSources drops unreferenced source buckets that have since refilled.
+func (proxy *TCPProxy) sweepSources() {
+	proxy.srcMutex.Lock()
+	for key, src := range proxy.sources {
+		if src.refs < 1 &&
+			(src.up == nil || src.up.full()) &&
+			(src.down == nil || src.down.full()) {
+			delete(proxy.sources, key)
+		}
+	}
+	proxy.srcMutex.Unlock()
+}
@@ -0,0 +1,137 @@
+package tcpee
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewBucket(t *testing.T) {
+	for _, test := range []struct {
+		limit RateLimit
+		nil   bool
+		burst int64
+	}{
+		{limit: RateLimit{}, nil: true},
+		{limit: RateLimit{Rate: -1}, nil: true},
+		{limit: RateLimit{Rate: 100}, burst: 100},
+		{limit: RateLimit{Rate: 100, Burst: 10}, burst: 10},
+		{limit: RateLimit{Rate: 100, Burst: 1000}, burst: 1000},
+	} {
+		b := newBucket(test.limit)
+		if test.nil {
+			if b != nil {
+				t.Errorf("newBucket(%+v) = %+v, expected nil", test.limit, b)
+			}
+			continue
+		}
+		if b.size() != test.burst {
+			t.Errorf("newBucket(%+v).size() = %d, expected %d", test.limit, b.size(), test.burst)
+		}
+		if !b.full() {
+			t.Errorf("newBucket(%+v) not full", test.limit)
+		}
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	b := newBucket(RateLimit{Rate: 1, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if !b.take(1) {
+			t.Fatalf("take %d failed within burst", i)
+		}
+	}
+	if b.take(1) {
+		t.Fatal("take succeeded beyond burst")
+	}
+	if b.full() {
+		t.Fatal("drained bucket reported full")
+	}
+}
+
+func TestBucketReserve(t *testing.T) {
+	b := newBucket(RateLimit{Rate: 1000, Burst: 1000})
+	if d := b.reserve(1000); d != 0 {
+		t.Fatalf("reserve within burst waits %v", d)
+	}
+
+	// 500 tokens in debt at 1000/s = ~500ms
+	d := b.reserve(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("reserve in debt waits %v, expected ~500ms", d)
+	}
+}
+
+func TestLimiterChunk(t *testing.T) {
+	for _, test := range []struct {
+		limiter limiter
+		max     int
+		chunk   int
+	}{
+		{limiter: nil, max: 32 * 1024, chunk: 32 * 1024},
+		{limiter: newLimiter(nil, nil), max: 1024, chunk: 1024},
+		{limiter: newLimiter(newBucket(RateLimit{Rate: 100})), max: 1024, chunk: 100},
+		{limiter: newLimiter(newBucket(RateLimit{Rate: 100}), newBucket(RateLimit{Rate: 10, Burst: 50})), max: 1024, chunk: 50},
+		{limiter: newLimiter(newBucket(RateLimit{Rate: 1, Burst: 1})), max: 0, chunk: 1},
+	} {
+		if chunk := test.limiter.chunk(test.max); chunk != test.chunk {
+			t.Errorf("chunk(%d) = %d, expected %d", test.max, chunk, test.chunk)
+		}
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := newLimiter(newBucket(RateLimit{Rate: 100, Burst: 10}))
+
+	start := time.Now()
+	if err := l.wait(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.wait(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("wait in debt returned after %v, expected ~50ms", d)
+	}
+
+	// Cancelled while waiting on debt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 100); err != context.Canceled {
+		t.Fatalf("wait on cancelled ctx = %v", err)
+	}
+}
+
+func TestSourceBuckets(t *testing.T) {
+	proxy := &TCPProxy{SourceLimits: BandwidthLimits{Upload: RateLimit{Rate: 100}}}
+	ip := parseIP(t, "192.0.2.1")
+
+	a := proxy.acquireSource(ip)
+	b := proxy.acquireSource(ip)
+	if a != b {
+		t.Fatal("conns from same source got different buckets")
+	}
+	if a.up == nil || a.down != nil {
+		t.Fatalf("unexpected source buckets up=%v down=%v", a.up, a.down)
+	}
+
+	proxy.releaseSource(ip)
+	if len(proxy.sources) != 1 {
+		t.Fatal("source dropped while still referenced")
+	}
+	proxy.releaseSource(ip)
+
+	// Drained buckets are kept until refilled
+	a.up.take(100)
+	proxy.sweepSources()
+	if c := proxy.acquireSource(ip); c != a {
+		t.Fatal("drained source dropped once unreferenced")
+	}
+	proxy.releaseSource(ip)
+
+	a.up.tokens = a.up.burst
+	proxy.sweepSources()
+	if len(proxy.sources) != 0 {
+		t.Fatal("refilled source not swept once unreferenced")
+	}
+}
@@ -0,0 +1,349 @@
+package tcpee
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRouteStopped is returned by RouteHandle.Wait() once stopped.
+var ErrRouteStopped = errors.New("tcpee: route stopped")
+
+// ErrNotDetachable is returned by RouteHandle.Detach() for listeners that
+// can't stop accepting without being closed, i.e. without deadline support.
+var ErrNotDetachable = errors.New("tcpee: listener not detachable")
+
+// RouteError is a route failure, as sent to TCPProxy.RouteErrors.
+type RouteError struct {
+	// Handle is the failed route's handle, e.g. to restart it.
+	Handle *RouteHandle
+
+	// Err is the error that stopped the route.
+	Err error
+}
+
+// Error implements error.
+func (err *RouteError) Error() string {
+	return "proxy " + err.Handle.proxy.Name + " route " + err.Handle.Route().Src + ": " + err.Err.Error()
+}
+
+// Unwrap returns the underlying route error.
+func (err *RouteError) Unwrap() error {
+	return err.Err
+}
+
+// RouteHandle controls a single running route, allowing it to be stopped,
+// restarted or replaced independently of the proxy's other routes. Stopping
+// a route closes its listener, leaving its already open conns to finish.
+type RouteHandle struct {
+	proxy *TCPProxy
+	mutex sync.Mutex // mutex protects the below fields
+	route Route      // route is the running route config
+	rt    *route     // rt is the running route state
+	run   *routeRun  // run is the current accept loop run
+}
+
+// routeRun is a single run of a route's accept loop.
+type routeRun struct {
+	ln     *routeListener // ln is the accept loop listener
+	cancel func()         // cancel stops the accept loop
+	done   chan struct{}  // done is closed once accept loop returned
+	err    error          // err is the accept loop error, set before done
+}
+
+// deadliner is a listener supporting accept deadlines,
+// e.g. *net.TCPListener and *net.UnixListener.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// routeListener wraps a route's listener, allowing its accept
+// loop to be stopped while leaving the listener itself open.
+type routeListener struct {
+	net.Listener
+	keep int32 // keep indicates to leave the listener open on close
+}
+
+// Close implements net.Listener, instead waking any blocked
+// accept with an expired deadline if the listener is kept.
+func (ln *routeListener) Close() error {
+	if atomic.LoadInt32(&ln.keep) == 1 {
+		return ln.Listener.(deadliner).SetDeadline(time.Unix(1, 0))
+	}
+	return ln.Listener.Close()
+}
+
+// ProxyContext is as Proxy(), returning ctx.Err() once ctx is cancelled.
+func (proxy *TCPProxy) ProxyContext(ctx context.Context, src string, dst string) error {
+	return proxy.ProxyRouteContext(ctx, Route{Src: src, Dst: dst})
+}
+
+// ProxyRouteContext is as ProxyRoute(), returning ctx.Err() once ctx
+// is cancelled. Only the route's listener is closed on cancel, leaving
+// its already open conns to finish.
+func (proxy *TCPProxy) ProxyRouteContext(ctx context.Context, r Route) error {
+	// Setup route state
+	rt, err := proxy.newRoute(r)
+	if err != nil {
+		return err
+	}
+
+	// Start TCP listener
+	ln, err := proxy.listen(r.Src)
+	if err != nil {
+		proxy.removeRoute(rt)
+		return err
+	}
+
+	defer proxy.removeRoute(rt)
+	return proxy.accept(ctx, ln, rt)
+}
+
+// StartRoute starts a proxy handler for the supplied route in the background,
+// returning once listening with a handle to control it. If the route later
+// fails, the error is sent to RouteErrors if set.
+func (proxy *TCPProxy) StartRoute(r Route) (*RouteHandle, error) {
+	// Setup route state
+	rt, err := proxy.newRoute(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &RouteHandle{proxy: proxy}
+	if err := h.start(r, rt); err != nil {
+		proxy.removeRoute(rt)
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// StartRouteListener is as StartRoute(), serving the route on an already
+// opened listener, e.g. one inherited from a parent process or detached
+// from another route, in place of listening on the route's Src, which if
+// empty is set from the listener address. The listener is left open on error.
+func (proxy *TCPProxy) StartRouteListener(ln net.Listener, r Route) (*RouteHandle, error) {
+	if r.Src == "" {
+		r.Src = ln.Addr().String()
+	}
+
+	// Setup route state
+	rt, err := proxy.newRoute(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &RouteHandle{proxy: proxy}
+	h.launch(r, rt, ln)
+	return h, nil
+}
+
+// Route returns the handle's current route configuration.
+func (h *RouteHandle) Route() Route {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.route
+}
+
+// Listener returns the route's listener, or nil if not running. It may be
+// used e.g. to pass the listening socket to another process, but must not
+// be closed, see Stop() and Detach().
+func (h *RouteHandle) Listener() net.Listener {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	select {
+	case <-h.run.done:
+		return nil
+	default:
+		return h.run.ln.Listener
+	}
+}
+
+// Done returns a channel closed once the route has stopped.
+func (h *RouteHandle) Done() <-chan struct{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.run.done
+}
+
+// Wait waits until the route has stopped, returning the error that
+// stopped it, or ErrRouteStopped if stopped via Stop().
+func (h *RouteHandle) Wait() error {
+	h.mutex.Lock()
+	run := h.run
+	h.mutex.Unlock()
+	<-run.done
+	return run.err
+}
+
+// Stop stops the route's listener, waiting for it to close. The route's
+// already open conns are left to finish.
+func (h *RouteHandle) Stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stop()
+	h.proxy.removeRoute(h.rt)
+}
+
+// Detach stops the route as Stop(), but leaves its listener open and returns
+// it, e.g. to serve it from another proxy via StartRouteListener() without
+// refusing conns in between. Returns ErrNotDetachable if the listener has no
+// deadline support, or ErrRouteStopped if the route is not running.
+func (h *RouteHandle) Detach() (net.Listener, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	select {
+	case <-h.run.done:
+		return nil, ErrRouteStopped
+	default:
+	}
+	if _, ok := h.run.ln.Listener.(deadliner); !ok {
+		return nil, ErrNotDetachable
+	}
+	ln := h.detach()
+	if ln == nil {
+		return nil, ErrRouteStopped
+	}
+	h.proxy.removeRoute(h.rt)
+	return ln, nil
+}
+
+// Restart restarts the route's listener if stopped, or after failure.
+func (h *RouteHandle) Restart() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stop()
+	if h.proxy.acceptCtx.Err() != nil {
+		return ErrProxyClosed
+	}
+	h.proxy.addRoute(h.rt)
+	if err := h.start(h.route, h.rt); err != nil {
+		h.proxy.removeRoute(h.rt)
+		return err
+	}
+	return nil
+}
+
+// Replace replaces the running route with r. If r listens on a different
+// address, the new listener is started before stopping the current one;
+// otherwise the current listener is handed over to r if it supports
+// deadlines, else it is stopped first and restarted on failure.
+func (h *RouteHandle) Replace(r Route) error {
+	// Setup new route state
+	rt, err := h.proxy.newRoute(r)
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	old, oldRt := h.route, h.rt
+
+	if r.Src == old.Src {
+		// Same address, hand over current listener
+		if _, ok := h.run.ln.Listener.(deadliner); ok {
+			if ln := h.detach(); ln != nil {
+				h.proxy.removeRoute(oldRt)
+				h.launch(r, rt, ln)
+				return nil
+			}
+		}
+
+		// Else stop current first
+		h.stop()
+		h.proxy.removeRoute(oldRt)
+		if err := h.start(r, rt); err != nil {
+			h.proxy.removeRoute(rt)
+			h.proxy.addRoute(oldRt)
+			if rerr := h.start(old, oldRt); rerr != nil {
+				h.proxy.removeRoute(oldRt)
+			}
+			return err
+		}
+		return nil
+	}
+
+	// Start the new listener
+	ln, err := h.proxy.listen(r.Src)
+	if err != nil {
+		h.proxy.removeRoute(rt)
+		return err
+	}
+
+	// Then swap with current
+	h.stop()
+	h.proxy.removeRoute(oldRt)
+	h.launch(r, rt, ln)
+	return nil
+}
+
+// start starts listening for route, running the accept loop
+// in the background. The handle mutex must be held.
+func (h *RouteHandle) start(r Route, rt *route) error {
+	ln, err := h.proxy.listen(r.Src)
+	if err != nil {
+		return err
+	}
+	h.launch(r, rt, ln)
+	return nil
+}
+
+// launch runs the accept loop for route on ln in the
+// background. The handle mutex must be held.
+func (h *RouteHandle) launch(r Route, rt *route, ln net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &routeRun{
+		ln:     &routeListener{Listener: ln},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	h.route, h.rt, h.run = r, rt, run
+
+	// Resume probing if restarted
+	h.proxy.probe(rt)
+
+	go func() {
+		err := h.proxy.accept(ctx, run.ln, rt)
+		if err == context.Canceled {
+			err = ErrRouteStopped
+		}
+		run.err = err
+		close(run.done)
+
+		if err != nil && err != ErrRouteStopped && err != ErrProxyClosed && h.proxy.RouteErrors != nil {
+			// Report route failure
+			select {
+			case h.proxy.RouteErrors <- &RouteError{Handle: h, Err: err}:
+			case <-h.proxy.baseCtx.Done():
+			}
+		}
+	}()
+}
+
+// stop stops the current accept loop, waiting for
+// it to return. The handle mutex must be held.
+func (h *RouteHandle) stop() {
+	h.run.cancel()
+	<-h.run.done
+}
+
+// detach stops the current accept loop as stop(), leaving its listener
+// open, which is returned if the loop hadn't already failed or been closed.
+// The listener must support deadlines, and the handle mutex must be held.
+func (h *RouteHandle) detach() net.Listener {
+	run := h.run
+	atomic.StoreInt32(&run.ln.keep, 1)
+	run.cancel()
+	<-run.done
+	if run.err != ErrRouteStopped {
+		// Loop failed / proxy closed
+		_ = run.ln.Listener.Close()
+		return nil
+	}
+	_ = run.ln.Listener.(deadliner).SetDeadline(time.Time{})
+	return run.ln.Listener
+}
@@ -0,0 +1,244 @@
+package tcpee
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// backendOf returns the backend of the proxy's most recent conn.
+func backendOf(t *testing.T, proxy *TCPProxy) string {
+	t.Helper()
+	conns := proxy.Conns()
+	if len(conns) == 0 {
+		t.Fatal("no conns")
+	}
+	return conns[len(conns)-1].Backend
+}
+
+// tcpDial dials the supplied TCP listener address, failing the test on error.
+func tcpDial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRouteStopRestart(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	mn.echo(t, "backend")
+	h := startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+
+	h.Stop()
+	if err := h.Wait(); err != ErrRouteStopped {
+		t.Fatalf("wait = %v", err)
+	}
+	select {
+	case <-h.Done():
+	default:
+		t.Fatal("done not closed")
+	}
+	if h.Listener() != nil {
+		t.Fatal("stopped route has listener")
+	}
+	if _, err := mn.DialContext(context.Background(), "tcp", "front"); err == nil {
+		t.Fatal("stopped route accepting")
+	}
+	if len(proxy.Stats().Routes) != 0 {
+		t.Fatal("stopped route in stats")
+	}
+
+	// Open conns left to finish
+	roundTrip(t, conn, "still here")
+
+	if err := h.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Listener() == nil || len(proxy.Stats().Routes) != 1 {
+		t.Fatal("restarted route not running")
+	}
+	roundTrip(t, mn.dial(t, "front"), "hello again")
+
+	// Restart after proxy close fails
+	proxy.Close()
+	if err := h.Restart(); err != ErrProxyClosed {
+		t.Fatalf("restart after close = %v", err)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	errs := make(chan *RouteError, 1)
+	proxy, mn := newMemProxy(t, &TCPProxy{RouteErrors: errs})
+	mn.echo(t, "backend")
+	h := startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	// Listener failure reported
+	h.Listener().Close()
+	select {
+	case err := <-errs:
+		if err.Handle != h || !errors.Is(err, net.ErrClosed) || err.Error() != "proxy proxy route front: "+net.ErrClosed.Error() {
+			t.Fatalf("route error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no route error")
+	}
+	if err := h.Wait(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("wait = %v", err)
+	}
+
+	// Restarted after failure
+	if err := h.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, mn.dial(t, "front"), "hello")
+}
+
+func TestRouteReplace(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	mn.echo(t, "backend1")
+	mn.echo(t, "backend2")
+	h := startRoute(t, proxy, Route{Src: "front", Dst: "backend1"})
+
+	old := mn.dial(t, "front")
+	roundTrip(t, old, "hello")
+
+	// Same address, listener without deadlines restarted
+	if err := h.Replace(Route{Src: "front", Dst: "backend2"}); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, mn.dial(t, "front"), "hello")
+	if backend := backendOf(t, proxy); backend != "backend2" {
+		t.Fatalf("replaced route backend = %s", backend)
+	}
+	roundTrip(t, old, "old conn left open")
+
+	// Different address, new listener started first
+	if err := h.Replace(Route{Src: "front2", Dst: "backend1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mn.DialContext(context.Background(), "tcp", "front"); err == nil {
+		t.Fatal("replaced listener still open")
+	}
+	roundTrip(t, mn.dial(t, "front2"), "hello")
+	if h.Route().Src != "front2" {
+		t.Fatalf("route = %+v", h.Route())
+	}
+
+	// Failed replace keeps current route
+	if err := h.Replace(Route{Src: "front3", Dst: "missing"}); err == nil {
+		t.Fatal("replaced with unreachable backend")
+	}
+	if h.Route().Src != "front2" || len(proxy.Stats().Routes) != 1 {
+		t.Fatalf("route = %+v", h.Route())
+	}
+	roundTrip(t, mn.dial(t, "front2"), "hello")
+}
+
+func TestRouteReplaceHandover(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	proxy.Listener = nil // TCP listeners support deadlines
+	mn.echo(t, "backend1")
+	mn.echo(t, "backend2")
+	h := startRoute(t, proxy, Route{Src: "127.0.0.1:0", Dst: "backend1"})
+	ln := h.Listener()
+	addr := ln.Addr().String()
+
+	// Same listener handed over to replacement
+	if err := h.Replace(Route{Src: "127.0.0.1:0", Dst: "backend2"}); err != nil {
+		t.Fatal(err)
+	}
+	if h.Listener() != ln {
+		t.Fatal("listener not handed over")
+	}
+	roundTrip(t, tcpDial(t, addr), "hello")
+	if backend := backendOf(t, proxy); backend != "backend2" {
+		t.Fatalf("replaced route backend = %s", backend)
+	}
+}
+
+func TestRouteDetach(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	mn.echo(t, "backend")
+
+	// In-memory listener can't be detached
+	h := startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+	if _, err := h.Detach(); err != ErrNotDetachable {
+		t.Fatalf("detach = %v", err)
+	}
+
+	proxy, _ = newMemProxy(t, &TCPProxy{})
+	proxy.Listener, proxy.Dialer = nil, mn // TCP listeners support deadlines
+	h = startRoute(t, proxy, Route{Src: "127.0.0.1:0", Dst: "backend"})
+	ln, err := h.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := h.Detach(); err != ErrRouteStopped {
+		t.Fatalf("second detach = %v", err)
+	}
+
+	// Conns queued on the detached listener until served elsewhere
+	conn := tcpDial(t, ln.Addr().String())
+	proxy2, _ := newMemProxy(t, &TCPProxy{})
+	proxy2.Dialer = mn
+	h2, err := proxy2.StartRouteListener(ln, Route{Dst: "backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Route().Src != ln.Addr().String() {
+		t.Fatalf("route = %+v", h2.Route())
+	}
+	roundTrip(t, conn, "hello")
+	if proxy2.Stats().Conns != 1 {
+		t.Fatal("conn not served by new proxy")
+	}
+}
+
+func TestProxyRouteContext(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web"})
+	mn.echo(t, "backend")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- proxy.ProxyRouteContext(ctx, Route{Src: "front", Dst: "backend"}) }()
+
+	// Wait on listener
+	var conn net.Conn
+	deadline := time.Now().Add(time.Second)
+	for {
+		var err error
+		if conn, err = mn.DialContext(context.Background(), "tcp", "front"); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Fatalf("proxy = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("proxy didn't return on cancel")
+	}
+	if len(proxy.Stats().Routes) != 0 {
+		t.Fatal("cancelled route in stats")
+	}
+
+	// Open conns left to finish
+	roundTrip(t, conn, "still here")
+}
@@ -0,0 +1,244 @@
+package tcpee
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// sessionMagic is the first line of a session recording.
+const sessionMagic = "tcpee-session v1\n"
+
+// maxSessionFrame is the maximum frame data length read, well above the
+// proxy copy buffer size, guarding against corrupt recordings.
+const maxSessionFrame = 1 << 20
+
+// Session recording frame types.
+const (
+	sessionIn    = '>' // client -> server data
+	sessionOut   = '<' // server -> client data
+	sessionTrunc = '!' // recording truncated at max bytes
+)
+
+// SessionHeader is the metadata of a recorded session.
+type SessionHeader struct {
+	// Proxy is the name of the recording proxy.
+	Proxy string `json:"proxy"`
+
+	// ID is the recorded connection ID.
+	ID string `json:"id"`
+
+	// Src and Dst are the client and backend addresses.
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+
+	// Start is the time recording started.
+	Start time.Time `json:"start"`
+}
+
+// SessionFrame is a single chunk of recorded session data.
+type SessionFrame struct {
+	// In indicates client -> server data, else server -> client.
+	In bool
+
+	// Offset is the time of the frame since the session start.
+	Offset time.Duration
+
+	// Skip is the no. bytes in the frame's direction dropped by
+	// the recorder before this frame, as it fell behind.
+	Skip uint64
+
+	// Data is the recorded data.
+	Data []byte
+}
+
+// SessionReader reads a session recording, as written by the CaptureSession
+// format, for replay. A recording is a magic line, a JSON header line, then
+// frames of a direction byte followed by uvarint offset (ns), skip and data
+// length, then the data.
+type SessionReader struct {
+	// Header is the recorded session metadata.
+	Header SessionHeader
+
+	// Truncated is set once a recording truncated
+	// at the capture's max bytes has been read.
+	Truncated bool
+
+	br   *bufio.Reader
+	cr   countReader // cr counts the bytes read from the recording
+	size int64       // size is the recording size, or -1 if unknown
+}
+
+// countReader wraps an io.Reader, counting the bytes read.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// NewSessionReader returns a new SessionReader for r, reading the header.
+// If r is an *os.File, frame lengths are also checked against its size.
+func NewSessionReader(r io.Reader) (*SessionReader, error) {
+	sr := &SessionReader{cr: countReader{r: r}, size: -1}
+	sr.br = bufio.NewReader(&sr.cr)
+	br := sr.br
+
+	if f, ok := r.(*os.File); ok {
+		stat, err := f.Stat()
+		if err == nil && stat.Mode().IsRegular() {
+			if off, err := f.Seek(0, io.SeekCurrent); err == nil {
+				sr.size = stat.Size() - off
+			}
+		}
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil || line != sessionMagic {
+		return nil, errors.New("not a session recording")
+	}
+
+	line, err = br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading session header: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(line), &sr.Header); err != nil {
+		return nil, fmt.Errorf("error decoding session header: %w", err)
+	}
+
+	return sr, nil
+}
+
+// Next returns the next recorded frame, or io.EOF at the end of the recording.
+func (sr *SessionReader) Next() (SessionFrame, error) {
+	var frame SessionFrame
+
+	typ, err := sr.br.ReadByte()
+	if err != nil {
+		return frame, err
+	}
+
+	switch typ {
+	case sessionIn:
+		frame.In = true
+	case sessionOut:
+	case sessionTrunc:
+		sr.Truncated = true
+		return frame, io.EOF
+	default:
+		return frame, fmt.Errorf("invalid session frame type %q", typ)
+	}
+
+	var vals [3]uint64
+	for i := range vals {
+		if vals[i], err = binary.ReadUvarint(sr.br); err != nil {
+			return frame, unexpectedEOF(err)
+		}
+	}
+	frame.Offset = time.Duration(vals[0])
+	frame.Skip = vals[1]
+
+	// Check length before allocating
+	if vals[2] > maxSessionFrame {
+		return frame, fmt.Errorf("session frame length %d exceeds max %d", vals[2], maxSessionFrame)
+	}
+	if sr.size >= 0 {
+		read := sr.cr.n - int64(sr.br.Buffered())
+		if int64(vals[2]) > sr.size-read {
+			return frame, io.ErrUnexpectedEOF
+		}
+	}
+
+	frame.Data = make([]byte, vals[2])
+	if _, err := io.ReadFull(sr.br, frame.Data); err != nil {
+		return frame, unexpectedEOF(err)
+	}
+
+	return frame, nil
+}
+
+// unexpectedEOF converts io.EOF in err to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// sessionWriter writes captured data as a session recording, for replay.
+type sessionWriter struct {
+	file  *os.File
+	bw    *bufio.Writer
+	start time.Time
+	buf   [3 * binary.MaxVarintLen64]byte
+}
+
+// newSessionWriter creates a session recording at name + ".rec".
+func newSessionWriter(name string, proxy string, id string, src, dst *net.TCPAddr) (*sessionWriter, error) {
+	file, err := os.OpenFile(name+".rec", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &sessionWriter{
+		file:  file,
+		bw:    bufio.NewWriter(file),
+		start: time.Now(),
+	}
+
+	hdr, _ := json.Marshal(SessionHeader{
+		Proxy: proxy,
+		ID:    id,
+		Src:   src.String(),
+		Dst:   dst.String(),
+		Start: w.start,
+	})
+	w.bw.WriteString(sessionMagic)
+	w.bw.Write(hdr)
+	w.bw.WriteByte('\n')
+
+	return w, nil
+}
+
+func (w *sessionWriter) write(chunk captureChunk) error {
+	typ := byte(sessionOut)
+	if chunk.in {
+		typ = sessionIn
+	}
+
+	offset := chunk.time.Sub(w.start)
+	if offset < 0 {
+		offset = 0
+	}
+
+	n := binary.PutUvarint(w.buf[:], uint64(offset))
+	n += binary.PutUvarint(w.buf[n:], chunk.skip)
+	n += binary.PutUvarint(w.buf[n:], uint64(len(chunk.data)))
+
+	w.bw.WriteByte(typ)
+	w.bw.Write(w.buf[:n])
+	_, err := w.bw.Write(chunk.data)
+	return err
+}
+
+func (w *sessionWriter) close(truncated bool) error {
+	if truncated {
+		w.bw.WriteByte(sessionTrunc)
+	}
+	err := w.bw.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package tcpee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSession reads all frames of the session recording at path.
+func readSession(t *testing.T, path string) (*SessionReader, []SessionFrame) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sr, err := NewSessionReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []SessionFrame
+	for {
+		frame, err := sr.Next()
+		if err == io.EOF {
+			return sr, frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+
+	for _, truncated := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "web-1")
+		w, err := newSessionWriter(name, "web", "1", src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunks := []captureChunk{
+			{in: true, time: w.start.Add(time.Millisecond), data: []byte("hello")},
+			{in: false, time: w.start.Add(time.Second), skip: 300, data: []byte("world")},
+			{in: true, time: w.start.Add(-time.Second), data: []byte{}},
+			{in: true, time: w.start.Add(time.Hour), data: bytes.Repeat([]byte{0}, 1000)},
+		}
+		for _, chunk := range chunks {
+			if err := w.write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.close(truncated); err != nil {
+			t.Fatal(err)
+		}
+
+		sr, frames := readSession(t, name+".rec")
+		if hdr := sr.Header; hdr.Proxy != "web" || hdr.ID != "1" || hdr.Src != src.String() ||
+			hdr.Dst != dst.String() || !hdr.Start.Equal(w.start) {
+			t.Fatalf("header = %+v", hdr)
+		}
+		if sr.Truncated != truncated {
+			t.Fatalf("truncated = %v", sr.Truncated)
+		}
+		if len(frames) != len(chunks) {
+			t.Fatalf("read %d frames", len(frames))
+		}
+		for i, frame := range frames {
+			chunk := chunks[i]
+			offset := chunk.time.Sub(w.start)
+			if offset < 0 {
+				offset = 0
+			}
+			if frame.In != chunk.in || frame.Offset != offset || frame.Skip != chunk.skip || !bytes.Equal(frame.Data, chunk.data) {
+				t.Errorf("frame %d = %+v", i, frame)
+			}
+		}
+	}
+}
+
+func TestSessionReaderErrors(t *testing.T) {
+	header := sessionMagic + `{"proxy":"web"}` + "\n"
+	for _, test := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"empty", "", "not a session recording"},
+		{"magic", "tcpee-session v2\n{}\n", "not a session recording"},
+		{"no header", sessionMagic, "error reading session header"},
+		{"bad header", sessionMagic + "{\n", "error decoding session header"},
+		{"frame type", header + "?", "invalid session frame type"},
+		{"short varints", header + ">\x01\x00", io.ErrUnexpectedEOF.Error()},
+		{"short data", header + ">\x01\x00\x05abc", io.ErrUnexpectedEOF.Error()},
+		{"huge data", header + ">\x01\x00" + string(binary.AppendUvarint(nil, 1<<62)), "exceeds max"},
+	} {
+		sr, err := NewSessionReader(strings.NewReader(test.data))
+		if err == nil {
+			_, err = sr.Next()
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, expected %q", test.name, err, test.err)
+		}
+	}
+
+	// Frame longer than the rest of the file
+	path := filepath.Join(t.TempDir(), "short.rec")
+	data := header + ">\x01\x00" + string(binary.AppendUvarint(nil, maxSessionFrame)) + "abc"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sr, err := NewSessionReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("next on short file = %v", err)
+	}
+
+	// Clean end of recording
+	sr, err = NewSessionReader(strings.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Next(); !errors.Is(err, io.EOF) || sr.Truncated {
+		t.Fatalf("next = %v, truncated = %v", err, sr.Truncated)
+	}
+}
+
+func TestCaptureSession(t *testing.T) {
+	capture := &Capture{Dir: t.TempDir(), Format: CaptureSession}
+	if err := capture.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web", Capture: capture})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	roundTrip(t, conn, "world")
+	conn.Close()
+	waitOpen(t, proxy, 0)
+	proxy.Close()
+
+	entries, _ := os.ReadDir(capture.Dir)
+	if len(entries) != 1 || filepath.Ext(entries[0].Name()) != ".rec" {
+		t.Fatalf("capture files = %v", entries)
+	}
+	sr, frames := readSession(t, filepath.Join(capture.Dir, entries[0].Name()))
+	if sr.Header.Proxy != "web" || sr.Truncated {
+		t.Fatalf("header = %+v, truncated = %v", sr.Header, sr.Truncated)
+	}
+
+	var in, out string
+	for _, frame := range frames {
+		if frame.In {
+			in += string(frame.Data)
+		} else {
+			out += string(frame.Data)
+		}
+	}
+	if in != "helloworld" || out != "helloworld" {
+		t.Fatalf("recorded %q / %q", in, out)
+	}
+}
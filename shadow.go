@@ -0,0 +1,194 @@
+package tcpee
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// defaultShadowQueue is the default no. chunks queued per shadowed conn.
+const defaultShadowQueue = 256
+
+// shadowWriteTimeout is the maximum time a single shadow write may block.
+const shadowWriteTimeout = 5 * time.Second
+
+// Shadow is a secondary backend to which the client -> server data of a
+// sample of proxied conns is duplicated, e.g. for testing a new release. The
+// data is duplicated as read, before any stream filters, and the shadow's
+// responses are discarded. Shadowed data is queued to a background writer,
+// and dropped if the queue is full or the shadow is down.
+type Shadow struct {
+	// Addr is the shadow backend address.
+	Addr string
+
+	// Sample is the fraction of conns to shadow, between 0 and 1.
+	// If zero, all connections are shadowed.
+	Sample float64
+
+	// QueueSize is the no. chunks queued per shadowed conn before
+	// shadowed data is dropped. If zero, a default is used.
+	QueueSize int
+}
+
+// ShadowStats is a snapshot of a route's shadow traffic counters.
+type ShadowStats struct {
+	// Addr is the shadow backend address.
+	Addr string `json:"addr"`
+
+	// Conns is the total no. conns shadowed.
+	Conns uint64 `json:"conns"`
+
+	// Bytes is the no. bytes written to the shadow.
+	Bytes uint64 `json:"bytes"`
+
+	// Dropped is the no. bytes dropped, as the shadow was slow or down.
+	Dropped uint64 `json:"dropped"`
+
+	// Errors is the no. shadow dial and write errors.
+	Errors uint64 `json:"errors"`
+}
+
+// shadowCounters are a route's lock-free shadow traffic counters.
+type shadowCounters struct {
+	conns   uint64 // conns tracks the no. shadowed conns
+	bytes   uint64 // bytes tracks the no. bytes written
+	dropped uint64 // dropped tracks the no. bytes dropped
+	errors  uint64 // errors tracks the no. dial / write errors
+}
+
+// shadowConn is the shadow state of a single proxied conn.
+type shadowConn struct {
+	queue chan []byte     // queue is the background writer queue
+	stats *shadowCounters // stats are the route shadow counters
+}
+
+// openShadow starts shadowing the conn with ID on route if sampled, returning
+// nil if not shadowed. The background writer is tracked by the proxy's serve
+// wait group.
+func (proxy *TCPProxy) openShadow(rt *route, id string) *shadowConn {
+	sh := rt.shadow
+	if sh == nil {
+		return nil
+	}
+
+	// Check conn sampling
+	if sh.Sample > 0 && sh.Sample < 1 && rand.Float64() >= sh.Sample {
+		return nil
+	}
+
+	size := sh.QueueSize
+	if size < 1 {
+		size = defaultShadowQueue
+	}
+
+	sc := &shadowConn{
+		queue: make(chan []byte, size),
+		stats: &rt.shadowStats,
+	}
+	atomic.AddUint64(&sc.stats.conns, 1)
+
+	proxy.serveWg.Add(1)
+	go func() {
+		defer proxy.serveWg.Done()
+		proxy.runShadow(sc, sh.Addr, id)
+	}()
+
+	return sc
+}
+
+// tap queues a copy of client -> server data for the shadow,
+// dropping it if the writer queue is full.
+func (sc *shadowConn) tap(data []byte) {
+	select {
+	case sc.queue <- append([]byte(nil), data...):
+	default:
+		// Shadow is behind, drop
+		atomic.AddUint64(&sc.stats.dropped, uint64(len(data)))
+	}
+}
+
+// close stops queueing shadowed data, letting the writer finish.
+func (sc *shadowConn) close() {
+	close(sc.queue)
+}
+
+// runShadow dials the shadow at addr and writes queued data to it until the
+// queue is closed, discarding any responses. Data is dropped on error.
+func (proxy *TCPProxy) runShadow(sc *shadowConn, addr string, id string) {
+	// shadowError logs and counts a shadow error.
+	shadowError := func(msg string, err error) {
+		atomic.AddUint64(&sc.stats.errors, 1)
+		log.ErrorKVs(kv.Fields{
+			{K: "proxy", V: proxy.Name},
+			{K: "id", V: id},
+			{K: "shadow", V: addr},
+			{K: "error", V: err},
+			{K: "msg", V: msg},
+		}...)
+	}
+
+	conn, err := proxy.dial(addr)
+	if err != nil {
+		shadowError("shadow dial error", err)
+	} else {
+		// Discard shadow responses
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+		defer func(conn io.Closer) {
+			conn.Close()
+			wg.Wait()
+		}(conn)
+	}
+
+	for data := range sc.queue {
+		if conn == nil {
+			atomic.AddUint64(&sc.stats.dropped, uint64(len(data)))
+			continue
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(shadowWriteTimeout))
+		n, err := conn.Write(data)
+		atomic.AddUint64(&sc.stats.bytes, uint64(n))
+		if err != nil {
+			atomic.AddUint64(&sc.stats.dropped, uint64(len(data)-n))
+			shadowError("shadow write error", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// snapshot returns a snapshot of the current shadow counter values.
+func (c *shadowCounters) snapshot(addr string) *ShadowStats {
+	return &ShadowStats{
+		Addr:    addr,
+		Conns:   atomic.LoadUint64(&c.conns),
+		Bytes:   atomic.LoadUint64(&c.bytes),
+		Dropped: atomic.LoadUint64(&c.dropped),
+		Errors:  atomic.LoadUint64(&c.errors),
+	}
+}
+
+// joinTaps returns a tap func calling both taps, either of which may be nil.
+func joinTaps(tap1, tap2 func([]byte)) func([]byte) {
+	switch {
+	case tap1 == nil:
+		return tap2
+	case tap2 == nil:
+		return tap1
+	default:
+		return func(b []byte) {
+			tap1(b)
+			tap2(b)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tcpee
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// shadowStats returns the shadow stats of the proxy's only route.
+func shadowStats(t *testing.T, proxy *TCPProxy) ShadowStats {
+	t.Helper()
+	routes := proxy.Stats().Routes
+	if len(routes) != 1 || routes[0].Shadow == nil {
+		t.Fatalf("routes = %+v", routes)
+	}
+	return *routes[0].Shadow
+}
+
+func TestShadow(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Shadow: &Shadow{Addr: "shadow"}})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	ln, err := mn.Listen(context.Background(), "tcp", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	shadowed := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// Responses are discarded
+		_, _ = conn.Write([]byte("ignored"))
+		b, _ := io.ReadAll(conn)
+		shadowed <- string(b)
+	}()
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello ")
+	roundTrip(t, conn, "world")
+	conn.Close()
+
+	select {
+	case data := <-shadowed:
+		if data != "hello world" {
+			t.Fatalf("shadowed %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shadow not closed")
+	}
+
+	waitOpen(t, proxy, 0)
+	if stats := shadowStats(t, proxy); stats.Addr != "shadow" || stats.Conns != 1 || stats.Bytes != 11 ||
+		stats.Dropped != 0 || stats.Errors != 0 {
+		t.Fatalf("shadow stats = %+v", stats)
+	}
+}
+
+func TestShadowDown(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend", Shadow: &Shadow{Addr: "shadow"}})
+
+	// Proxied conn unaffected by shadow being down
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	conn.Close()
+	waitOpen(t, proxy, 0)
+
+	// Wait on shadow writer
+	deadline := time.Now().Add(time.Second)
+	for shadowStats(t, proxy).Dropped != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("shadow stats = %+v", shadowStats(t, proxy))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := shadowStats(t, proxy); stats.Conns != 1 || stats.Bytes != 0 || stats.Errors != 1 {
+		t.Fatalf("shadow stats = %+v", stats)
+	}
+}
+
+func TestShadowSample(t *testing.T) {
+	proxy, _ := newMemProxy(t, &TCPProxy{})
+	proxy.init()
+
+	for _, test := range []struct {
+		shadow *Shadow
+		opened bool
+	}{
+		{nil, false},
+		{&Shadow{Addr: "shadow", Sample: 1e-12}, false},
+		{&Shadow{Addr: "shadow", Sample: 1}, true},
+		{&Shadow{Addr: "shadow"}, true},
+	} {
+		sc := proxy.openShadow(&route{shadow: test.shadow}, "1")
+		if (sc != nil) != test.opened {
+			t.Errorf("%+v: shadowed = %v", test.shadow, sc != nil)
+		}
+		if sc != nil {
+			sc.close()
+		}
+	}
+}
+
+func TestJoinTaps(t *testing.T) {
+	var calls []string
+	tap := func(name string) func([]byte) {
+		return func(b []byte) { calls = append(calls, name+":"+string(b)) }
+	}
+
+	if joinTaps(nil, nil) != nil {
+		t.Fatal("joined nil taps")
+	}
+	joinTaps(tap("a"), nil)([]byte("1"))
+	joinTaps(nil, tap("b"))([]byte("2"))
+	joinTaps(tap("a"), tap("b"))([]byte("3"))
+
+	if want := "[a:1 b:2 a:3 b:3]"; fmt.Sprint(calls) != want {
+		t.Fatalf("calls = %v, expected %s", calls, want)
+	}
+}
@@ -0,0 +1,243 @@
+package tcpee
+
+import (
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// startupProbeInterval is the interval at which an unreachable
+// route backend is dialed, while waiting on or probing it.
+const startupProbeInterval = time.Second
+
+// StartupPolicy determines how a route is started when its
+// backend can't be dialed.
+type StartupPolicy int
+
+const (
+	// StartupDefault uses the TCPProxy's StartupPolicy for a Route,
+	// and is equivalent to StartupStrict for a TCPProxy.
+	StartupDefault StartupPolicy = iota
+
+	// StartupStrict fails to start the route.
+	StartupStrict
+
+	// StartupLazy starts the route without waiting on the backend,
+	// which is dialed in the background, serving the fallback behaviour
+	// until it can be dialed, see TCPProxy.Fallback. Conns accepted
+	// before the first dial completes are held until it does.
+	StartupLazy
+
+	// StartupWait starts the route regardless, holding accepted conns
+	// until the backend can be dialed, for up to TCPProxy.StartupTimeout
+	// from route start, after which they're served as by StartupLazy.
+	StartupWait
+)
+
+// String returns the config string representation of policy.
+func (policy StartupPolicy) String() string {
+	switch policy {
+	case StartupDefault:
+		return ""
+	case StartupStrict:
+		return "strict"
+	case StartupLazy:
+		return "lazy"
+	case StartupWait:
+		return "wait-until-ready"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseStartupPolicy parses a StartupPolicy from its string representation.
+func ParseStartupPolicy(str string) (StartupPolicy, bool) {
+	switch str {
+	case "":
+		return StartupDefault, true
+	case "strict":
+		return StartupStrict, true
+	case "lazy":
+		return StartupLazy, true
+	case "wait-until-ready":
+		return StartupWait, true
+	default:
+		return 0, false
+	}
+}
+
+// startupPolicy returns the startup policy of the supplied route.
+func (proxy *TCPProxy) startupPolicy(r Route) StartupPolicy {
+	if r.Startup != StartupDefault {
+		return r.Startup
+	}
+	return proxy.StartupPolicy
+}
+
+// checkBackend dials the supplied route's destination, returning an error if
+// it can't be dialed. Only used under StartupStrict, other policies check the
+// backend in the background, see probe().
+func (proxy *TCPProxy) checkBackend(r Route) error {
+	conn, err := proxy.dial(r.Dst)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// awaitReady holds a conn accepted while the route is waiting on its unready
+// backend, until ready, the wait ends or the proxy is closed, returning ready.
+// Under StartupLazy the wait ends once the backend has first been dialed.
+func (proxy *TCPProxy) awaitReady(rt *route) bool {
+	if rt.ready() || !rt.waiting() {
+		return rt.ready()
+	}
+
+	rt.metrics.hold(1)
+	defer rt.metrics.hold(-1)
+
+	checked := rt.checkCh
+	var deadline <-chan time.Time
+	if rt.wait {
+		checked = nil
+		if !rt.waitUntil.IsZero() {
+			timer := time.NewTimer(time.Until(rt.waitUntil))
+			defer timer.Stop()
+			deadline = timer.C
+		}
+	}
+
+	select {
+	case <-rt.readyCh:
+	case <-checked:
+	case <-deadline:
+	case <-proxy.baseCtx.Done():
+	}
+
+	return rt.ready()
+}
+
+// probe starts dialing the supplied route's destination in the background
+// if it isn't ready, until it is, the route is stopped or the proxy closed.
+// The first dial happens immediately, with the outcome logged as per the
+// route's startup policy, as is the end of any startup wait meanwhile.
+func (proxy *TCPProxy) probe(rt *route) {
+	if rt.ready() || !atomic.CompareAndSwapInt32(&rt.probing, 0, 1) {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(startupProbeInterval)
+		defer ticker.Stop()
+
+		var deadline <-chan time.Time
+		if rt.wait && !rt.waitUntil.IsZero() {
+			timer := time.NewTimer(time.Until(rt.waitUntil))
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		for first := true; ; first = false {
+			if !first {
+				select {
+				case <-ticker.C:
+				case <-deadline:
+					deadline = nil
+					log.ErrorKVs(kv.Fields{
+						{K: "proxy", V: proxy.Name},
+						{K: "route", V: rt.src},
+						{K: "backend", V: rt.dst},
+						{K: "msg", V: "backend startup timeout, serving fallback"},
+					}...)
+					continue
+				case <-proxy.baseCtx.Done():
+					atomic.StoreInt32(&rt.probing, 0)
+					return
+				}
+			}
+
+			if !proxy.hasRoute(rt) {
+				// Stopped, unless restarted meanwhile
+				atomic.StoreInt32(&rt.probing, 0)
+				if !proxy.hasRoute(rt) || !atomic.CompareAndSwapInt32(&rt.probing, 0, 1) {
+					return
+				}
+			}
+
+			conn, err := proxy.dial(rt.dst)
+			if err != nil {
+				if first {
+					proxy.unreachable(rt, err)
+					rt.checked()
+				}
+				continue
+			}
+			conn.Close()
+
+			if atomic.CompareAndSwapInt32(&rt.unready, 1, 0) {
+				// Release any held conns
+				close(rt.readyCh)
+			}
+			rt.checked()
+			log.InfoKVs(kv.Fields{
+				{K: "proxy", V: proxy.Name},
+				{K: "route", V: rt.src},
+				{K: "backend", V: rt.dst},
+				{K: "msg", V: "backend ready"},
+			}...)
+			return
+		}
+	}()
+}
+
+// unreachable logs the supplied route's backend first failing to be dialed.
+func (proxy *TCPProxy) unreachable(rt *route, err error) {
+	if rt.wait {
+		log.InfoKVs(kv.Fields{
+			{K: "proxy", V: proxy.Name},
+			{K: "route", V: rt.src},
+			{K: "backend", V: rt.dst},
+			{K: "error", V: err},
+			{K: "msg", V: "waiting on backend"},
+		}...)
+		return
+	}
+	log.ErrorKVs(kv.Fields{
+		{K: "proxy", V: proxy.Name},
+		{K: "route", V: rt.src},
+		{K: "backend", V: rt.dst},
+		{K: "error", V: err},
+		{K: "msg", V: "backend unreachable, serving fallback"},
+	}...)
+}
+
+// ready returns whether the route's backend was reachable, else
+// conns are served the route's fallback behaviour.
+func (rt *route) ready() bool {
+	return atomic.LoadInt32(&rt.unready) == 0
+}
+
+// checked marks the route's backend as having been dialed, if not
+// already. Only called from the probing routine.
+func (rt *route) checked() {
+	select {
+	case <-rt.checkCh:
+	default:
+		close(rt.checkCh)
+	}
+}
+
+// waiting returns whether conns are held while the route's backend is
+// unready, i.e. until it's first dialed, and during its startup wait.
+func (rt *route) waiting() bool {
+	select {
+	case <-rt.checkCh:
+	default:
+		if rt.checkCh != nil {
+			return true
+		}
+	}
+	return rt.wait && (rt.waitUntil.IsZero() || time.Now().Before(rt.waitUntil))
+}
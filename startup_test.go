@@ -0,0 +1,192 @@
+package tcpee
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartupPolicy(t *testing.T) {
+	for _, test := range []struct {
+		proxy StartupPolicy
+		route StartupPolicy
+		start bool
+	}{
+		{StartupDefault, StartupDefault, false},
+		{StartupStrict, StartupDefault, false},
+		{StartupLazy, StartupDefault, true},
+		{StartupWait, StartupDefault, true},
+		{StartupLazy, StartupStrict, false},
+		{StartupStrict, StartupLazy, true},
+		{StartupStrict, StartupWait, true},
+	} {
+		proxy, _ := newMemProxy(t, &TCPProxy{StartupPolicy: test.proxy})
+
+		// Never blocks on an unreachable backend, even without a timeout
+		start := time.Now()
+		_, err := proxy.StartRoute(Route{Src: "front", Dst: "missing", Startup: test.route})
+		if (err == nil) != test.start {
+			t.Errorf("proxy %s route %s: start = %v", test.proxy, test.route, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("proxy %s route %s: start took %v", test.proxy, test.route, elapsed)
+		}
+	}
+
+	for str, policy := range map[string]StartupPolicy{
+		"":                 StartupDefault,
+		"strict":           StartupStrict,
+		"lazy":             StartupLazy,
+		"wait-until-ready": StartupWait,
+	} {
+		if p, ok := ParseStartupPolicy(str); !ok || p != policy || p.String() != str {
+			t.Errorf("ParseStartupPolicy(%q) = %s, %t", str, p, ok)
+		}
+	}
+	if _, ok := ParseStartupPolicy("eager"); ok {
+		t.Error("parsed unknown policy")
+	}
+}
+
+func TestStartupWait(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{StartupPolicy: StartupWait, Metrics: &Metrics{}})
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+	if routes := proxy.Stats().Routes; !routes[0].Fallback {
+		t.Fatalf("routes = %+v", routes)
+	}
+
+	// Conn held until backend reachable, counted as open meanwhile
+	conn := mn.dial(t, "front")
+	waitOpen(t, proxy, 1)
+	rec := httptest.NewRecorder()
+	proxy.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `tcpee_connections_held{proxy="proxy",route="front"} 1`; !strings.Contains(rec.Body.String(), line+"\n") {
+		t.Fatalf("metrics missing %s", line)
+	}
+	mn.echo(t, "backend")
+	for deadline := time.Now().Add(5 * time.Second); proxy.Stats().Routes[0].Fallback; {
+		if time.Now().After(deadline) {
+			t.Fatal("backend never ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	roundTrip(t, conn, "hello")
+}
+
+func TestStartupWaitTimeout(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		StartupPolicy:  StartupWait,
+		StartupTimeout: 50 * time.Millisecond,
+		RejectBanner:   "unavailable",
+	})
+	mn.echo(t, "fallback")
+	startRoute(t, proxy, Route{Src: "fallback-route", Dst: "backend", Fallback: "fallback"})
+	startRoute(t, proxy, Route{Src: "reject-route", Dst: "backend"})
+
+	// Held conns served as by StartupLazy after the timeout
+	conn := mn.dial(t, "fallback-route")
+	roundTrip(t, conn, "hello")
+	if backend := backendOf(t, proxy); backend != "fallback" {
+		t.Fatalf("backend = %s", backend)
+	}
+	if data, err := readAll(mn.dial(t, "reject-route")); err != nil || data != "unavailable" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
+
+func TestFallbackStats(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Metrics: &Metrics{}})
+	mn.echo(t, "fallback")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend", Startup: StartupLazy, Fallback: "fallback"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	conn.Close()
+	waitOpen(t, proxy, 0)
+
+	// Fallback conns counted against the fallback backend
+	backends := proxy.Stats().Backends
+	if len(backends) != 2 || backends[0].Backend != "backend" || backends[1].Backend != "fallback" {
+		t.Fatalf("backends = %+v", backends)
+	}
+	if backends[0].Conns != 0 || backends[1].Conns != 1 || backends[1].BytesIn != 5 {
+		t.Fatalf("backends = %+v", backends)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`tcpee_connections_closed_total{proxy="proxy",route="front",backend="backend"} 0`,
+		`tcpee_connections_closed_total{proxy="proxy",route="front",backend="fallback"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metrics missing %s", line)
+		}
+	}
+
+	// Draining the fallback rejects conns while unready
+	if !proxy.Drain("fallback", true) {
+		t.Fatal("fallback not found")
+	}
+	if data, err := readAll(mn.dial(t, "front")); err != nil || data != "" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if stats := proxy.Stats(); stats.Rejected != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestStartupWaitClose(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{StartupPolicy: StartupWait})
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+	conn := mn.dial(t, "front")
+
+	closed := make(chan struct{})
+	go func() {
+		proxy.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked on held conn")
+	}
+	if _, err := readAll(conn); err != nil {
+		t.Fatalf("held conn not closed: %v", err)
+	}
+}
+
+// slowDialer delays each dial by a fixed duration.
+type slowDialer struct {
+	Dialer
+	delay time.Duration
+}
+
+func (d *slowDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestStartupLazyAsync(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{StartupPolicy: StartupLazy})
+	proxy.Dialer = &slowDialer{Dialer: mn, delay: 200 * time.Millisecond}
+	mn.echo(t, "backend")
+	mn.echo(t, "fallback")
+
+	// Started without waiting on the backend check
+	start := time.Now()
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend", Fallback: "fallback"})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("start took %v", elapsed)
+	}
+
+	// Conn accepted meanwhile held until the check, then served by the backend
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	if backend := backendOf(t, proxy); backend != "backend" {
+		t.Fatalf("backend = %s", backend)
+	}
+}
@@ -0,0 +1,384 @@
+package tcpee
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/gruf/go-kv"
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+// ProxyStats is a snapshot of the traffic counters of a TCPProxy.
+type ProxyStats struct {
+	// Name is the proxy name.
+	Name string `json:"name"`
+
+	// Open is the no. currently open connections.
+	Open int64 `json:"open"`
+
+	// Conns is the total no. connections served.
+	Conns uint64 `json:"conns"`
+
+	// BytesIn and BytesOut are the total no. bytes proxied
+	// client -> server, and server -> client.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+
+	// Errors is the total no. dial and proxying errors.
+	Errors uint64 `json:"errors"`
+
+	// Rejected is the total no. conns rejected before being served,
+	// of which Denied were denied by ACLs / hooks, and Banned were
+	// from banned sources.
+	Rejected uint64 `json:"rejected"`
+	Denied   uint64 `json:"denied"`
+	Banned   uint64 `json:"banned"`
+
+	// Routes are the per-route stats, ordered by listener.
+	Routes []RouteStats `json:"routes"`
+
+	// Backends are the per-backend stats, ordered by address.
+	Backends []BackendStats `json:"backends"`
+}
+
+// RouteStats is a snapshot of the traffic counters of a single route.
+type RouteStats struct {
+	// Listener is the route listening address.
+	Listener string `json:"listener"`
+
+	// Backend is the route destination address.
+	Backend string `json:"backend"`
+
+	// Counters are the route traffic counters.
+	Counters
+
+	// Fallback indicates the route's backend has been unreachable
+	// since startup, with conns served the fallback behaviour.
+	Fallback bool `json:"fallback,omitempty"`
+
+	// Shadow are the route shadow traffic counters, if shadowed.
+	Shadow *ShadowStats `json:"shadow,omitempty"`
+}
+
+// BackendStats is a snapshot of the traffic counters of a single backend,
+// summed across all of a proxy's routes to it.
+type BackendStats struct {
+	// Backend is the backend address.
+	Backend string `json:"backend"`
+
+	// Drained indicates the backend is draining, see TCPProxy.Drain().
+	Drained bool `json:"drained"`
+
+	// Counters are the backend traffic counters.
+	Counters
+}
+
+// Counters are a snapshot of a set of traffic counters.
+type Counters struct {
+	// Open is the no. currently open connections.
+	Open int64 `json:"open"`
+
+	// Conns is the total no. connections served.
+	Conns uint64 `json:"conns"`
+
+	// BytesIn and BytesOut are the no. bytes proxied
+	// client -> server, and server -> client.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+
+	// Errors is the no. dial and proxying errors.
+	Errors uint64 `json:"errors"`
+
+	// Rejected is the no. conns rejected before being served.
+	Rejected uint64 `json:"rejected"`
+}
+
+// ConnError is a recent connection error.
+type ConnError struct {
+	// Time is the time of the error.
+	Time time.Time `json:"time"`
+
+	// Proxy is the name of the proxy serving the connection.
+	Proxy string `json:"proxy"`
+
+	// ID is the connection ID.
+	ID string `json:"id"`
+
+	// Listener and Backend are the connection's route addresses.
+	Listener string `json:"listener"`
+	Backend  string `json:"backend"`
+
+	// Msg describes the failed operation, e.g. "dial error".
+	Msg string `json:"msg"`
+
+	// Error is the error string.
+	Error string `json:"error"`
+}
+
+// maxConnErrors is the no. recent conn errors kept per proxy.
+const maxConnErrors = 64
+
+// counters are a set of lock-free traffic counters.
+type counters struct {
+	open     int64  // open tracks the no. open conns
+	conns    uint64 // conns tracks the total no. conns
+	bytesIn  uint64 // bytesIn tracks the no. bytes client -> server
+	bytesOut uint64 // bytesOut tracks the no. bytes server -> client
+	errors   uint64 // errors tracks the no. dial / proxying errors
+	rejected uint64 // rejected tracks the no. rejected conns
+}
+
+// backendState holds the state shared by all of a proxy's routes to a backend.
+type backendState struct {
+	counters
+	drained int32 // drained indicates the backend is draining
+}
+
+// openConn increments the open and total conn counters.
+func (c *counters) openConn() {
+	atomic.AddInt64(&c.open, 1)
+	atomic.AddUint64(&c.conns, 1)
+}
+
+// closeConn decrements the open conn counter.
+func (c *counters) closeConn() {
+	atomic.AddInt64(&c.open, -1)
+}
+
+// addBytesIn adds n to the client -> server byte counter.
+func (c *counters) addBytesIn(n int64) {
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+}
+
+// addBytesOut adds n to the server -> client byte counter.
+func (c *counters) addBytesOut(n int64) {
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+}
+
+// addError increments the error counter.
+func (c *counters) addError() {
+	atomic.AddUint64(&c.errors, 1)
+}
+
+// addReject increments the rejected conn counter.
+func (c *counters) addReject() {
+	atomic.AddUint64(&c.rejected, 1)
+}
+
+// snapshot returns a snapshot of the current counter values.
+func (c *counters) snapshot() Counters {
+	return Counters{
+		Open:     atomic.LoadInt64(&c.open),
+		Conns:    atomic.LoadUint64(&c.conns),
+		BytesIn:  atomic.LoadUint64(&c.bytesIn),
+		BytesOut: atomic.LoadUint64(&c.bytesOut),
+		Errors:   atomic.LoadUint64(&c.errors),
+		Rejected: atomic.LoadUint64(&c.rejected),
+	}
+}
+
+// addRoute registers the supplied route for stats tracking, setting
+// its route counters and (shared by address) backend state.
+func (proxy *TCPProxy) addRoute(rt *route) {
+	proxy.rtMutex.Lock()
+	defer proxy.rtMutex.Unlock()
+
+	if rt.stats == nil {
+		// Setup route counters
+		rt.stats = &counters{}
+	}
+
+	if proxy.backends == nil {
+		proxy.backends = make(map[string]*backendState)
+	}
+
+	if rt.bstats == nil {
+		rt.bstats = proxy.backendState(rt.dst)
+	}
+	if rt.fbStats == nil && rt.fallback != "" {
+		rt.fbStats = proxy.backendState(rt.fallback)
+	}
+
+	for _, r := range proxy.routes {
+		if r == rt {
+			// Already registered
+			return
+		}
+	}
+
+	// Watch route ACL while registered
+	ctx, cancel := context.WithCancel(proxy.baseCtx)
+	rt.acl.watch(proxy.Name, ctx.Done())
+	rt.stop = cancel
+
+	proxy.routes = append(proxy.routes, rt)
+}
+
+// backendState returns the backend state for address, shared between
+// routes, creating it if necessary. The route mutex must be held.
+func (proxy *TCPProxy) backendState(addr string) *backendState {
+	b := proxy.backends[addr]
+	if b == nil {
+		b = &backendState{}
+		proxy.backends[addr] = b
+	}
+	return b
+}
+
+// hasRoute returns whether the supplied route is registered.
+func (proxy *TCPProxy) hasRoute(rt *route) bool {
+	proxy.rtMutex.Lock()
+	defer proxy.rtMutex.Unlock()
+	for _, r := range proxy.routes {
+		if r == rt {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRoute unregisters the stopped route from the proxy's stats.
+func (proxy *TCPProxy) removeRoute(rt *route) {
+	proxy.rtMutex.Lock()
+	defer proxy.rtMutex.Unlock()
+	for i, r := range proxy.routes {
+		if r == rt {
+			proxy.routes = append(proxy.routes[:i], proxy.routes[i+1:]...)
+			rt.stop()
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the proxy's current traffic counters,
+// overall and per-route / per-backend.
+func (proxy *TCPProxy) Stats() ProxyStats {
+	// Proxy totals are kept separately from the routes,
+	// so they don't go backwards as routes are stopped
+	totals := proxy.totals.snapshot()
+	stats := ProxyStats{
+		Name:     proxy.Name,
+		Open:     atomic.LoadInt64(&proxy.open),
+		Conns:    totals.Conns,
+		BytesIn:  totals.BytesIn,
+		BytesOut: totals.BytesOut,
+		Errors:   totals.Errors,
+		Rejected: totals.Rejected,
+		Denied:   atomic.LoadUint64(&proxy.denied),
+		Banned:   atomic.LoadUint64(&proxy.banned),
+		Routes:   []RouteStats{},
+		Backends: []BackendStats{},
+	}
+
+	proxy.rtMutex.Lock()
+	for _, rt := range proxy.routes {
+		rs := RouteStats{
+			Listener: rt.src,
+			Backend:  rt.dst,
+			Counters: rt.stats.snapshot(),
+			Fallback: !rt.ready(),
+		}
+		if rt.shadow != nil {
+			rs.Shadow = rt.shadowStats.snapshot(rt.shadow.Addr)
+		}
+		stats.Routes = append(stats.Routes, rs)
+	}
+	for addr, b := range proxy.backends {
+		stats.Backends = append(stats.Backends, BackendStats{
+			Backend:  addr,
+			Drained:  b.draining(),
+			Counters: b.snapshot(),
+		})
+	}
+	proxy.rtMutex.Unlock()
+
+	sort.Slice(stats.Routes, func(i, j int) bool {
+		return stats.Routes[i].Listener < stats.Routes[j].Listener
+	})
+	sort.Slice(stats.Backends, func(i, j int) bool {
+		return stats.Backends[i].Backend < stats.Backends[j].Backend
+	})
+
+	return stats
+}
+
+// Drain sets whether the backend at address (as configured in the proxy's
+// routes) is draining. A draining backend's existing conns are left to
+// finish, while new conns to it are rejected. Returns whether found.
+func (proxy *TCPProxy) Drain(backend string, drain bool) bool {
+	proxy.rtMutex.Lock()
+	b, ok := proxy.backends[backend]
+	proxy.rtMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	var v int32
+	if drain {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&b.drained, v) != v {
+		msg := "backend draining"
+		if !drain {
+			msg = "backend undrained"
+		}
+		log.InfoKVs(kv.Fields{
+			{K: "proxy", V: proxy.Name},
+			{K: "backend", V: backend},
+			{K: "msg", V: msg},
+		}...)
+	}
+
+	return true
+}
+
+// draining returns whether the backend is draining.
+func (b *backendState) draining() bool {
+	return atomic.LoadInt32(&b.drained) == 1
+}
+
+// connError logs and records a dial / proxying error for conn with ID on route, to target.
+func (proxy *TCPProxy) connError(rt *route, t target, id string, msg string, err error) {
+	rt.addError(t)
+
+	log.ErrorKVs(kv.Fields{
+		{K: "proxy", V: proxy.Name},
+		{K: "id", V: id},
+		{K: "error", V: err},
+		{K: "msg", V: msg},
+	}...)
+
+	cerr := ConnError{
+		Time:     time.Now(),
+		Proxy:    proxy.Name,
+		ID:       id,
+		Listener: rt.src,
+		Backend:  t.addr,
+		Msg:      msg,
+		Error:    err.Error(),
+	}
+
+	proxy.errMutex.Lock()
+	if len(proxy.errs) < maxConnErrors {
+		proxy.errs = append(proxy.errs, cerr)
+	} else {
+		proxy.errs[proxy.errNext] = cerr
+	}
+	proxy.errNext = (proxy.errNext + 1) % maxConnErrors
+	proxy.errMutex.Unlock()
+}
+
+// Errors returns the proxy's recent connection errors, newest first.
+func (proxy *TCPProxy) Errors() []ConnError {
+	proxy.errMutex.Lock()
+	errs := make([]ConnError, 0, len(proxy.errs))
+	for i := 1; i <= len(proxy.errs); i++ {
+		j := (proxy.errNext - i + maxConnErrors) % maxConnErrors
+		errs = append(errs, proxy.errs[j])
+	}
+	proxy.errMutex.Unlock()
+	return errs
+}
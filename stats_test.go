@@ -0,0 +1,83 @@
+package tcpee
+
+import (
+	"testing"
+)
+
+func TestStatsTotals(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{Name: "web"})
+	mn.echo(t, "backend")
+	h := startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+	conn.Close()
+	waitOpen(t, proxy, 0)
+
+	// Rejected by draining backend
+	if !proxy.Drain("backend", true) {
+		t.Fatal("backend not found")
+	}
+	_, _ = readAll(mn.dial(t, "front"))
+
+	stats := proxy.Stats()
+	if len(stats.Routes) != 1 || len(stats.Backends) != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	route, backend := stats.Routes[0], stats.Backends[0]
+	for _, c := range []Counters{route.Counters, backend.Counters, {
+		Conns:    stats.Conns,
+		BytesIn:  stats.BytesIn,
+		BytesOut: stats.BytesOut,
+		Rejected: stats.Rejected,
+	}} {
+		if c.Conns != 1 || c.BytesIn != 5 || c.BytesOut != 5 || c.Rejected != 1 {
+			t.Errorf("counters = %+v", c)
+		}
+	}
+	if !backend.Drained {
+		t.Error("backend not drained")
+	}
+
+	// Totals kept after route stopped
+	h.Stop()
+	stats = proxy.Stats()
+	if len(stats.Routes) != 0 {
+		t.Fatalf("stopped route in stats: %+v", stats.Routes)
+	}
+	if stats.Conns != 1 || stats.BytesIn != 5 || stats.Rejected != 1 {
+		t.Fatalf("totals after stop = %+v", stats)
+	}
+}
+
+func TestStatsRejected(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		Hooks: denyHooks{},
+		ACL:   &ACL{Deny: []string{"127.0.0.1"}},
+	})
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "acl", Dst: "backend"})
+	startRoute(t, proxy, Route{Src: "hook", Dst: "backend", ACL: &ACL{}})
+	startRoute(t, proxy, Route{Src: "unready", Dst: "missing", ACL: &ACL{}, Startup: StartupLazy})
+
+	for _, src := range []string{"acl", "hook", "unready"} {
+		_, _ = readAll(mn.dial(t, src))
+	}
+
+	stats := proxy.Stats()
+	if stats.Rejected != 3 || stats.Denied != 2 {
+		t.Fatalf("rejected=%d denied=%d", stats.Rejected, stats.Denied)
+	}
+	var routes uint64
+	for _, r := range stats.Routes {
+		routes += r.Rejected
+	}
+	if routes != stats.Rejected {
+		t.Fatalf("route rejected %d != proxy rejected %d", routes, stats.Rejected)
+	}
+}
+
+// denyHooks are Hooks denying all conns.
+type denyHooks struct{ NopHooks }
+
+func (denyHooks) OnAccept(Conn) bool { return false }
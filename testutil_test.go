@@ -0,0 +1,275 @@
+package tcpee
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/gruf/go-logger/v2/log"
+)
+
+func TestMain(m *testing.M) {
+	// Only log in verbose mode
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// parseIP parses str as an IP, failing the test if invalid.
+func parseIP(t *testing.T, str string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(str)
+	if ip == nil {
+		t.Fatalf("invalid IP %q", str)
+	}
+	return ip
+}
+
+// addrConn is a net.Conn with a fixed remote address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// pipeFrom returns one end of an in-memory conn pair, appearing
+// to be from the supplied remote address, and its peer.
+func pipeFrom(t *testing.T, remote string) (net.Conn, net.Conn) {
+	t.Helper()
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return &addrConn{Conn: c1, addr: addr}, c2
+}
+
+// memNet is an in-memory network of net.Pipe conns, usable
+// as both the TCPProxy Listener and Dialer.
+type memNet struct {
+	mutex sync.Mutex
+	lns   map[string]*memListener
+	ports uint32
+}
+
+// Listen implements Listener.
+func (mn *memNet) Listen(ctx context.Context, network string, address string) (net.Listener, error) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if mn.lns == nil {
+		mn.lns = make(map[string]*memListener)
+	}
+	if _, ok := mn.lns[address]; ok {
+		return nil, fmt.Errorf("address %s in use", address)
+	}
+	ln := &memListener{
+		net:    mn,
+		addr:   memAddr(address),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	mn.lns[address] = ln
+	return ln, nil
+}
+
+// DialContext implements Dialer, blocking until the conn is accepted.
+func (mn *memNet) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	mn.mutex.Lock()
+	ln := mn.lns[address]
+	mn.mutex.Unlock()
+	if ln == nil {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+	c1, c2 := net.Pipe()
+	port := atomic.AddUint32(&mn.ports, 1) + 10000
+	local := memAddr(fmt.Sprintf("127.0.0.1:%d", port))
+	client := &memConn{Conn: c1, local: local, remote: ln.addr}
+	server := &memConn{Conn: c2, local: ln.addr, remote: local}
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.closed:
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial dials address, failing the test on error.
+func (mn *memNet) dial(t *testing.T, address string) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := mn.DialContext(ctx, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echo serves an echo backend on address until the test ends.
+func (mn *memNet) echo(t *testing.T, address string) {
+	t.Helper()
+	ln, err := mn.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+}
+
+// memListener is a memNet listener.
+type memListener struct {
+	net    *memNet
+	addr   memAddr
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.once.Do(func() {
+		ln.net.mutex.Lock()
+		delete(ln.net.lns, string(ln.addr))
+		ln.net.mutex.Unlock()
+		close(ln.closed)
+	})
+	return nil
+}
+
+func (ln *memListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// memConn is a memNet conn, with the
+// client side given an IPv4 loopback address.
+type memConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// memAddr is a memNet address.
+type memAddr string
+
+func (addr memAddr) Network() string { return "mem" }
+func (addr memAddr) String() string  { return string(addr) }
+
+// newMemProxy returns a TCPProxy on a new memNet, closed on test end.
+func newMemProxy(t *testing.T, proxy *TCPProxy) (*TCPProxy, *memNet) {
+	t.Helper()
+	mn := &memNet{}
+	proxy.Listener = mn
+	proxy.Dialer = mn
+	t.Cleanup(proxy.Close)
+	return proxy, mn
+}
+
+// startRoute starts route r on proxy, failing the test on error.
+func startRoute(t *testing.T, proxy *TCPProxy, r Route) *RouteHandle {
+	t.Helper()
+	h, err := proxy.StartRoute(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// roundTrip writes msg to conn, expecting it echoed back.
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("read %q, expected %q", buf, msg)
+	}
+	_ = conn.SetDeadline(time.Time{})
+}
+
+// readAll reads conn until EOF or error, within a second.
+func readAll(conn net.Conn) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(conn)
+	return string(b), err
+}
+
+// waitOpen waits for the proxy's no. open conns to reach n.
+func waitOpen(t *testing.T, proxy *TCPProxy, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for proxy.Stats().Open != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("open conns = %d, expected %d", proxy.Stats().Open, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// recordHooks are Hooks sending each closed conn's access record on records.
+type recordHooks struct {
+	NopHooks
+	records chan AccessRecord
+}
+
+func newRecordHooks() *recordHooks {
+	return &recordHooks{records: make(chan AccessRecord, 16)}
+}
+
+func (h *recordHooks) OnClose(rec AccessRecord, err error) {
+	h.records <- rec
+}
+
+// next returns the next access record, failing the test after a second.
+func (h *recordHooks) next(t *testing.T) AccessRecord {
+	t.Helper()
+	select {
+	case rec := <-h.records:
+		return rec
+	case <-time.After(time.Second):
+		t.Fatal("no access record")
+		return AccessRecord{}
+	}
+}
@@ -0,0 +1,59 @@
+package tcpee
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// Dialer dials conns to backends, e.g. a *net.Dialer or a dialer
+// tunnelling via SSH or a VPN library.
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// Listener opens listeners for routes, e.g. a *net.ListenConfig or a
+// TLS or in-memory listener implementation. See also TCPProxy.Serve()
+// for serving already opened listeners.
+//
+// Accepted conns whose remote address has no IP, e.g. from in-memory or
+// unix socket listeners, are exempt from per-source limits and bans, and
+// match no ACL entries, i.e. are denied only by ACLs with allow entries.
+type Listener interface {
+	Listen(ctx context.Context, network string, address string) (net.Listener, error)
+}
+
+// tcpAddr returns addr as a TCP address, parsing non-TCP addresses of
+// "{ip}:{port}" form. Addresses without an IP (e.g. in-memory transports)
+// are returned as the unspecified IPv4 address, for logging and capture.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if tcp := parseTCPAddr(addr); tcp != nil {
+		return tcp
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// sourceIP returns the IP of the supplied conn remote address,
+// or nil if it has none, see Listener.
+func sourceIP(addr net.Addr) net.IP {
+	if tcp := parseTCPAddr(addr); tcp != nil {
+		return tcp.IP
+	}
+	return nil
+}
+
+// parseTCPAddr returns addr as a TCP address, parsing non-TCP addresses
+// of "{ip}:{port}" form, or nil for addresses without an IP.
+func parseTCPAddr(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+	if addr != nil {
+		host, port, err := net.SplitHostPort(addr.String())
+		if ip := net.ParseIP(host); err == nil && ip != nil {
+			p, _ := strconv.Atoi(port)
+			return &net.TCPAddr{IP: ip, Port: p}
+		}
+	}
+	return nil
+}
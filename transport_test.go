@@ -0,0 +1,150 @@
+package tcpee
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPAddr(t *testing.T) {
+	for _, test := range []struct {
+		addr net.Addr
+		str  string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, "192.0.2.1:80"},
+		{memAddr("127.0.0.1:1234"), "127.0.0.1:1234"},
+		{memAddr("[2001:db8::1]:443"), "[2001:db8::1]:443"},
+		{memAddr("backend"), "0.0.0.0:0"},
+		{memAddr("example.com:80"), "0.0.0.0:0"},
+		{nil, "0.0.0.0:0"},
+	} {
+		if str := tcpAddr(test.addr).String(); str != test.str {
+			t.Errorf("tcpAddr(%v) = %s, expected %s", test.addr, str, test.str)
+		}
+	}
+}
+
+func TestNonIPSource(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{
+		SourceMaxConns: 1,
+		Bans:           &Banlist{Threshold: 1, Window: time.Minute, BanTime: time.Minute},
+		ACL:            &ACL{Deny: []string{"0.0.0.0/0", "::/0"}},
+	})
+	mn.echo(t, "backend")
+	rt, err := proxy.newRoute(Route{Src: "front", Dst: "backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := sourceIP(memAddr("client")); ip != nil {
+		t.Fatalf("sourceIP = %v", ip)
+	}
+
+	// Exempt from source limits, bans and ACL deny entries
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c1.Close(); c2.Close() })
+		if _, ok := proxy.admit(&addrConn{Conn: c1, addr: memAddr("client")}, rt); !ok {
+			t.Fatalf("conn %d not admitted", i+1)
+		}
+		proxy.Bans.Record(nil, EventEmptyConn)
+	}
+	if bans := proxy.Bans.Bans(); len(bans) != 0 {
+		t.Fatalf("bans = %+v", bans)
+	}
+
+	// Denied by ACL allow entries
+	rt.acl = &ACL{Allow: []string{"192.0.2.0/24"}}
+	if err := rt.acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	if _, ok := proxy.admit(&addrConn{Conn: c1, addr: memAddr("client")}, rt); ok {
+		t.Fatal("conn admitted by allow-list")
+	}
+}
+
+func TestServe(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	mn.echo(t, "backend")
+
+	ln, err := mn.Listen(context.Background(), "tcp", "front")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve(ln, "backend") }()
+
+	conn := mn.dial(t, "front")
+	roundTrip(t, conn, "hello")
+
+	// Route src set from the listener
+	if routes := proxy.Stats().Routes; len(routes) != 1 || routes[0].Listener != "front" || routes[0].Backend != "backend" {
+		t.Fatalf("routes = %+v", routes)
+	}
+
+	proxy.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return on close")
+	}
+	if len(proxy.Stats().Routes) != 0 {
+		t.Fatal("closed route in stats")
+	}
+
+	// Listener closed on return
+	if _, err := mn.DialContext(context.Background(), "tcp", "front"); err == nil {
+		t.Fatal("listener not closed")
+	}
+}
+
+func TestServeStrict(t *testing.T) {
+	proxy, mn := newMemProxy(t, &TCPProxy{})
+	ln, err := mn.Listen(context.Background(), "tcp", "front")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unreachable backend fails strict route, closing listener
+	if err := proxy.Serve(ln, "backend"); err == nil {
+		t.Fatal("served unreachable backend")
+	}
+	if _, err := mn.DialContext(context.Background(), "tcp", "front"); err == nil {
+		t.Fatal("listener not closed")
+	}
+}
+
+// failDialer is a Dialer failing all dials after the first.
+type failDialer struct {
+	*memNet
+	dials int
+}
+
+func (d *failDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if d.dials++; d.dials > 1 {
+		return nil, errors.New("dial failed")
+	}
+	return d.memNet.DialContext(ctx, network, address)
+}
+
+func TestDialerError(t *testing.T) {
+	hooks := newRecordHooks()
+	proxy, mn := newMemProxy(t, &TCPProxy{Hooks: hooks})
+	proxy.Dialer = &failDialer{memNet: mn}
+	mn.echo(t, "backend")
+	startRoute(t, proxy, Route{Src: "front", Dst: "backend"})
+
+	if data, err := readAll(mn.dial(t, "front")); err != nil || data != "" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if rec := hooks.next(t); rec.Reason != ReasonDial {
+		t.Fatalf("record = %+v", rec)
+	}
+	if stats := proxy.Stats(); stats.Errors != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}